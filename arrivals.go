@@ -0,0 +1,58 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// arrivals generates the times between the arrivals of a stream of rounds or
+// requests according to an arrival process.
+type arrivals struct {
+	conf ArrivalConfig
+	rng  *rand.Rand
+	// left is the number of arrivals left in the current burst.
+	left int
+}
+
+// newArrivals returns the arrivals of the named stream. Streams with the same
+// seed but different names get different random sequences.
+func newArrivals(conf ArrivalConfig, stream string) *arrivals {
+	a := &arrivals{conf: conf}
+	switch conf.Process {
+	case arrivalUniform, arrivalPoisson:
+		seed := conf.Seed
+		if seed == 0 {
+			seed = rand.Uint64()
+		}
+		log.Printf("%s: %s arrivals with seed %d\n", stream, conf.Process, seed)
+
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(stream))
+		a.rng = rand.New(rand.NewPCG(seed, h.Sum64()))
+	case arrivalBurst:
+		log.Printf("%s: arrivals in bursts of %d\n", stream, conf.Burst)
+		a.left = conf.Burst - 1
+	}
+	return a
+}
+
+// next returns the time until the next arrival. On average it is mean.
+func (a *arrivals) next(mean time.Duration) time.Duration {
+	switch a.conf.Process {
+	case arrivalUniform:
+		return time.Duration(float64(mean) * (1 + a.conf.Jitter*(2*a.rng.Float64()-1)))
+	case arrivalPoisson:
+		return time.Duration(float64(mean) * a.rng.ExpFloat64())
+	case arrivalBurst:
+		if a.left > 0 {
+			a.left--
+			return 0
+		}
+		a.left = a.conf.Burst - 1
+		return mean * time.Duration(a.conf.Burst)
+	default:
+		return mean
+	}
+}
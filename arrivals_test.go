@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArrivalsFixed(t *testing.T) {
+	a := newArrivals(ArrivalConfig{Process: arrivalFixed}, "test")
+	for i := 0; i < 3; i++ {
+		if got := a.next(time.Second); got != time.Second {
+			t.Errorf("next() = %v, want %v", got, time.Second)
+		}
+	}
+}
+
+func TestArrivalsBurst(t *testing.T) {
+	a := newArrivals(ArrivalConfig{Process: arrivalBurst, Burst: 3}, "test")
+	want := []time.Duration{0, 0, 3 * time.Second, 0, 0, 3 * time.Second}
+	for i, w := range want {
+		if got := a.next(time.Second); got != w {
+			t.Errorf("arrival %d: next() = %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestArrivalsUniform(t *testing.T) {
+	a := newArrivals(ArrivalConfig{Process: arrivalUniform, Jitter: 0.2, Seed: 1}, "test")
+	for i := 0; i < 1000; i++ {
+		if got := a.next(time.Second); got < 800*time.Millisecond || got > 1200*time.Millisecond {
+			t.Fatalf("next() = %v, want within 20%% of %v", got, time.Second)
+		}
+	}
+}
+
+func TestArrivalsPoisson(t *testing.T) {
+	a := newArrivals(ArrivalConfig{Process: arrivalPoisson, Seed: 1}, "test")
+	const n = 10000
+	var sum time.Duration
+	for i := 0; i < n; i++ {
+		got := a.next(time.Second)
+		if got < 0 {
+			t.Fatalf("next() = %v, want a positive duration", got)
+		}
+		sum += got
+	}
+	if mean := sum / n; mean < 950*time.Millisecond || mean > 1050*time.Millisecond {
+		t.Errorf("mean of next() = %v, want close to %v", mean, time.Second)
+	}
+}
+
+func TestArrivalsSeed(t *testing.T) {
+	conf := ArrivalConfig{Process: arrivalPoisson, Seed: 42}
+	draw := func(stream string) []time.Duration {
+		a := newArrivals(conf, stream)
+		ds := make([]time.Duration, 10)
+		for i := range ds {
+			ds[i] = a.next(time.Second)
+		}
+		return ds
+	}
+
+	first, again, other := draw("merge"), draw("merge"), draw("range")
+	for i := range first {
+		if first[i] != again[i] {
+			t.Fatalf("arrivals of the same stream and seed differ: %v and %v", first, again)
+		}
+	}
+	same := true
+	for i := range first {
+		same = same && first[i] == other[i]
+	}
+	if same {
+		t.Errorf("arrivals of different streams are the same: %v", first)
+	}
+}
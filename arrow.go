@@ -0,0 +1,949 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+)
+
+// The Arrow IPC format is read and written without the Arrow library, which
+// parca-load doesn't depend on. Only the parts needed to read the string
+// columns of flamegraph records and to write the records of the agents'
+// Write stream are implemented, and all other columns are skipped.
+
+// Arrow type ids of the flatbuffers Type union. Types that are not listed
+// are only skipped, which works the same for all of them.
+const (
+	arrowTypeNull          = 1
+	arrowTypeInt           = 2
+	arrowTypeBinary        = 4
+	arrowTypeUtf8          = 5
+	arrowTypeBool          = 6
+	arrowTypeList          = 12
+	arrowTypeStruct        = 13
+	arrowTypeUnion         = 14
+	arrowTypeFixedSizeList = 16
+	arrowTypeLargeBinary   = 19
+	arrowTypeLargeUtf8     = 20
+	arrowTypeRunEndEncoded = 22
+	arrowTypeBinaryView    = 23
+	arrowTypeUtf8View      = 24
+	arrowTypeListView      = 25
+	arrowTypeLargeListView = 26
+
+	arrowUnionModeDense = 1
+)
+
+// Arrow IPC message header types.
+const (
+	arrowMessageSchema      = 1
+	arrowMessageDictionary  = 2
+	arrowMessageRecordBatch = 3
+)
+
+const (
+	// arrowContinuationMarker precedes the metadata size of each message.
+	arrowContinuationMarker = 0xFFFFFFFF
+	// arrowMaxMetadataSize bounds the metadata of a message, so that broken
+	// streams fail instead of allocating.
+	arrowMaxMetadataSize = 1 << 26
+)
+
+// flatbuffer reads tables of a flatbuffer. Reads out of bounds set err and
+// return zero values, so that a broken message is only checked for errors
+// once it was read.
+type flatbuffer struct {
+	buf []byte
+	err error
+}
+
+func (f *flatbuffer) in(pos, n int) bool {
+	if f.err != nil {
+		return false
+	}
+	if pos < 0 || n < 0 || pos > len(f.buf)-n {
+		f.err = fmt.Errorf("flatbuffer: read of %d bytes at %d out of bounds of %d bytes", n, pos, len(f.buf))
+		return false
+	}
+	return true
+}
+
+func (f *flatbuffer) u8(pos int) uint8 {
+	if !f.in(pos, 1) {
+		return 0
+	}
+	return f.buf[pos]
+}
+
+func (f *flatbuffer) u16(pos int) uint16 {
+	if !f.in(pos, 2) {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(f.buf[pos:])
+}
+
+func (f *flatbuffer) u32(pos int) uint32 {
+	if !f.in(pos, 4) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(f.buf[pos:])
+}
+
+func (f *flatbuffer) u64(pos int) uint64 {
+	if !f.in(pos, 8) {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(f.buf[pos:])
+}
+
+// indirect follows the offset stored at pos.
+func (f *flatbuffer) indirect(pos int) int {
+	return pos + int(f.u32(pos))
+}
+
+// root returns the root table of the flatbuffer.
+func (f *flatbuffer) root() fbTable {
+	return fbTable{fb: f, pos: f.indirect(0)}
+}
+
+// fbTable is a table of a flatbuffer.
+type fbTable struct {
+	fb  *flatbuffer
+	pos int
+}
+
+// field returns the position of the field in the given vtable slot, or zero
+// if the field is not set.
+func (t fbTable) field(slot int) int {
+	vtable := t.pos - int(int32(t.fb.u32(t.pos)))
+	size := int(t.fb.u16(vtable))
+	if 4+2*slot+2 > size {
+		return 0
+	}
+	off := int(t.fb.u16(vtable + 4 + 2*slot))
+	if off == 0 {
+		return 0
+	}
+	return t.pos + off
+}
+
+func (t fbTable) u8(slot int) uint8 {
+	if pos := t.field(slot); pos != 0 {
+		return t.fb.u8(pos)
+	}
+	return 0
+}
+
+func (t fbTable) bool(slot int) bool {
+	return t.u8(slot) != 0
+}
+
+func (t fbTable) i16(slot int) int16 {
+	if pos := t.field(slot); pos != 0 {
+		return int16(t.fb.u16(pos))
+	}
+	return 0
+}
+
+func (t fbTable) i32(slot int) int32 {
+	if pos := t.field(slot); pos != 0 {
+		return int32(t.fb.u32(pos))
+	}
+	return 0
+}
+
+func (t fbTable) i64(slot int) int64 {
+	if pos := t.field(slot); pos != 0 {
+		return int64(t.fb.u64(pos))
+	}
+	return 0
+}
+
+// table returns the table the field in the slot refers to.
+func (t fbTable) table(slot int) (fbTable, bool) {
+	pos := t.field(slot)
+	if pos == 0 {
+		return fbTable{}, false
+	}
+	return fbTable{fb: t.fb, pos: t.fb.indirect(pos)}, true
+}
+
+// vector returns the position of the first element and the length of the
+// vector in the slot.
+func (t fbTable) vector(slot int) (int, int) {
+	pos := t.field(slot)
+	if pos == 0 {
+		return 0, 0
+	}
+	vec := t.fb.indirect(pos)
+	n := int(t.fb.u32(vec))
+	return vec + 4, n
+}
+
+// tables returns the tables of the vector of tables in the slot.
+func (t fbTable) tables(slot int) []fbTable {
+	pos, n := t.vector(slot)
+	if !t.fb.in(pos, 4*n) {
+		return nil
+	}
+	tables := make([]fbTable, n)
+	for i := range tables {
+		tables[i] = fbTable{fb: t.fb, pos: t.fb.indirect(pos + 4*i)}
+	}
+	return tables
+}
+
+func (t fbTable) string(slot int) string {
+	pos, n := t.vector(slot)
+	if !t.fb.in(pos, n) {
+		return ""
+	}
+	return string(t.fb.buf[pos : pos+n])
+}
+
+// arrowField is a field of an Arrow schema.
+type arrowField struct {
+	name string
+	// typ is the Arrow type id, and for dictionary-encoded fields the type
+	// of the dictionary values.
+	typ uint8
+	// bitWidth and signed describe Int types.
+	bitWidth int
+	signed   bool
+	// dense is set for dense unions.
+	dense bool
+	// dictionary describes the indices of dictionary-encoded fields.
+	dictionary *arrowDictionary
+	children   []arrowField
+}
+
+// arrowDictionary is the dictionary encoding of a field.
+type arrowDictionary struct {
+	id       int64
+	bitWidth int
+	signed   bool
+}
+
+func readArrowField(t fbTable) arrowField {
+	f := arrowField{
+		name: t.string(0),
+		typ:  t.u8(2),
+	}
+	if typ, ok := t.table(3); ok {
+		switch f.typ {
+		case arrowTypeInt:
+			f.bitWidth, f.signed = int(typ.i32(0)), typ.bool(1)
+		case arrowTypeUnion:
+			f.dense = typ.i16(0) == arrowUnionModeDense
+		}
+	}
+	if dict, ok := t.table(4); ok {
+		f.dictionary = &arrowDictionary{id: dict.i64(0), bitWidth: 32, signed: true}
+		if index, ok := dict.table(1); ok {
+			f.dictionary.bitWidth, f.dictionary.signed = int(index.i32(0)), index.bool(1)
+		}
+	}
+	for _, child := range t.tables(5) {
+		f.children = append(f.children, readArrowField(child))
+	}
+	return f
+}
+
+// dictionaries adds the dictionary-encoded fields of the field and its
+// children by dictionary id.
+func (f arrowField) dictionaries(fields map[int64]arrowField) {
+	if f.dictionary != nil {
+		value := f
+		value.dictionary = nil
+		fields[f.dictionary.id] = value
+	}
+	for _, child := range f.children {
+		child.dictionaries(fields)
+	}
+}
+
+// arrowArray is the data of a field in a record batch.
+type arrowArray struct {
+	field    arrowField
+	length   int
+	nulls    int
+	buffers  [][]byte
+	children []arrowArray
+}
+
+// recordBatchReader hands out the field nodes and buffers of a record batch
+// in the order the fields of the schema are visited, depth first.
+type recordBatchReader struct {
+	fb       *flatbuffer
+	body     []byte
+	nodes    int
+	numNodes int
+	buffers  int
+	numBufs  int
+	variadic []int64
+	length   int
+}
+
+func newRecordBatchReader(batch fbTable, body []byte) (*recordBatchReader, error) {
+	if _, ok := batch.table(3); ok {
+		return nil, errors.New("compressed record batches are not supported")
+	}
+	r := &recordBatchReader{fb: batch.fb, body: body, length: int(batch.i64(0))}
+	r.nodes, r.numNodes = batch.vector(1)
+	r.buffers, r.numBufs = batch.vector(2)
+	pos, n := batch.vector(4)
+	for i := range n {
+		r.variadic = append(r.variadic, int64(batch.fb.u64(pos+8*i)))
+	}
+	return r, batch.fb.err
+}
+
+// bufferCount returns how many buffers an array of the field has.
+func (r *recordBatchReader) bufferCount(f arrowField) (int, error) {
+	if f.dictionary != nil {
+		return 2, nil
+	}
+	switch f.typ {
+	case arrowTypeNull, arrowTypeRunEndEncoded:
+		return 0, nil
+	case arrowTypeStruct, arrowTypeFixedSizeList:
+		return 1, nil
+	case arrowTypeUnion:
+		if f.dense {
+			return 2, nil
+		}
+		return 1, nil
+	case arrowTypeBinary, arrowTypeUtf8, arrowTypeLargeBinary, arrowTypeLargeUtf8, arrowTypeListView, arrowTypeLargeListView:
+		return 3, nil
+	case arrowTypeBinaryView, arrowTypeUtf8View:
+		if len(r.variadic) == 0 {
+			return 0, errors.New("view array without variadic buffer count")
+		}
+		n := r.variadic[0]
+		r.variadic = r.variadic[1:]
+		if n < 0 || n > math.MaxInt32 {
+			return 0, fmt.Errorf("invalid variadic buffer count %d", n)
+		}
+		return 2 + int(n), nil
+	default:
+		// Lists and maps have validity and offsets, and all fixed-width
+		// types validity and values.
+		return 2, nil
+	}
+}
+
+// array reads the array of the field and of its children.
+func (r *recordBatchReader) array(f arrowField) (arrowArray, error) {
+	if r.numNodes == 0 {
+		return arrowArray{}, errors.New("record batch has fewer field nodes than the schema has fields")
+	}
+	a := arrowArray{
+		field:  f,
+		length: int(int64(r.fb.u64(r.nodes))),
+		nulls:  int(int64(r.fb.u64(r.nodes + 8))),
+	}
+	r.nodes += 16
+	r.numNodes--
+
+	n, err := r.bufferCount(f)
+	if err != nil {
+		return arrowArray{}, err
+	}
+	for range n {
+		if r.numBufs == 0 {
+			return arrowArray{}, errors.New("record batch has fewer buffers than its fields need")
+		}
+		offset, length := int64(r.fb.u64(r.buffers)), int64(r.fb.u64(r.buffers+8))
+		r.buffers += 16
+		r.numBufs--
+		if offset < 0 || length < 0 || offset > int64(len(r.body)) || length > int64(len(r.body))-offset {
+			return arrowArray{}, fmt.Errorf("buffer of %d bytes at %d out of bounds of the %d byte body", length, offset, len(r.body))
+		}
+		a.buffers = append(a.buffers, r.body[offset:offset+length])
+	}
+	if a.length < 0 || a.nulls < 0 {
+		return arrowArray{}, fmt.Errorf("field %q has a negative length", f.name)
+	}
+
+	// The children of dictionary-encoded fields are those of the values,
+	// which are part of the dictionary batches.
+	if f.dictionary == nil {
+		for _, child := range f.children {
+			c, err := r.array(child)
+			if err != nil {
+				return arrowArray{}, err
+			}
+			a.children = append(a.children, c)
+		}
+	}
+	return a, r.fb.err
+}
+
+// valid reports whether the value at index i is not null.
+func (a arrowArray) valid(i int) bool {
+	if a.nulls == 0 || len(a.buffers) == 0 || len(a.buffers[0]) == 0 {
+		return true
+	}
+	return i/8 < len(a.buffers[0]) && a.buffers[0][i/8]&(1<<(i%8)) != 0
+}
+
+// integers returns the values of an integer buffer of the given width.
+func integers(buf []byte, length, bitWidth int, signed bool) ([]int64, error) {
+	size := bitWidth / 8
+	if size != 1 && size != 2 && size != 4 && size != 8 {
+		return nil, fmt.Errorf("unsupported integer width %d", bitWidth)
+	}
+	if length > len(buf)/size {
+		return nil, fmt.Errorf("%d integers don't fit into %d bytes", length, len(buf))
+	}
+	values := make([]int64, length)
+	for i := range values {
+		switch {
+		case size == 1 && signed:
+			values[i] = int64(int8(buf[i]))
+		case size == 1:
+			values[i] = int64(buf[i])
+		case size == 2 && signed:
+			values[i] = int64(int16(binary.LittleEndian.Uint16(buf[2*i:])))
+		case size == 2:
+			values[i] = int64(binary.LittleEndian.Uint16(buf[2*i:]))
+		case size == 4 && signed:
+			values[i] = int64(int32(binary.LittleEndian.Uint32(buf[4*i:])))
+		case size == 4:
+			values[i] = int64(binary.LittleEndian.Uint32(buf[4*i:]))
+		default:
+			values[i] = int64(binary.LittleEndian.Uint64(buf[8*i:]))
+		}
+	}
+	return values, nil
+}
+
+// strings returns the values of a binary or string array, which may be
+// dictionary-encoded or run-end encoded. Nulls are empty strings.
+func (a arrowArray) strings(dictionaries map[int64][]string) ([]string, error) {
+	values := make([]string, a.length)
+	if d := a.field.dictionary; d != nil {
+		indices, err := integers(a.buffers[1], a.length, d.bitWidth, d.signed)
+		if err != nil {
+			return nil, err
+		}
+		dict := dictionaries[d.id]
+		for i, index := range indices {
+			if !a.valid(i) {
+				continue
+			}
+			if index < 0 || index >= int64(len(dict)) {
+				return nil, fmt.Errorf("field %q: index %d out of bounds of dictionary %d with %d values", a.field.name, index, d.id, len(dict))
+			}
+			values[i] = dict[index]
+		}
+		return values, nil
+	}
+
+	switch a.field.typ {
+	case arrowTypeBinary, arrowTypeUtf8, arrowTypeLargeBinary, arrowTypeLargeUtf8:
+		width := 32
+		if a.field.typ == arrowTypeLargeBinary || a.field.typ == arrowTypeLargeUtf8 {
+			width = 64
+		}
+		offsets, err := integers(a.buffers[1], a.length+1, width, true)
+		if err != nil {
+			return nil, err
+		}
+		data := a.buffers[2]
+		for i := range values {
+			start, end := offsets[i], offsets[i+1]
+			if start < 0 || start > end || end > int64(len(data)) {
+				return nil, fmt.Errorf("field %q: value %d out of bounds", a.field.name, i)
+			}
+			if a.valid(i) {
+				values[i] = string(data[start:end])
+			}
+		}
+		return values, nil
+	case arrowTypeRunEndEncoded:
+		if len(a.children) != 2 || a.children[0].field.typ != arrowTypeInt {
+			return nil, fmt.Errorf("field %q: invalid run-end encoding", a.field.name)
+		}
+		runEnds := a.children[0]
+		ends, err := integers(runEnds.buffers[1], runEnds.length, runEnds.field.bitWidth, true)
+		if err != nil {
+			return nil, err
+		}
+		runs, err := a.children[1].strings(dictionaries)
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) < len(ends) {
+			return nil, fmt.Errorf("field %q: fewer values than runs", a.field.name)
+		}
+		var run int
+		for i := range values {
+			for run < len(ends) && ends[run] <= int64(i) {
+				run++
+			}
+			if run == len(ends) {
+				return nil, fmt.Errorf("field %q: runs end before the array", a.field.name)
+			}
+			values[i] = runs[run]
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("field %q: type %d is not a binary or string type", a.field.name, a.field.typ)
+	}
+}
+
+// readArrowStrings reads an Arrow IPC stream and returns the values of the
+// named binary or string columns of all its record batches, row by row.
+// Columns that the stream doesn't have are left out.
+func readArrowStrings(stream []byte, columns ...string) (map[string][]string, error) {
+	var (
+		schema       []arrowField
+		dictFields   = map[int64]arrowField{}
+		dictionaries = map[int64][]string{}
+		values       = map[string][]string{}
+	)
+
+	for len(stream) > 0 {
+		if len(stream) < 4 {
+			return nil, errors.New("truncated message")
+		}
+		size := binary.LittleEndian.Uint32(stream)
+		stream = stream[4:]
+		// Streams written before Arrow 0.15 have no continuation marker.
+		if size == arrowContinuationMarker {
+			if len(stream) < 4 {
+				return nil, errors.New("truncated message")
+			}
+			size = binary.LittleEndian.Uint32(stream)
+			stream = stream[4:]
+		}
+		if size == 0 {
+			break
+		}
+		if size > arrowMaxMetadataSize || int(size) > len(stream) {
+			return nil, fmt.Errorf("message metadata of %d bytes exceeds the stream", size)
+		}
+		fb := &flatbuffer{buf: stream[:size]}
+		stream = stream[size:]
+
+		message := fb.root()
+		headerType := message.u8(1)
+		header, ok := message.table(2)
+		bodyLength := message.i64(3)
+		if fb.err != nil {
+			return nil, fb.err
+		}
+		if !ok {
+			return nil, errors.New("message without header")
+		}
+		if bodyLength < 0 || bodyLength > int64(len(stream)) {
+			return nil, fmt.Errorf("message body of %d bytes exceeds the stream", bodyLength)
+		}
+		body := stream[:bodyLength]
+		stream = stream[bodyLength:]
+
+		switch headerType {
+		case arrowMessageSchema:
+			schema = nil
+			for _, t := range header.tables(1) {
+				f := readArrowField(t)
+				f.dictionaries(dictFields)
+				schema = append(schema, f)
+			}
+			if fb.err != nil {
+				return nil, fb.err
+			}
+		case arrowMessageDictionary:
+			id := header.i64(0)
+			data, ok := header.table(1)
+			field, known := dictFields[id]
+			if !ok || !known {
+				return nil, fmt.Errorf("dictionary %d without data or field", id)
+			}
+			r, err := newRecordBatchReader(data, body)
+			if err != nil {
+				return nil, err
+			}
+			a, err := r.array(field)
+			if err != nil {
+				return nil, err
+			}
+			dict, err := a.strings(dictionaries)
+			if err != nil {
+				return nil, fmt.Errorf("dictionary %d: %w", id, err)
+			}
+			if header.bool(2) {
+				dict = append(dictionaries[id], dict...)
+			}
+			dictionaries[id] = dict
+		case arrowMessageRecordBatch:
+			if schema == nil {
+				return nil, errors.New("record batch before the schema")
+			}
+			r, err := newRecordBatchReader(header, body)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range schema {
+				a, err := r.array(f)
+				if err != nil {
+					return nil, err
+				}
+				for _, column := range columns {
+					if f.name != column {
+						continue
+					}
+					v, err := a.strings(dictionaries)
+					if err != nil {
+						return nil, err
+					}
+					values[column] = append(values[column], v...)
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+// fbObject is a flatbuffers table, vector or string to write.
+type fbObject interface {
+	// write appends the object and returns the position that offsets to it
+	// point at.
+	write(b *fbBuilder) int
+}
+
+// fbField is a field of a table: a scalar of size bytes, or an offset to ref.
+// Fields that are neither are not set.
+type fbField struct {
+	size  int
+	value uint64
+	ref   fbObject
+}
+
+func fbScalar(size int, value uint64) fbField { return fbField{size: size, value: value} }
+func fbRef(ref fbObject) fbField              { return fbField{ref: ref} }
+
+// fbTableDef is a table with its fields by slot.
+type fbTableDef []fbField
+
+// fbTables is a vector of tables.
+type fbTables []fbObject
+
+// fbStructs is a vector of 16 byte structs, such as field nodes and buffers.
+type fbStructs [][2]int64
+
+type fbString string
+
+// fbBuilder writes flatbuffers front to back: every object is followed by
+// the objects it refers to, so that all offsets point forward.
+type fbBuilder struct {
+	buf []byte
+}
+
+func (b *fbBuilder) pad(align, rem int) {
+	for len(b.buf)%align != rem {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *fbBuilder) patch(pos, target int) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(target-pos))
+}
+
+func (t fbTableDef) write(b *fbBuilder) int {
+	var present []int
+	for slot, f := range t {
+		if f.size > 0 || f.ref != nil {
+			present = append(present, slot)
+		}
+	}
+
+	// Every field takes an 8 byte slot, and the table starts 4 bytes before
+	// an 8 byte boundary, so that all fields are aligned.
+	b.pad(2, 0)
+	vtable := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(4+2*len(t)))
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(4+8*len(present)))
+	k := 0
+	for _, f := range t {
+		if f.size == 0 && f.ref == nil {
+			b.buf = binary.LittleEndian.AppendUint16(b.buf, 0)
+			continue
+		}
+		b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(4+8*k))
+		k++
+	}
+	b.pad(8, 4)
+	table := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(int32(table-vtable)))
+
+	refs := map[int]fbObject{}
+	for _, slot := range present {
+		f := t[slot]
+		if f.ref != nil {
+			refs[len(b.buf)] = f.ref
+		}
+		b.buf = binary.LittleEndian.AppendUint64(b.buf, f.value)
+	}
+	for _, pos := range slices.Sorted(maps.Keys(refs)) {
+		b.patch(pos, refs[pos].write(b))
+	}
+	return table
+}
+
+func (v fbTables) write(b *fbBuilder) int {
+	b.pad(4, 0)
+	pos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+	b.buf = append(b.buf, make([]byte, 4*len(v))...)
+	for i, t := range v {
+		b.patch(pos+4+4*i, t.write(b))
+	}
+	return pos
+}
+
+func (v fbStructs) write(b *fbBuilder) int {
+	b.pad(8, 4)
+	pos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+	for _, s := range v {
+		b.buf = binary.LittleEndian.AppendUint64(b.buf, uint64(s[0]))
+		b.buf = binary.LittleEndian.AppendUint64(b.buf, uint64(s[1]))
+	}
+	return pos
+}
+
+func (s fbString) write(b *fbBuilder) int {
+	b.pad(4, 0)
+	pos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(s)))
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	return pos
+}
+
+// fbFinish returns the flatbuffer with the given root table.
+func fbFinish(root fbObject) []byte {
+	b := &fbBuilder{buf: make([]byte, 4)}
+	b.patch(0, root.write(b))
+	b.pad(8, 0)
+	return b.buf
+}
+
+// fieldTable returns the schema table of the field. All fields are nullable.
+func fieldTable(f arrowField) fbTableDef {
+	typ := fbTableDef{}
+	if f.typ == arrowTypeInt {
+		typ = fbTableDef{fbScalar(4, uint64(f.bitWidth)), fbScalar(1, boolValue(f.signed))}
+	}
+	children := fbTables{}
+	if f.dictionary == nil {
+		for _, child := range f.children {
+			children = append(children, fieldTable(child))
+		}
+	}
+	t := fbTableDef{
+		fbRef(fbString(f.name)),
+		fbScalar(1, 1),
+		fbScalar(1, uint64(f.typ)),
+		fbRef(typ),
+		{},
+		fbRef(children),
+	}
+	if d := f.dictionary; d != nil {
+		t[4] = fbRef(fbTableDef{
+			fbScalar(8, uint64(d.id)),
+			fbRef(fbTableDef{fbScalar(4, uint64(d.bitWidth)), fbScalar(1, boolValue(d.signed))}),
+		})
+	}
+	return t
+}
+
+func boolValue(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// appendMessage appends a message with the header and body to the stream.
+func appendMessage(stream []byte, headerType uint8, header fbTableDef, body []byte) []byte {
+	meta := fbFinish(fbTableDef{
+		fbScalar(2, 4), // V5
+		fbScalar(1, uint64(headerType)),
+		fbRef(header),
+		fbScalar(8, uint64(len(body))),
+	})
+	stream = binary.LittleEndian.AppendUint32(stream, arrowContinuationMarker)
+	stream = binary.LittleEndian.AppendUint32(stream, uint32(len(meta)))
+	stream = append(stream, meta...)
+	return append(stream, body...)
+}
+
+// recordBatch returns the record batch table and body of the arrays.
+func recordBatch(length int, arrays []arrowArray) (fbTableDef, []byte) {
+	var (
+		nodes   fbStructs
+		buffers fbStructs
+		body    []byte
+	)
+	var add func(a arrowArray)
+	add = func(a arrowArray) {
+		nodes = append(nodes, [2]int64{int64(a.length), int64(a.nulls)})
+		for _, buf := range a.buffers {
+			buffers = append(buffers, [2]int64{int64(len(body)), int64(len(buf))})
+			body = append(body, buf...)
+			for len(body)%8 != 0 {
+				body = append(body, 0)
+			}
+		}
+		if a.field.dictionary == nil {
+			for _, child := range a.children {
+				add(child)
+			}
+		}
+	}
+	for _, a := range arrays {
+		add(a)
+	}
+	return fbTableDef{fbScalar(8, uint64(length)), fbRef(nodes), fbRef(buffers)}, body
+}
+
+func appendSchema(stream []byte, fields ...arrowField) []byte {
+	tables := fbTables{}
+	for _, f := range fields {
+		tables = append(tables, fieldTable(f))
+	}
+	return appendMessage(stream, arrowMessageSchema, fbTableDef{{}, fbRef(tables)}, nil)
+}
+
+func appendDictionary(stream []byte, id int64, delta bool, values arrowArray) []byte {
+	batch, body := recordBatch(values.length, []arrowArray{values})
+	return appendMessage(stream, arrowMessageDictionary, fbTableDef{fbScalar(8, uint64(id)), fbRef(batch), fbScalar(1, boolValue(delta))}, body)
+}
+
+func appendRecordBatch(stream []byte, length int, arrays ...arrowArray) []byte {
+	batch, body := recordBatch(length, arrays)
+	return appendMessage(stream, arrowMessageRecordBatch, batch, body)
+}
+
+// appendEndOfStream ends the stream.
+func appendEndOfStream(stream []byte) []byte {
+	stream = binary.LittleEndian.AppendUint32(stream, arrowContinuationMarker)
+	return binary.LittleEndian.AppendUint32(stream, 0)
+}
+
+// validityBitmap returns the validity buffer and null count of the values
+// at which valid is false. Without nulls, the buffer is left out.
+func validityBitmap(valid []bool) ([]byte, int) {
+	bitmap := make([]byte, (len(valid)+7)/8)
+	nulls := 0
+	for i, v := range valid {
+		if v {
+			bitmap[i/8] |= 1 << (i % 8)
+		} else {
+			nulls++
+		}
+	}
+	if nulls == 0 {
+		return nil, 0
+	}
+	return bitmap, nulls
+}
+
+// newBinaryArray returns an array of the binary or string values.
+func newBinaryArray(f arrowField, values []string) arrowArray {
+	offsets := binary.LittleEndian.AppendUint32(nil, 0)
+	var data []byte
+	for _, v := range values {
+		data = append(data, v...)
+		offsets = binary.LittleEndian.AppendUint32(offsets, uint32(len(data)))
+	}
+	return arrowArray{field: f, length: len(values), buffers: [][]byte{nil, offsets, data}}
+}
+
+// newIntArray returns an array of the integers, or of the indices of a
+// dictionary-encoded field, in the width of the field. The values at which
+// valid is false are null, and a nil valid has no nulls.
+func newIntArray(f arrowField, values []int64, valid []bool) arrowArray {
+	bitWidth := f.bitWidth
+	if f.dictionary != nil {
+		bitWidth = f.dictionary.bitWidth
+	}
+	data := make([]byte, 0, len(values)*bitWidth/8)
+	for i, v := range values {
+		if valid != nil && !valid[i] {
+			v = 0
+		}
+		switch bitWidth {
+		case 8:
+			data = append(data, byte(v))
+		case 16:
+			data = binary.LittleEndian.AppendUint16(data, uint16(v))
+		case 32:
+			data = binary.LittleEndian.AppendUint32(data, uint32(v))
+		default:
+			data = binary.LittleEndian.AppendUint64(data, uint64(v))
+		}
+	}
+	bitmap, nulls := validityBitmap(valid)
+	return arrowArray{field: f, length: len(values), nulls: nulls, buffers: [][]byte{bitmap, data}}
+}
+
+// newBoolArray returns an array of the booleans.
+func newBoolArray(f arrowField, values []bool) arrowArray {
+	data := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			data[i/8] |= 1 << (i % 8)
+		}
+	}
+	return arrowArray{field: f, length: len(values), buffers: [][]byte{nil, data}}
+}
+
+// newListArray returns an array of lists, of which list i holds the values
+// of child from offsets[i] to offsets[i+1]. The field of child becomes the
+// child of f.
+func newListArray(f arrowField, offsets []int32, child arrowArray) arrowArray {
+	data := make([]byte, 0, 4*len(offsets))
+	for _, o := range offsets {
+		data = binary.LittleEndian.AppendUint32(data, uint32(o))
+	}
+	f.children = []arrowField{child.field}
+	return arrowArray{field: f, length: len(offsets) - 1, buffers: [][]byte{nil, data}, children: []arrowArray{child}}
+}
+
+// newStructArray returns an array of structs of the children, which all have
+// length values. Their fields become the children of f.
+func newStructArray(f arrowField, length int, children ...arrowArray) arrowArray {
+	f.children = nil
+	for _, child := range children {
+		f.children = append(f.children, child.field)
+	}
+	return arrowArray{field: f, length: length, buffers: [][]byte{nil}, children: children}
+}
+
+// stringDictionary collects the distinct values of a dictionary-encoded
+// column in the order they were added.
+type stringDictionary struct {
+	indices map[string]int64
+	values  []string
+}
+
+// index returns the index of the value, adding it if it is new.
+func (d *stringDictionary) index(value string) int64 {
+	if i, ok := d.indices[value]; ok {
+		return i
+	}
+	if d.indices == nil {
+		d.indices = map[string]int64{}
+	}
+	i := int64(len(d.values))
+	d.indices[value] = i
+	d.values = append(d.values, value)
+	return i
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func binaryArray(f arrowField, values ...string) arrowArray {
+	return newBinaryArray(f, values)
+}
+
+// intArray returns an array of 32 bit integers in which negative values are
+// null, such as dictionary indices.
+func intArray(f arrowField, values ...int) arrowArray {
+	ints := make([]int64, len(values))
+	valid := make([]bool, len(values))
+	for i, v := range values {
+		ints[i], valid[i] = int64(v), v >= 0
+	}
+	return newIntArray(f, ints, valid)
+}
+
+func listArray(f arrowField, offsets []int, child arrowArray) arrowArray {
+	offsets32 := make([]int32, len(offsets))
+	for i, o := range offsets {
+		offsets32[i] = int32(o)
+	}
+	return newListArray(f, offsets32, child)
+}
+
+var (
+	testInt32  = arrowField{typ: arrowTypeInt, bitWidth: 32, signed: true}
+	testUint32 = arrowField{typ: arrowTypeInt, bitWidth: 32}
+)
+
+func named(f arrowField, name string) arrowField {
+	f.name = name
+	return f
+}
+
+// testFlamegraph returns a stream like the flamegraph records of Parca, with
+// dictionary-encoded and run-end encoded names next to columns that are
+// skipped.
+func testFlamegraph() []byte {
+	functionName := arrowField{name: "function_name", typ: arrowTypeUtf8, dictionary: &arrowDictionary{id: 0, bitWidth: 32, signed: true}}
+	buildID := arrowField{name: "mapping_build_id", typ: arrowTypeBinary, dictionary: &arrowDictionary{id: 1, bitWidth: 32}}
+	fileValues := arrowField{name: "values", typ: arrowTypeUtf8, dictionary: &arrowDictionary{id: 2, bitWidth: 32, signed: true}}
+	fileName := arrowField{name: "function_file_name", typ: arrowTypeRunEndEncoded, children: []arrowField{named(testInt32, "run_ends"), fileValues}}
+	children := arrowField{name: "children", typ: arrowTypeList, children: []arrowField{named(testUint32, "item")}}
+	cumulative := named(testInt32, "cumulative")
+	label := arrowField{name: "labels", typ: arrowTypeLargeUtf8}
+
+	stream := appendSchema(nil, cumulative, functionName, children, buildID, fileName, label)
+	stream = appendDictionary(stream, 0, false, binaryArray(arrowField{typ: arrowTypeUtf8}, "main", "runtime.mallocgc"))
+	stream = appendDictionary(stream, 1, false, binaryArray(arrowField{typ: arrowTypeBinary}, "b1", "b2"))
+	stream = appendDictionary(stream, 2, false, binaryArray(arrowField{typ: arrowTypeUtf8}, "main.go", "malloc.go"))
+
+	// The root and three nodes, of which the last two are in the same file.
+	large := binary.LittleEndian.AppendUint64(nil, 0)
+	for i := 0; i < 4; i++ {
+		large = binary.LittleEndian.AppendUint64(large, 0)
+	}
+	stream = appendRecordBatch(stream, 4,
+		intArray(cumulative, 10, 7, 3, 3),
+		intArray(functionName, -1, 0, 1, 1),
+		listArray(children, []int{0, 2, 3, 3, 3}, intArray(named(testUint32, "item"), 1, 2, 3)),
+		intArray(buildID, -1, 0, 1, 1),
+		arrowArray{field: fileName, length: 4, children: []arrowArray{
+			intArray(named(testInt32, "run_ends"), 1, 2, 4),
+			intArray(fileValues, -1, 0, 1),
+		}},
+		arrowArray{field: label, length: 4, buffers: [][]byte{nil, large, nil}},
+	)
+
+	// A delta dictionary adds a function for a second batch.
+	stream = appendDictionary(stream, 0, true, binaryArray(arrowField{typ: arrowTypeUtf8}, "runtime.gcBgMarkWorker"))
+	stream = appendRecordBatch(stream, 1,
+		intArray(cumulative, 1),
+		intArray(functionName, 2),
+		listArray(children, []int{0, 0}, intArray(named(testUint32, "item"))),
+		intArray(buildID, 1),
+		arrowArray{field: fileName, length: 1, children: []arrowArray{
+			intArray(named(testInt32, "run_ends"), 1),
+			intArray(fileValues, 1),
+		}},
+		arrowArray{field: label, length: 1, buffers: [][]byte{nil, make([]byte, 16), nil}},
+	)
+	return appendEndOfStream(stream)
+}
+
+func TestReadArrowStrings(t *testing.T) {
+	columns, err := readArrowStrings(testFlamegraph(), "function_name", "mapping_build_id", "function_file_name", "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"function_name":      {"", "main", "runtime.mallocgc", "runtime.mallocgc", "runtime.gcBgMarkWorker"},
+		"mapping_build_id":   {"", "b1", "b2", "b2", "b2"},
+		"function_file_name": {"", "main.go", "malloc.go", "malloc.go", "malloc.go"},
+	}
+	if len(columns) != len(want) {
+		t.Errorf("read columns %v, want %v", columns, want)
+	}
+	for name, values := range want {
+		if !slices.Equal(columns[name], values) {
+			t.Errorf("column %s = %q, want %q", name, columns[name], values)
+		}
+	}
+}
+
+func TestReadArrowStringsErrors(t *testing.T) {
+	valid := testFlamegraph()
+	functionName := arrowField{name: "function_name", typ: arrowTypeUtf8, dictionary: &arrowDictionary{id: 0, bitWidth: 32, signed: true}}
+
+	outOfBounds := appendSchema(nil, functionName)
+	outOfBounds = appendDictionary(outOfBounds, 0, false, binaryArray(arrowField{typ: arrowTypeUtf8}, "main"))
+	outOfBounds = appendRecordBatch(outOfBounds, 1, intArray(functionName, 1))
+
+	compressed := appendSchema(nil, named(testInt32, "cumulative"))
+	batch, body := recordBatch(1, []arrowArray{intArray(named(testInt32, "cumulative"), 1)})
+	compressed = appendMessage(compressed, arrowMessageRecordBatch, append(batch, fbRef(fbTableDef{fbScalar(1, 0)})), body)
+
+	for _, tt := range []struct {
+		name   string
+		stream []byte
+		err    string
+	}{
+		{"truncated", valid[:len(valid)-20], "exceeds the stream"},
+		{"no schema", appendRecordBatch(nil, 1, intArray(named(testInt32, "cumulative"), 1)), "before the schema"},
+		{"index out of bounds", outOfBounds, "out of bounds of dictionary"},
+		{"compressed", compressed, "compressed"},
+		{"corrupt metadata", append(binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, arrowContinuationMarker), 8), 0xff, 0xff, 0, 0, 0, 0, 0, 0), "out of bounds"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readArrowStrings(tt.stream, "function_name")
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("readArrowStrings() error = %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadFlamegraphNames(t *testing.T) {
+	names, err := readFlamegraphNames(testFlamegraph())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"main", "runtime.mallocgc", "runtime.gcBgMarkWorker"}; !slices.Equal(names.functions, want) {
+		t.Errorf("functions = %q, want %q", names.functions, want)
+	}
+	// The root has neither a build ID nor a file, and the last two nodes
+	// share theirs.
+	if want := []sourceRef{{"b1", "main.go"}, {"b2", "malloc.go"}}; !slices.Equal(names.sources, want) {
+		t.Errorf("sources = %v, want %v", names.sources, want)
+	}
+}
@@ -0,0 +1,1420 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+	scrapev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/scrape/v1alpha1"
+	"go.yaml.in/yaml/v2"
+)
+
+// configVersion is the only workload file version understood by this build.
+const configVersion = 1
+
+// Config is the declarative description of a load scenario. It is read from
+// the file given by -config, which may be written in YAML or JSON.
+type Config struct {
+	Version  int            `yaml:"version"`
+	Target   TargetConfig   `yaml:"target"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Schedule ScheduleConfig `yaml:"schedule"`
+	Queries  QueriesConfig  `yaml:"queries"`
+	Mix      MixConfig      `yaml:"mix"`
+	Limits   LimitsConfig   `yaml:"limits"`
+
+	// ProfileTypes to query. If empty, types are auto-discovered from the backend.
+	ProfileTypes []ProfileTypeString `yaml:"profileTypes"`
+	// Ranges are the query time ranges used by labels, values, range and merge queries.
+	Ranges []Duration `yaml:"ranges"`
+	// Selectors are appended to profile types for filtering queries. If empty,
+	// queries are not filtered.
+	Selectors []Selector `yaml:"selectors"`
+	// ProfileTypeRules choose the query kinds, modes and ranges of the profile
+	// types they match. The first matching rule applies.
+	ProfileTypeRules []ProfileTypeRule `yaml:"profileTypeRules"`
+	// DefaultProfileTypeRules adds the rules of defaultProfileTypeRules after
+	// ProfileTypeRules, for the profile types that none of those match.
+	DefaultProfileTypeRules bool `yaml:"defaultProfileTypeRules"`
+	// Viewports are the screens that range and merge queries are made for.
+	Viewports ViewportsConfig `yaml:"viewports"`
+	// Write configures the writer, which ingests synthetic profiles.
+	Write WriteConfig `yaml:"write"`
+	// Debuginfo configures the simulated agents uploading debuginfo files.
+	Debuginfo DebuginfoConfig `yaml:"debuginfo"`
+}
+
+type TargetConfig struct {
+	URL     string            `yaml:"url"`
+	Timeout Duration          `yaml:"timeout"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+type AuthConfig struct {
+	// Token is sent as a bearer token along each request.
+	Token string      `yaml:"token"`
+	Vault VaultConfig `yaml:"vault"`
+}
+
+// VaultConfig configures fetching the bearer token from Vault using the
+// Kubernetes auth method. It is disabled if URL is empty.
+type VaultConfig struct {
+	URL       string `yaml:"url"`
+	TokenPath string `yaml:"tokenPath"`
+	Role      string `yaml:"role"`
+}
+
+const (
+	// scheduleModeClosed runs rounds of requests, and a round only starts
+	// once a previous round finished, so a slow Parca receives less traffic.
+	scheduleModeClosed = "closed"
+	// scheduleModeOpen issues requests at a fixed rate regardless of
+	// whether earlier requests completed.
+	scheduleModeOpen = "open"
+)
+
+type ScheduleConfig struct {
+	// Mode is either "closed" or "open".
+	Mode string `yaml:"mode"`
+	// Interval is the default time between query rounds of each query kind
+	// in closed mode.
+	Interval Duration `yaml:"interval"`
+	// Rate is the number of requests per second in open mode, shared by all
+	// query kinds that do not set their own rate.
+	Rate float64 `yaml:"rate"`
+	// MaxInFlight caps the number of requests in flight in open mode. A
+	// request that is due while the cap is reached is dropped.
+	MaxInFlight int `yaml:"maxInFlight"`
+	// Stages shape the shared rate over time in open mode and replace Rate.
+	// The rate at the end of the last stage is held afterwards.
+	Stages []StageConfig `yaml:"stages"`
+	// Arrival is the arrival process of the shared open-loop stream and of
+	// every query kind that does not set its own.
+	Arrival ArrivalConfig `yaml:"arrival"`
+}
+
+const (
+	arrivalFixed   = "fixed"
+	arrivalUniform = "uniform"
+	arrivalPoisson = "poisson"
+	arrivalBurst   = "burst"
+)
+
+// ArrivalConfig shapes the time between rounds in closed mode, or between
+// requests in open mode, while keeping the configured interval or rate on
+// average:
+//
+//   - fixed keeps exactly the same time between arrivals.
+//   - uniform varies each time by up to Jitter times the mean in either
+//     direction.
+//   - poisson draws exponentially distributed times, like independent users.
+//   - burst lets Burst arrivals happen at once and waits Burst times the mean
+//     until the next burst.
+type ArrivalConfig struct {
+	Process string  `yaml:"process"`
+	Jitter  float64 `yaml:"jitter"`
+	Burst   int     `yaml:"burst"`
+	// Seed makes the random times reproducible. If zero, a random seed is
+	// used and logged. Each stream derives its own sequence from the seed, so
+	// that query kinds don't arrive in lockstep.
+	Seed uint64 `yaml:"seed"`
+}
+
+const (
+	stageTypeConstant = "constant"
+	stageTypeRamp     = "ramp"
+	stageTypeSteps    = "steps"
+	stageTypeSpike    = "spike"
+)
+
+// StageConfig is one stage of a load profile. Which fields are used depends
+// on the type:
+//
+//   - constant holds Rate for the whole stage, e.g. for a soak test.
+//   - ramp changes the rate linearly from From to To.
+//   - steps goes from From to To in Steps equal steps, like a staircase.
+//   - spike jumps to To for Hold and then recovers at From.
+type StageConfig struct {
+	Name     string   `yaml:"name"`
+	Type     string   `yaml:"type"`
+	Duration Duration `yaml:"duration"`
+	Rate     float64  `yaml:"rate"`
+	From     float64  `yaml:"from"`
+	To       float64  `yaml:"to"`
+	Steps    int      `yaml:"steps"`
+	Hold     Duration `yaml:"hold"`
+}
+
+// QueriesConfig configures each query kind. Every kind is scheduled
+// independently of the others.
+type QueriesConfig struct {
+	ProfileTypes QueryKindConfig    `yaml:"profileTypes"`
+	Labels       QueryKindConfig    `yaml:"labels"`
+	Values       ValuesQueryConfig  `yaml:"values"`
+	Range        RangeQueryConfig   `yaml:"range"`
+	Merge        MergeQueryConfig   `yaml:"merge"`
+	Single       SingleQueryConfig  `yaml:"single"`
+	Diff         DiffQueryConfig    `yaml:"diff"`
+	Source       SourceQueryConfig  `yaml:"source"`
+	Share        QueryKindConfig    `yaml:"share"`
+	Targets      TargetsQueryConfig `yaml:"targets"`
+	Agents       QueryKindConfig    `yaml:"agents"`
+}
+
+// QueryKindConfig holds the scheduling settings shared by all query kinds.
+type QueryKindConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is the time between rounds. If zero, schedule.interval is used.
+	Interval Duration `yaml:"interval"`
+	// Concurrency is the number of rounds that may be in flight at once.
+	// A round that is due while this many are still running is skipped.
+	Concurrency int `yaml:"concurrency"`
+	// Workers is the number of requests of a round that are made
+	// concurrently. With a single worker they are made one after another.
+	Workers int `yaml:"workers"`
+	// Rate is the number of requests per second of this kind in open mode.
+	// If zero, the kind shares schedule.rate with the other kinds.
+	Rate float64 `yaml:"rate"`
+	// Arrival is the arrival process of the kind's rounds, or of its own
+	// open-loop stream. If its process is empty, schedule.arrival is used.
+	Arrival ArrivalConfig `yaml:"arrival"`
+}
+
+type ValuesQueryConfig struct {
+	// Kind is inlined so that values share the layout of the other kinds.
+	Kind QueryKindConfig `yaml:",inline"`
+
+	// Labels are the label names to query values for. If empty, values
+	// queries are skipped.
+	Labels []string `yaml:"labels"`
+	// MatchSelectors narrows the values by each of the selectors, as the UI
+	// does with the selectors already chosen, instead of always asking for
+	// all values of the profile type.
+	MatchSelectors bool `yaml:"matchSelectors"`
+}
+
+type RangeQueryConfig struct {
+	Kind QueryKindConfig `yaml:",inline"`
+
+	// SumBy are label sets that the series are each summed by, in addition
+	// to requesting the series without aggregation.
+	SumBy []SumByConfig `yaml:"sumBy"`
+}
+
+// SumByConfig aggregates the series of range queries by label names, like
+// the metrics graph of the UI does.
+type SumByConfig struct {
+	Name   string   `yaml:"name"`
+	Labels []string `yaml:"labels"`
+	// SampleLabels is the number of label names to sample for each request
+	// from earlier Labels responses of the profile type, in addition to
+	// Labels.
+	SampleLabels int `yaml:"sampleLabels"`
+}
+
+type MergeQueryConfig struct {
+	Kind QueryKindConfig `yaml:",inline"`
+
+	// ReportTypes are requested for every profile type, range and selector.
+	ReportTypes []ReportType `yaml:"reportTypes"`
+	// Filters are sets of filters that are each requested in addition to
+	// the unfiltered profile.
+	Filters []FilterSetConfig `yaml:"filters"`
+	// GroupBy are group-by configurations that are each requested in
+	// addition to the ungrouped profile.
+	GroupBy []GroupByConfig `yaml:"groupBy"`
+}
+
+// GroupByConfig groups the flamegraph by the fields, such as function_name
+// or labels.pod for the pod label.
+type GroupByConfig struct {
+	Name   string   `yaml:"name"`
+	Fields []string `yaml:"fields"`
+}
+
+// proto returns the group-by of the request, or nil to not group.
+func (g GroupByConfig) proto() *queryv1alpha1.GroupBy {
+	if len(g.Fields) == 0 {
+		return nil
+	}
+	return &queryv1alpha1.GroupBy{Fields: g.Fields}
+}
+
+// FilterSetConfig is a set of filters attached to merge requests, like the
+// UI's search box and sandwich view use them.
+type FilterSetConfig struct {
+	Name string `yaml:"name"`
+	// Functions keeps only the stacks that contain all of the functions.
+	Functions []string `yaml:"functions"`
+	// SampleFunctions is the number of function names to sample for each
+	// request from earlier top reports of the profile type, in addition to
+	// Functions.
+	SampleFunctions int `yaml:"sampleFunctions"`
+	// Exclude drops the stacks that contain the functions instead.
+	Exclude bool `yaml:"exclude"`
+	// Binaries keeps only the frames of these binaries.
+	Binaries []string `yaml:"binaries"`
+	// Sandwich shows the callers and callees of the first function instead
+	// of filtering the stacks by it.
+	Sandwich bool `yaml:"sandwich"`
+}
+
+// SingleQueryConfig configures single-profile queries, as the UI makes them
+// when a user clicks a point of the metrics graph. They query the timestamps
+// of samples returned by range queries, so range queries must be enabled.
+type SingleQueryConfig struct {
+	Kind QueryKindConfig `yaml:",inline"`
+
+	// Samples is the number of timestamps taken from each range query
+	// response, spread evenly over its samples.
+	Samples int `yaml:"samples"`
+}
+
+// SourceQueryConfig configures source reports, as the UI requests them when
+// a user opens the source of a function. The build IDs and filenames are
+// taken from the flamegraphs of merge queries.
+type SourceQueryConfig struct {
+	Kind QueryKindConfig `yaml:",inline"`
+
+	// Samples is the number of source files requested for every profile
+	// type, range and selector, picked at random for every request.
+	Samples int `yaml:"samples"`
+	// SourceOnly only fetches the source file, without querying the profile
+	// for the values of its lines.
+	SourceOnly bool `yaml:"sourceOnly"`
+}
+
+const (
+	targetStateAny     = "any"
+	targetStateActive  = "active"
+	targetStateDropped = "dropped"
+)
+
+// targetStates maps the target states of the workload file to the states of
+// Targets requests.
+var targetStates = map[string]scrapev1alpha1.TargetsRequest_State{
+	targetStateAny:     scrapev1alpha1.TargetsRequest_STATE_ANY_UNSPECIFIED,
+	targetStateActive:  scrapev1alpha1.TargetsRequest_STATE_ACTIVE,
+	targetStateDropped: scrapev1alpha1.TargetsRequest_STATE_DROPPED,
+}
+
+// TargetsQueryConfig configures the scrape target listings of the UI's
+// targets page.
+type TargetsQueryConfig struct {
+	Kind QueryKindConfig `yaml:",inline"`
+
+	// States are the target states to list, each with its own request.
+	States []string `yaml:"states"`
+}
+
+// DiffQueryConfig configures diff queries, which compare a baseline window
+// (A) with the window ending now (B) for every profile type, range and
+// selector.
+type DiffQueryConfig struct {
+	Kind QueryKindConfig `yaml:",inline"`
+
+	Comparisons []DiffComparison `yaml:"comparisons"`
+}
+
+// DiffComparison is one way of choosing the two sides of a diff query.
+type DiffComparison struct {
+	Name string `yaml:"name"`
+	// Offset is how much earlier the baseline window is. If not set, it is
+	// the window right before, so a 15m range compares the last 15m with the
+	// 15m before. An offset of 24h compares now with the same time yesterday,
+	// and an offset of 0s compares the same window.
+	Offset *Duration `yaml:"offset"`
+	// A and B are added to the selector of the baseline and the compared
+	// side, for example to compare two deployments.
+	A Selector `yaml:"a"`
+	B Selector `yaml:"b"`
+}
+
+// MixConfig weights the requests that share the open-loop rate, instead of
+// sweeping the full matrix of every kind in turn.
+type MixConfig struct {
+	// Seed makes the sampled sequence of requests reproducible. If zero, a
+	// random seed is used and logged.
+	Seed uint64 `yaml:"seed"`
+	// Kinds weights the query kinds by their name in queries. If empty, all
+	// kinds are weighted equally, otherwise kinds that are missing are not
+	// sent at all.
+	Kinds map[string]float64 `yaml:"kinds"`
+	// ProfileTypes weights profile types by their full name or by the name
+	// before the first colon. Profile types that don't match have weight 1.
+	ProfileTypes map[string]float64 `yaml:"profileTypes"`
+}
+
+func (c MixConfig) enabled() bool {
+	return len(c.Kinds) > 0 || len(c.ProfileTypes) > 0
+}
+
+func (c MixConfig) kindWeight(key string) float64 {
+	if len(c.Kinds) == 0 {
+		return 1
+	}
+	return c.Kinds[key]
+}
+
+func (c MixConfig) profileTypeWeight(profileType string) float64 {
+	if w, ok := c.ProfileTypes[profileType]; ok {
+		return w
+	}
+	name, _, _ := strings.Cut(profileType, ":")
+	if w, ok := c.ProfileTypes[name]; ok {
+		return w
+	}
+	return 1
+}
+
+const (
+	// viewportModeSweep makes every request for each viewport.
+	viewportModeSweep = "sweep"
+	// viewportModeRotate makes each request for the next viewport in turn.
+	viewportModeRotate = "rotate"
+)
+
+// ViewportsConfig sets the screen widths that the step of range queries and
+// the node trimming of merge queries are derived from.
+type ViewportsConfig struct {
+	// Mode is either "sweep" or "rotate".
+	Mode     string           `yaml:"mode"`
+	Profiles []ViewportConfig `yaml:"profiles"`
+}
+
+// ViewportConfig is a screen a user looks at Parca on.
+type ViewportConfig struct {
+	Name string `yaml:"name"`
+	// Width in pixels. Range queries request a sample per pixel, and merge
+	// queries trim nodes too small to be displayed.
+	Width int `yaml:"width"`
+	// NoTrimming requests merged profiles without trimming any nodes.
+	NoTrimming bool `yaml:"noTrimming"`
+}
+
+// WriteConfig configures the writer, which pushes synthetic profiles through
+// the profile store's WriteRaw RPC to load the ingestion path.
+type WriteConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Mode is the RPC that profiles are written with, writeModeRaw or
+	// writeModeArrow.
+	Mode string `yaml:"mode"`
+	// Rate is the number of WriteRaw requests or Write streams per second.
+	Rate float64 `yaml:"rate"`
+	// MaxInFlight is the number of requests that may be in flight at once.
+	// Requests that are due while this many are in flight are dropped.
+	MaxInFlight int           `yaml:"maxInFlight"`
+	Arrival     ArrivalConfig `yaml:"arrival"`
+	// Name is the __name__ label of the written series.
+	Name string `yaml:"name"`
+	// LabelSets are the series that every request writes a profile for.
+	LabelSets []map[string]string `yaml:"labelSets"`
+	// Replicas writes each label set this many times, with a replica label
+	// telling them apart, to inflate the number of series.
+	Replicas int                    `yaml:"replicas"`
+	Profile  SyntheticProfileConfig `yaml:"profile"`
+	Replay   ReplayConfig           `yaml:"replay"`
+}
+
+const (
+	// writeModeRaw sends pprof profiles with WriteRaw requests.
+	writeModeRaw = "raw"
+	// writeModeArrow streams Arrow records of samples and stacktraces over
+	// the Write RPC, like Parca Agent does.
+	writeModeArrow = "arrow"
+)
+
+// ReplayConfig configures replaying captured pprof profiles instead of
+// generating them.
+type ReplayConfig struct {
+	// Path is a directory or a tarball, optionally gzipped, of .pb.gz or .pb
+	// profiles. If empty, synthetic profiles are written.
+	Path string `yaml:"path"`
+	// Speed compresses time. The profiles are written in the order they were
+	// taken, with the time between them divided by Speed.
+	Speed float64 `yaml:"speed"`
+}
+
+// DebuginfoConfig configures agents that upload synthetic debuginfo files
+// through the debuginfo service's upload handshake, each file one after the
+// other, and all agents at the same time.
+type DebuginfoConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Agents is the number of simulated agents.
+	Agents int `yaml:"agents"`
+	// Files is the number of debuginfo files each agent holds.
+	Files int `yaml:"files"`
+	// Shared is the number of each agent's files that all agents hold, like
+	// the binaries of a common base image. The build IDs of the other files
+	// are unique to their agent.
+	Shared int `yaml:"shared"`
+	// Size is the size in bytes of the .text section of each file.
+	Size int64 `yaml:"size"`
+	// ChunkSize is the size in bytes of the chunks files are streamed in.
+	ChunkSize int `yaml:"chunkSize"`
+	// Startup spreads the first start of the agents evenly over this
+	// duration. If zero, all agents start at once. Restarts are never spread.
+	Startup Duration               `yaml:"startup"`
+	Restart DebuginfoRestartConfig `yaml:"restart"`
+	// Seed makes the build IDs reproducible across runs. If zero, a random
+	// seed is used and logged.
+	Seed uint64 `yaml:"seed"`
+}
+
+// DebuginfoRestartConfig configures the thundering restart, in which all
+// agents restart at the same time and go through all their files again, as
+// after a rollout of the agents.
+type DebuginfoRestartConfig struct {
+	// Interval is the time between restarts. If zero, the agents never
+	// restart.
+	Interval Duration `yaml:"interval"`
+	// NewBuildIDs gives the agents new build IDs on every restart, as if the
+	// restart came with new binaries to upload.
+	NewBuildIDs bool `yaml:"newBuildIDs"`
+}
+
+// SyntheticProfileConfig shapes the generated pprof profiles. Every profile
+// has the same functions, spread over the mappings, and random stacks of
+// them, where some functions are much more common than others.
+type SyntheticProfileConfig struct {
+	Functions int `yaml:"functions"`
+	Mappings  int `yaml:"mappings"`
+	// StackDepth is the maximum depth of a stack. Each stack's depth is
+	// picked at random up to it.
+	StackDepth int `yaml:"stackDepth"`
+	// Samples is the number of stacks in a profile.
+	Samples int `yaml:"samples"`
+	// Seed makes the profiles reproducible. If zero, a random seed is used
+	// and logged.
+	Seed uint64 `yaml:"seed"`
+}
+
+// ProfileTypeRule adjusts the queries made for the profile types it matches,
+// so that they resemble how the UI is used for them.
+type ProfileTypeRule struct {
+	Match ProfileTypeMatch `yaml:"match"`
+	// Exclude are the query kinds that are not made for matching types.
+	Exclude []string `yaml:"exclude"`
+	// MaxRange leaves out the ranges longer than it. If zero, all ranges are
+	// used.
+	MaxRange Duration `yaml:"maxRange"`
+	// Mode is how merge queries of matching types are made, ruleModeMerge if
+	// empty.
+	Mode string `yaml:"mode"`
+}
+
+const (
+	// ruleModeMerge merges the profiles of the whole range.
+	ruleModeMerge = "merge"
+	// ruleModeSingle queries the most recent profile that range queries
+	// returned instead, as the UI shows profiles that aren't deltas one at a
+	// time.
+	ruleModeSingle = "single"
+)
+
+// ProfileTypeMatch selects profile types. Fields that are not set match any
+// profile type.
+type ProfileTypeMatch struct {
+	// Name is the name of the profile type, such as memory, or the whole
+	// profile type.
+	Name       string `yaml:"name"`
+	SampleType string `yaml:"sampleType"`
+	Delta      *bool  `yaml:"delta"`
+}
+
+func (r *ProfileTypeRule) excludes(kind string) bool {
+	return slices.Contains(r.Exclude, kind)
+}
+
+// defaultProfileTypeRules query profile types that aren't deltas, such as
+// the memory in use or the number of goroutines, like the UI does. These
+// are snapshots, so a single profile is shown instead of merging them over
+// the range, and they aren't compared.
+func defaultProfileTypeRules() []ProfileTypeRule {
+	return []ProfileTypeRule{
+		{Match: ProfileTypeMatch{Delta: new(bool)}, Exclude: []string{"diff"}, Mode: ruleModeSingle},
+	}
+}
+
+// profileTypeRules returns the configured rules, followed by the default
+// ones if enabled. As single profiles are picked from the responses of range
+// queries, the default rules are left out if those are disabled.
+func (c *Config) profileTypeRules() []ProfileTypeRule {
+	if !c.DefaultProfileTypeRules || !c.Queries.Range.Kind.Enabled {
+		return c.ProfileTypeRules
+	}
+	return append(c.ProfileTypeRules[:len(c.ProfileTypeRules):len(c.ProfileTypeRules)], defaultProfileTypeRules()...)
+}
+
+// LimitsConfig bounds a run. Once any limit is reached, no new requests are
+// sent, the requests in flight are awaited and a summary is printed. A zero
+// duration, rounds or requests means no such limit.
+type LimitsConfig struct {
+	// Duration after which no new requests are sent.
+	Duration Duration `yaml:"duration"`
+	// Rounds each query kind runs in closed mode.
+	Rounds int `yaml:"rounds"`
+	// Requests sent in total across all query kinds.
+	Requests int64 `yaml:"requests"`
+	// MaxErrorRatio of failed to total requests above which a bounded run
+	// fails. The default of 1 never fails.
+	MaxErrorRatio float64 `yaml:"maxErrorRatio"`
+}
+
+// bounded returns whether the run stops by itself.
+func (c LimitsConfig) bounded() bool {
+	return c.Duration > 0 || c.Rounds > 0 || c.Requests > 0
+}
+
+// defaultConfig returns a Config with the same defaults as the command line flags.
+func defaultConfig() *Config {
+	return &Config{
+		Version: configVersion,
+		Target: TargetConfig{
+			URL:     "http://localhost:7070",
+			Timeout: Duration(10 * time.Second),
+		},
+		Auth: AuthConfig{
+			Vault: VaultConfig{
+				TokenPath: "parca-load/token",
+				Role:      "parca-load",
+			},
+		},
+		Schedule: ScheduleConfig{
+			Mode:        scheduleModeClosed,
+			Interval:    Duration(5 * time.Second),
+			MaxInFlight: 100,
+			Arrival:     ArrivalConfig{Process: arrivalFixed},
+		},
+		Queries: QueriesConfig{
+			ProfileTypes: defaultQueryKindConfig(),
+			Labels:       defaultQueryKindConfig(),
+			Values:       ValuesQueryConfig{Kind: defaultQueryKindConfig()},
+			Range:        RangeQueryConfig{Kind: defaultQueryKindConfig()},
+			Merge:        defaultMergeQueryConfig(),
+			Single:       defaultSingleQueryConfig(),
+			Diff:         defaultDiffQueryConfig(),
+			Source:       defaultSourceQueryConfig(),
+			Share:        disabledQueryKindConfig(),
+			Targets: TargetsQueryConfig{
+				Kind:   disabledQueryKindConfig(),
+				States: []string{targetStateAny},
+			},
+			Agents: disabledQueryKindConfig(),
+		},
+		DefaultProfileTypeRules: true,
+		Limits: LimitsConfig{
+			MaxErrorRatio: 1,
+		},
+		Write: WriteConfig{
+			Mode:        writeModeRaw,
+			Rate:        1,
+			MaxInFlight: 10,
+			Arrival:     ArrivalConfig{Process: arrivalFixed},
+			Name:        "parca_load",
+			LabelSets:   []map[string]string{{"job": "parca-load"}},
+			Replicas:    1,
+			Profile: SyntheticProfileConfig{
+				Functions:  1000,
+				Mappings:   4,
+				StackDepth: 32,
+				Samples:    1000,
+			},
+			Replay: ReplayConfig{Speed: 1},
+		},
+		Debuginfo: DebuginfoConfig{
+			Agents:    100,
+			Files:     10,
+			Size:      1 << 20,
+			ChunkSize: 64 << 10,
+		},
+		Viewports: ViewportsConfig{
+			Mode: viewportModeSweep,
+			Profiles: []ViewportConfig{
+				{Name: "8k", Width: numHorizontalPixelsOn8KDisplay},
+			},
+		},
+		Ranges: []Duration{
+			Duration(15 * time.Minute),
+			Duration(12 * time.Hour),
+			Duration(168 * time.Hour),
+		},
+	}
+}
+
+// kinds returns the scheduling settings of every query kind by its name in
+// the workload file.
+func (c QueriesConfig) kinds() map[string]QueryKindConfig {
+	return map[string]QueryKindConfig{
+		"profileTypes": c.ProfileTypes,
+		"labels":       c.Labels,
+		"values":       c.Values.Kind,
+		"range":        c.Range.Kind,
+		"merge":        c.Merge.Kind,
+		"single":       c.Single.Kind,
+		"diff":         c.Diff.Kind,
+		"source":       c.Source.Kind,
+		"share":        c.Share,
+		"targets":      c.Targets.Kind,
+		"agents":       c.Agents,
+	}
+}
+
+func defaultQueryKindConfig() QueryKindConfig {
+	return QueryKindConfig{
+		Enabled:     true,
+		Concurrency: 1,
+		Workers:     1,
+	}
+}
+
+// disabledQueryKindConfig returns the default settings of a kind that is
+// disabled by default, see defaultSingleQueryConfig.
+func disabledQueryKindConfig() QueryKindConfig {
+	kind := defaultQueryKindConfig()
+	kind.Enabled = false
+	return kind
+}
+
+func defaultMergeQueryConfig() MergeQueryConfig {
+	return MergeQueryConfig{
+		Kind:        defaultQueryKindConfig(),
+		ReportTypes: []ReportType{reportTypeFlamegraphArrow},
+	}
+}
+
+// defaultSingleQueryConfig disables single-profile queries, as they were
+// added after the other kinds and would otherwise change existing scenarios.
+func defaultSingleQueryConfig() SingleQueryConfig {
+	return SingleQueryConfig{
+		Kind:    disabledQueryKindConfig(),
+		Samples: 3,
+	}
+}
+
+// defaultDiffQueryConfig disables diff queries for the same reason as
+// defaultSingleQueryConfig, and compares with the previous window.
+func defaultDiffQueryConfig() DiffQueryConfig {
+	return DiffQueryConfig{
+		Kind:        disabledQueryKindConfig(),
+		Comparisons: []DiffComparison{{Name: "previous"}},
+	}
+}
+
+// defaultSourceQueryConfig disables source reports for the same reason as
+// defaultSingleQueryConfig.
+func defaultSourceQueryConfig() SourceQueryConfig {
+	return SourceQueryConfig{
+		Kind:    disabledQueryKindConfig(),
+		Samples: 3,
+	}
+}
+
+// LoadConfig reads and validates the workload file at path. Unknown fields
+// and invalid values are reported together with their line numbers.
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(content)
+}
+
+func parseConfig(content []byte) (*Config, error) {
+	cfg := defaultConfig()
+	cfg.Version = 0
+	// JSON is a subset of YAML, so both formats go through the YAML decoder
+	// and get the same line-numbered errors.
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Version == 0 {
+		return nil, errors.New("config is empty or missing the version field")
+	}
+	return cfg, nil
+}
+
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type config Config
+	if err := unmarshal((*config)(c)); err != nil {
+		return err
+	}
+
+	line := yamlLine(unmarshal)
+	var problems []string
+	switch c.Version {
+	case configVersion:
+	case 0:
+		problems = append(problems, "version is required")
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported version %d, expected %d", c.Version, configVersion))
+	}
+	if len(c.Ranges) == 0 {
+		problems = append(problems, "ranges must not be empty")
+	}
+	for _, r := range c.Ranges {
+		if r <= 0 {
+			problems = append(problems, fmt.Sprintf("range %s must be positive", r))
+		}
+	}
+	if c.Mix.enabled() && c.Schedule.Mode != scheduleModeOpen {
+		problems = append(problems, "mix requires open mode")
+	}
+	if c.Queries.Single.Kind.Enabled && !c.Queries.Range.Kind.Enabled {
+		problems = append(problems, "queries.single requires queries.range to be enabled")
+	}
+	if c.Queries.Source.Kind.Enabled && (!c.Queries.Merge.Kind.Enabled || !slices.Contains(c.Queries.Merge.ReportTypes, reportTypeFlamegraphArrow)) {
+		problems = append(problems, fmt.Sprintf("queries.source requires queries.merge to be enabled with the %s report type", reportTypeFlamegraphArrow))
+	}
+	if !c.Queries.Range.Kind.Enabled && slices.ContainsFunc(c.ProfileTypeRules, func(r ProfileTypeRule) bool { return r.Mode == ruleModeSingle }) {
+		problems = append(problems, "profile type rules with mode single require queries.range to be enabled")
+	}
+	if c.Limits.Rounds > 0 && c.Schedule.Mode != scheduleModeClosed {
+		problems = append(problems, "limits.rounds requires closed mode")
+	}
+	if c.Schedule.Mode == scheduleModeOpen && c.Schedule.Rate == 0 && len(c.Schedule.Stages) == 0 {
+		kinds := c.Queries.kinds()
+		for _, name := range slices.Sorted(maps.Keys(kinds)) {
+			if kind := kinds[name]; kind.Enabled && kind.Rate == 0 {
+				problems = append(problems, fmt.Sprintf("queries.%s needs a rate in open mode as schedule.rate is not set", name))
+			}
+		}
+	}
+	return lineErrors(line, problems)
+}
+
+func (c *TargetConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type targetConfig TargetConfig
+	if err := unmarshal((*targetConfig)(c)); err != nil {
+		return err
+	}
+
+	line := yamlLine(unmarshal)
+	var problems []string
+	if c.URL == "" {
+		problems = append(problems, "target.url must not be empty")
+	}
+	if c.Timeout <= 0 {
+		problems = append(problems, "target.timeout must be positive")
+	}
+	for key := range c.Headers {
+		if strings.TrimSpace(key) == "" {
+			problems = append(problems, "target.headers contains an empty header name")
+		}
+	}
+	return lineErrors(line, problems)
+}
+
+func (c *ScheduleConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type scheduleConfig ScheduleConfig
+	if err := unmarshal((*scheduleConfig)(c)); err != nil {
+		return err
+	}
+
+	var problems []string
+	if c.Mode != scheduleModeClosed && c.Mode != scheduleModeOpen {
+		problems = append(problems, fmt.Sprintf("schedule.mode must be %q or %q", scheduleModeClosed, scheduleModeOpen))
+	}
+	if c.Interval <= 0 {
+		problems = append(problems, "schedule.interval must be positive")
+	}
+	if c.Rate < 0 {
+		problems = append(problems, "schedule.rate must not be negative")
+	}
+	if c.MaxInFlight < 1 {
+		problems = append(problems, "schedule.maxInFlight must be at least 1")
+	}
+	if len(c.Stages) > 0 && c.Mode != scheduleModeOpen {
+		problems = append(problems, "schedule.stages require open mode")
+	}
+	if c.Arrival.Process == "" {
+		problems = append(problems, "schedule.arrival.process must not be empty")
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *StageConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type stageConfig StageConfig
+	if err := unmarshal((*stageConfig)(c)); err != nil {
+		return err
+	}
+
+	var problems []string
+	if c.Duration <= 0 {
+		problems = append(problems, "stage duration must be positive")
+	}
+	if c.Rate < 0 || c.From < 0 || c.To < 0 {
+		problems = append(problems, "stage rates must not be negative")
+	}
+	switch c.Type {
+	case stageTypeConstant, stageTypeRamp:
+	case stageTypeSteps:
+		if c.Steps < 2 {
+			problems = append(problems, "steps stage needs at least 2 steps")
+		}
+	case stageTypeSpike:
+		if c.Hold <= 0 || c.Hold > c.Duration {
+			problems = append(problems, "spike stage needs a hold that is positive and within its duration")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"stage type must be one of %q, %q, %q or %q",
+			stageTypeConstant, stageTypeRamp, stageTypeSteps, stageTypeSpike,
+		))
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *MixConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type mixConfig MixConfig
+	if err := unmarshal((*mixConfig)(c)); err != nil {
+		return err
+	}
+
+	var problems []string
+	known := QueriesConfig{}.kinds()
+	var total float64
+	for _, key := range slices.Sorted(maps.Keys(c.Kinds)) {
+		if _, ok := known[key]; !ok {
+			problems = append(problems, fmt.Sprintf("mix.kinds contains unknown query kind %q", key))
+		}
+		if c.Kinds[key] < 0 {
+			problems = append(problems, fmt.Sprintf("mix.kinds weight of %q must not be negative", key))
+		}
+		total += c.Kinds[key]
+	}
+	if len(c.Kinds) > 0 && total == 0 {
+		problems = append(problems, "mix.kinds needs at least one positive weight")
+	}
+	for _, pt := range slices.Sorted(maps.Keys(c.ProfileTypes)) {
+		if c.ProfileTypes[pt] < 0 {
+			problems = append(problems, fmt.Sprintf("mix.profileTypes weight of %q must not be negative", pt))
+		}
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *WriteConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type writeConfig WriteConfig
+	if err := unmarshal((*writeConfig)(c)); err != nil {
+		return err
+	}
+
+	var problems []string
+	if c.Mode != writeModeRaw && c.Mode != writeModeArrow {
+		problems = append(problems, fmt.Sprintf("write.mode must be %q or %q", writeModeRaw, writeModeArrow))
+	}
+	if c.Mode == writeModeArrow && c.Replay.Path != "" {
+		problems = append(problems, "write.replay requires write.mode raw, as only pprof profiles are replayed")
+	}
+	if c.Rate <= 0 {
+		problems = append(problems, "write.rate must be positive")
+	}
+	if c.MaxInFlight < 1 {
+		problems = append(problems, "write.maxInFlight must be at least 1")
+	}
+	if c.Name == "" {
+		problems = append(problems, "write.name must not be empty")
+	}
+	if len(c.LabelSets) == 0 {
+		problems = append(problems, "write.labelSets must not be empty")
+	}
+	for _, labels := range c.LabelSets {
+		if _, ok := labels["__name__"]; ok {
+			problems = append(problems, "write.labelSets must not set __name__, which is write.name")
+		}
+		if _, ok := labels["replica"]; ok && c.Replicas > 1 {
+			problems = append(problems, "write.labelSets must not set replica if write.replicas is above 1")
+		}
+	}
+	if c.Replicas < 1 {
+		problems = append(problems, "write.replicas must be at least 1")
+	}
+	if c.Replay.Speed <= 0 {
+		problems = append(problems, "write.replay.speed must be positive")
+	}
+	if c.Profile.Functions < 1 || c.Profile.Mappings < 1 || c.Profile.StackDepth < 1 || c.Profile.Samples < 1 {
+		problems = append(problems, "write.profile functions, mappings, stackDepth and samples must be at least 1")
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *DebuginfoConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type debuginfoConfig DebuginfoConfig
+	if err := unmarshal((*debuginfoConfig)(c)); err != nil {
+		return err
+	}
+
+	var problems []string
+	if c.Agents < 1 {
+		problems = append(problems, "debuginfo.agents must be at least 1")
+	}
+	if c.Files < 1 {
+		problems = append(problems, "debuginfo.files must be at least 1")
+	}
+	if c.Shared < 0 || c.Shared > c.Files {
+		problems = append(problems, "debuginfo.shared must be between 0 and debuginfo.files")
+	}
+	if c.Size < 0 {
+		problems = append(problems, "debuginfo.size must not be negative")
+	}
+	if c.ChunkSize < 1 {
+		problems = append(problems, "debuginfo.chunkSize must be at least 1")
+	}
+	if c.Startup < 0 {
+		problems = append(problems, "debuginfo.startup must not be negative")
+	}
+	if c.Restart.Interval < 0 {
+		problems = append(problems, "debuginfo.restart.interval must not be negative")
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *ProfileTypeRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type profileTypeRule ProfileTypeRule
+	if err := unmarshal((*profileTypeRule)(c)); err != nil {
+		return err
+	}
+
+	var problems []string
+	kinds := QueriesConfig{}.kinds()
+	for _, kind := range c.Exclude {
+		if _, ok := kinds[kind]; !ok {
+			problems = append(problems, fmt.Sprintf(
+				"unknown query kind %q, expected one of %s", kind, strings.Join(slices.Sorted(maps.Keys(kinds)), ", "),
+			))
+		}
+	}
+	if c.MaxRange < 0 {
+		problems = append(problems, "maxRange must not be negative")
+	}
+	if c.Mode != "" && c.Mode != ruleModeMerge && c.Mode != ruleModeSingle {
+		problems = append(problems, fmt.Sprintf("mode must be %q or %q", ruleModeMerge, ruleModeSingle))
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *ViewportsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type viewportsConfig ViewportsConfig
+	if err := unmarshal((*viewportsConfig)(c)); err != nil {
+		return err
+	}
+
+	var problems []string
+	if c.Mode != viewportModeSweep && c.Mode != viewportModeRotate {
+		problems = append(problems, fmt.Sprintf("viewports.mode must be %q or %q", viewportModeSweep, viewportModeRotate))
+	}
+	if len(c.Profiles) == 0 {
+		problems = append(problems, "viewports.profiles must not be empty")
+	}
+	names := map[string]bool{}
+	for _, vp := range c.Profiles {
+		if vp.Name == "" {
+			problems = append(problems, "viewport name must not be empty")
+		} else if names[vp.Name] {
+			problems = append(problems, fmt.Sprintf("viewport name %q is not unique", vp.Name))
+		}
+		names[vp.Name] = true
+		if vp.Width < 1 {
+			problems = append(problems, fmt.Sprintf("viewport %q width must be at least 1", vp.Name))
+		}
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *LimitsConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type limitsConfig LimitsConfig
+	if err := unmarshal((*limitsConfig)(c)); err != nil {
+		return err
+	}
+	return lineErrors(yamlLine(unmarshal), c.problems())
+}
+
+func (c LimitsConfig) problems() []string {
+	var problems []string
+	if c.Duration < 0 || c.Rounds < 0 || c.Requests < 0 {
+		problems = append(problems, "limits must not be negative")
+	}
+	if c.MaxErrorRatio < 0 || c.MaxErrorRatio > 1 {
+		problems = append(problems, "limits.maxErrorRatio must be between 0 and 1")
+	}
+	return problems
+}
+
+func (c *QueryKindConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type queryKindConfig QueryKindConfig
+	if err := unmarshal((*queryKindConfig)(c)); err != nil {
+		return err
+	}
+	return lineErrors(yamlLine(unmarshal), c.problems())
+}
+
+func (c *ValuesQueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type valuesQueryConfig ValuesQueryConfig
+	if err := unmarshal((*valuesQueryConfig)(c)); err != nil {
+		return err
+	}
+	return lineErrors(yamlLine(unmarshal), c.Kind.problems())
+}
+
+func (c *RangeQueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rangeQueryConfig RangeQueryConfig
+	if err := unmarshal((*rangeQueryConfig)(c)); err != nil {
+		return err
+	}
+
+	problems := c.Kind.problems()
+	names := map[string]bool{}
+	for _, sumBy := range c.SumBy {
+		if sumBy.Name == "" {
+			problems = append(problems, "sum-by name must not be empty")
+		} else if names[sumBy.Name] {
+			problems = append(problems, fmt.Sprintf("sum-by name %q is not unique", sumBy.Name))
+		}
+		names[sumBy.Name] = true
+		if sumBy.SampleLabels < 0 {
+			problems = append(problems, fmt.Sprintf("sum-by %q sampleLabels must not be negative", sumBy.Name))
+		}
+		if len(sumBy.Labels) == 0 && sumBy.SampleLabels == 0 {
+			problems = append(problems, fmt.Sprintf("sum-by %q needs labels or sampleLabels", sumBy.Name))
+		}
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+// samplesFunctions reports whether any filter set samples function names.
+func (c MergeQueryConfig) samplesFunctions() bool {
+	return slices.ContainsFunc(c.Filters, func(set FilterSetConfig) bool { return set.SampleFunctions > 0 })
+}
+
+func (c *MergeQueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type mergeQueryConfig MergeQueryConfig
+	if err := unmarshal((*mergeQueryConfig)(c)); err != nil {
+		return err
+	}
+
+	problems := c.Kind.problems()
+	if len(c.ReportTypes) == 0 {
+		problems = append(problems, "reportTypes must not be empty")
+	}
+	names := map[string]bool{}
+	for _, set := range c.Filters {
+		if set.Name == "" {
+			problems = append(problems, "filter set name must not be empty")
+		} else if names[set.Name] {
+			problems = append(problems, fmt.Sprintf("filter set name %q is not unique", set.Name))
+		}
+		names[set.Name] = true
+		functions := len(set.Functions) > 0 || set.SampleFunctions > 0
+		if !functions && len(set.Binaries) == 0 {
+			problems = append(problems, fmt.Sprintf("filter set %q needs functions, sampleFunctions or binaries", set.Name))
+		}
+		if set.SampleFunctions < 0 {
+			problems = append(problems, fmt.Sprintf("filter set %q sampleFunctions must not be negative", set.Name))
+		}
+		if set.SampleFunctions > 0 && !slices.Contains(c.ReportTypes, reportTypeFlamegraphArrow) {
+			problems = append(problems, fmt.Sprintf("filter set %q sampleFunctions needs the %s report type to sample from", set.Name, reportTypeFlamegraphArrow))
+		}
+		if (set.Sandwich || set.Exclude) && !functions {
+			problems = append(problems, fmt.Sprintf("filter set %q needs functions for sandwich or exclude", set.Name))
+		}
+	}
+	names = map[string]bool{}
+	for _, groupBy := range c.GroupBy {
+		if groupBy.Name == "" {
+			problems = append(problems, "group-by name must not be empty")
+		} else if names[groupBy.Name] {
+			problems = append(problems, fmt.Sprintf("group-by name %q is not unique", groupBy.Name))
+		}
+		names[groupBy.Name] = true
+		if len(groupBy.Fields) == 0 || slices.Contains(groupBy.Fields, "") {
+			problems = append(problems, fmt.Sprintf("group-by %q needs fields that are not empty", groupBy.Name))
+		}
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *SingleQueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type singleQueryConfig SingleQueryConfig
+	if err := unmarshal((*singleQueryConfig)(c)); err != nil {
+		return err
+	}
+
+	problems := c.Kind.problems()
+	if c.Samples < 1 {
+		problems = append(problems, "samples must be at least 1")
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *SourceQueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type sourceQueryConfig SourceQueryConfig
+	if err := unmarshal((*sourceQueryConfig)(c)); err != nil {
+		return err
+	}
+
+	problems := c.Kind.problems()
+	if c.Samples < 1 {
+		problems = append(problems, "samples must be at least 1")
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *TargetsQueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type targetsQueryConfig TargetsQueryConfig
+	if err := unmarshal((*targetsQueryConfig)(c)); err != nil {
+		return err
+	}
+
+	problems := c.Kind.problems()
+	if len(c.States) == 0 {
+		problems = append(problems, "states must not be empty")
+	}
+	for _, state := range c.States {
+		if _, ok := targetStates[state]; !ok {
+			problems = append(problems, fmt.Sprintf(
+				"unknown target state %q, expected one of %s", state, strings.Join(slices.Sorted(maps.Keys(targetStates)), ", "),
+			))
+		}
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c *DiffQueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type diffQueryConfig DiffQueryConfig
+	if err := unmarshal((*diffQueryConfig)(c)); err != nil {
+		return err
+	}
+
+	problems := c.Kind.problems()
+	if len(c.Comparisons) == 0 {
+		problems = append(problems, "comparisons must not be empty")
+	}
+	names := map[string]bool{}
+	for _, comparison := range c.Comparisons {
+		if comparison.Name == "" {
+			problems = append(problems, "comparison name must not be empty")
+		} else if names[comparison.Name] {
+			problems = append(problems, fmt.Sprintf("comparison name %q is not unique", comparison.Name))
+		}
+		names[comparison.Name] = true
+		if comparison.Offset != nil && *comparison.Offset < 0 {
+			problems = append(problems, fmt.Sprintf("comparison %q offset must not be negative", comparison.Name))
+		}
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+func (c QueryKindConfig) problems() []string {
+	var problems []string
+	if c.Interval < 0 {
+		problems = append(problems, "interval must not be negative")
+	}
+	if c.Concurrency < 1 {
+		problems = append(problems, "concurrency must be at least 1")
+	}
+	if c.Workers < 1 {
+		problems = append(problems, "workers must be at least 1")
+	}
+	if c.Rate < 0 {
+		problems = append(problems, "rate must not be negative")
+	}
+	return problems
+}
+
+func (c *ArrivalConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type arrivalConfig ArrivalConfig
+	if err := unmarshal((*arrivalConfig)(c)); err != nil {
+		return err
+	}
+
+	var problems []string
+	switch c.Process {
+	case "", arrivalFixed, arrivalPoisson:
+	case arrivalUniform:
+		if c.Jitter <= 0 || c.Jitter > 1 {
+			problems = append(problems, "uniform arrivals need a jitter above 0 and at most 1")
+		}
+	case arrivalBurst:
+		if c.Burst < 2 {
+			problems = append(problems, "burst arrivals need a burst of at least 2")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"arrival process must be one of %q, %q, %q or %q",
+			arrivalFixed, arrivalUniform, arrivalPoisson, arrivalBurst,
+		))
+	}
+	return lineErrors(yamlLine(unmarshal), problems)
+}
+
+// Duration is a time.Duration that is written as a string such as "15m" in
+// the workload file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return lineErrors(yamlLine(unmarshal), []string{fmt.Sprintf("invalid duration %q", s)})
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// durations converts the configured durations to time.Duration.
+func durations(ds []Duration) []time.Duration {
+	res := make([]time.Duration, len(ds))
+	for i, d := range ds {
+		res[i] = time.Duration(d)
+	}
+	return res
+}
+
+// Selector is a label selector such as {job="api"}.
+type Selector string
+
+func (s *Selector) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "{") || !strings.HasSuffix(v, "}") {
+		return lineErrors(yamlLine(unmarshal), []string{fmt.Sprintf("label selector %q must be enclosed in curly braces", v)})
+	}
+	*s = Selector(v)
+	return nil
+}
+
+// selectorStrings returns the configured selectors, or "all" for no
+// filtering if none are configured.
+func selectorStrings(selectors []Selector) []string {
+	if len(selectors) == 0 {
+		return []string{"all"}
+	}
+	res := make([]string, len(selectors))
+	for i, s := range selectors {
+		res[i] = string(s)
+	}
+	return res
+}
+
+// reportTypeFlamegraphArrow is the report type the UI requests for
+// flamegraphs.
+const reportTypeFlamegraphArrow ReportType = "flamegraph_arrow"
+
+// reportTypeSource is the report type of source reports. It can't be
+// requested by merge queries, but is used for the metrics of the source kind.
+const reportTypeSource ReportType = "source"
+
+// ReportType is a report type of Query requests, named like the proto enum
+// value in lower case and without the REPORT_TYPE_ prefix, such as pprof or
+// flamegraph_arrow.
+type ReportType string
+
+func (r *ReportType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	if _, ok := queryReportTypes()[v]; !ok {
+		return lineErrors(yamlLine(unmarshal), []string{fmt.Sprintf(
+			"unknown report type %q, expected one of %s", v, strings.Join(slices.Sorted(maps.Keys(queryReportTypes())), ", "),
+		)})
+	}
+	*r = ReportType(v)
+	return nil
+}
+
+func (r ReportType) proto() queryv1alpha1.QueryRequest_ReportType {
+	return queryReportTypes()[string(r)]
+}
+
+// queryReportTypes returns the report types that can be requested by name.
+// The deprecated flamegraph and the source report, which needs a build ID
+// and filename, are left out.
+func queryReportTypes() map[string]queryv1alpha1.QueryRequest_ReportType {
+	types := map[string]queryv1alpha1.QueryRequest_ReportType{}
+	for name, value := range queryv1alpha1.QueryRequest_ReportType_value {
+		switch t := queryv1alpha1.QueryRequest_ReportType(value); t {
+		case queryv1alpha1.QueryRequest_REPORT_TYPE_FLAMEGRAPH_UNSPECIFIED, queryv1alpha1.QueryRequest_REPORT_TYPE_SOURCE:
+		default:
+			types[strings.ToLower(strings.TrimPrefix(name, "REPORT_TYPE_"))] = t
+		}
+	}
+	return types
+}
+
+// ProfileTypeString is a profile type in the form
+// name:sample_type:sample_unit:period_type:period_unit[:delta].
+type ProfileTypeString string
+
+func (p *ProfileTypeString) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	v = strings.TrimSpace(v)
+	parts := strings.Split(v, ":")
+	if (len(parts) != 5 && len(parts) != 6) || (len(parts) == 6 && parts[5] != "delta") {
+		return lineErrors(yamlLine(unmarshal), []string{fmt.Sprintf(
+			"profile type %q must be name:sample_type:sample_unit:period_type:period_unit[:delta]", v,
+		)})
+	}
+	*p = ProfileTypeString(v)
+	return nil
+}
+
+func profileTypeStrings(types []ProfileTypeString) []string {
+	if len(types) == 0 {
+		return nil
+	}
+	res := make([]string, len(types))
+	for i, t := range types {
+		res[i] = string(t)
+	}
+	return res
+}
+
+// yamlLine returns the line of the node that is currently being decoded by
+// an UnmarshalYAML method, or 0 if it is unknown. The decoder only reports
+// positions for type errors, so it decodes the node into a channel, which no
+// node can be decoded into, and reads the line from the resulting error.
+func yamlLine(unmarshal func(interface{}) error) int {
+	var probe chan struct{}
+	var typeErr *yaml.TypeError
+	if err := unmarshal(&probe); !errors.As(err, &typeErr) || len(typeErr.Errors) == 0 {
+		return 0
+	}
+	var line int
+	if _, err := fmt.Sscanf(typeErr.Errors[0], "line %d:", &line); err != nil {
+		return 0
+	}
+	return line
+}
+
+// lineErrors returns the problems as a *yaml.TypeError so that the decoder
+// collects them together with its own line-numbered errors.
+func lineErrors(line int, problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	errs := make([]string, len(problems))
+	for i, p := range problems {
+		errs[i] = fmt.Sprintf("line %d: %s", line, p)
+	}
+	return &yaml.TypeError{Errors: errs}
+}
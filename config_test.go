@@ -0,0 +1,671 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		// want changes the default configuration to the expected one.
+		want func(c *Config)
+	}{
+		{
+			name:    "minimal",
+			content: "version: 1\n",
+			want:    func(c *Config) {},
+		},
+		{
+			name: "json",
+			content: `{
+  "version": 1,
+  "ranges": ["1h", "24h"],
+  "selectors": ["{job=\"api\"}"],
+  "queries": {"labels": {"enabled": false}}
+}`,
+			want: func(c *Config) {
+				c.Ranges = []Duration{Duration(time.Hour), Duration(24 * time.Hour)}
+				c.Selectors = []Selector{`{job="api"}`}
+				c.Queries.Labels.Enabled = false
+			},
+		},
+		{
+			name: "closed mode",
+			content: `version: 1
+target:
+  url: http://parca:7070
+  timeout: 30s
+  headers:
+    X-Scope-OrgID: team-a
+schedule:
+  interval: 10s
+  arrival:
+    process: uniform
+    jitter: 0.5
+profileTypes:
+  - parca_agent:samples:count:cpu:nanoseconds:delta
+  - memory:inuse_space:bytes:space:bytes
+queries:
+  values:
+    labels: [job]
+    matchSelectors: true
+  range:
+    workers: 4
+    sumBy:
+      - name: ns
+        labels: [namespace]
+  merge:
+    interval: 30s
+    concurrency: 2
+    reportTypes: [pprof, flamegraph_arrow, top]
+    filters:
+      - name: sandwich
+        sampleFunctions: 1
+        sandwich: true
+    groupBy:
+      - name: pod
+        fields: [labels.pod]
+  single:
+    enabled: true
+  diff:
+    enabled: true
+    comparisons:
+      - name: yesterday
+        offset: 24h
+  targets:
+    enabled: true
+    states: [active, dropped]
+limits:
+  rounds: 3
+  maxErrorRatio: 0.1
+`,
+			want: func(c *Config) {
+				c.Target = TargetConfig{
+					URL:     "http://parca:7070",
+					Timeout: Duration(30 * time.Second),
+					Headers: map[string]string{"X-Scope-OrgID": "team-a"},
+				}
+				c.Schedule.Interval = Duration(10 * time.Second)
+				c.Schedule.Arrival = ArrivalConfig{Process: arrivalUniform, Jitter: 0.5}
+				c.ProfileTypes = []ProfileTypeString{
+					"parca_agent:samples:count:cpu:nanoseconds:delta",
+					"memory:inuse_space:bytes:space:bytes",
+				}
+				c.Queries.Values.Labels = []string{"job"}
+				c.Queries.Values.MatchSelectors = true
+				c.Queries.Range.Kind.Workers = 4
+				c.Queries.Range.SumBy = []SumByConfig{{Name: "ns", Labels: []string{"namespace"}}}
+				c.Queries.Merge.Kind.Interval = Duration(30 * time.Second)
+				c.Queries.Merge.Kind.Concurrency = 2
+				c.Queries.Merge.ReportTypes = []ReportType{"pprof", "flamegraph_arrow", "top"}
+				c.Queries.Merge.Filters = []FilterSetConfig{{Name: "sandwich", SampleFunctions: 1, Sandwich: true}}
+				c.Queries.Merge.GroupBy = []GroupByConfig{{Name: "pod", Fields: []string{"labels.pod"}}}
+				c.Queries.Single.Kind.Enabled = true
+				c.Queries.Diff.Kind.Enabled = true
+				yesterday := Duration(24 * time.Hour)
+				c.Queries.Diff.Comparisons = []DiffComparison{{Name: "yesterday", Offset: &yesterday}}
+				c.Queries.Targets.Kind.Enabled = true
+				c.Queries.Targets.States = []string{targetStateActive, targetStateDropped}
+				c.Limits = LimitsConfig{Rounds: 3, MaxErrorRatio: 0.1}
+			},
+		},
+		{
+			name: "open mode",
+			content: `version: 1
+schedule:
+  mode: open
+  maxInFlight: 50
+  stages:
+    - type: ramp
+      duration: 1m
+      from: 1
+      to: 10
+    - name: hold
+      type: constant
+      duration: 5m
+      rate: 10
+mix:
+  seed: 42
+  kinds: {merge: 3, range: 1}
+  profileTypes: {parca_agent: 2}
+`,
+			want: func(c *Config) {
+				c.Schedule.Mode = scheduleModeOpen
+				c.Schedule.MaxInFlight = 50
+				c.Schedule.Stages = []StageConfig{
+					{Type: stageTypeRamp, Duration: Duration(time.Minute), From: 1, To: 10},
+					{Name: "hold", Type: stageTypeConstant, Duration: Duration(5 * time.Minute), Rate: 10},
+				}
+				c.Mix = MixConfig{
+					Seed:         42,
+					Kinds:        map[string]float64{"merge": 3, "range": 1},
+					ProfileTypes: map[string]float64{"parca_agent": 2},
+				}
+			},
+		},
+		{
+			name: "rules, viewports, writer and debuginfo",
+			content: `version: 1
+profileTypeRules:
+  - match:
+      name: goroutine
+      delta: false
+    exclude: [merge, diff]
+    maxRange: 12h
+  - match:
+      name: memory
+    mode: single
+defaultProfileTypeRules: false
+viewports:
+  mode: rotate
+  profiles:
+    - name: laptop
+      width: 1440
+    - name: full
+      width: 1
+      noTrimming: true
+write:
+  enabled: true
+  rate: 5
+  labelSets:
+    - {job: a}
+  replicas: 3
+  replay:
+    path: ./captured
+    speed: 60
+debuginfo:
+  enabled: true
+  agents: 10
+  files: 4
+  shared: 1
+  restart:
+    interval: 10m
+    newBuildIDs: true
+`,
+			want: func(c *Config) {
+				c.ProfileTypeRules = []ProfileTypeRule{{
+					Match:    ProfileTypeMatch{Name: "goroutine", Delta: new(bool)},
+					Exclude:  []string{"merge", "diff"},
+					MaxRange: Duration(12 * time.Hour),
+				}, {
+					Match: ProfileTypeMatch{Name: "memory"},
+					Mode:  ruleModeSingle,
+				}}
+				c.DefaultProfileTypeRules = false
+				c.Viewports = ViewportsConfig{
+					Mode: viewportModeRotate,
+					Profiles: []ViewportConfig{
+						{Name: "laptop", Width: 1440},
+						{Name: "full", Width: 1, NoTrimming: true},
+					},
+				}
+				c.Write.Enabled = true
+				c.Write.Rate = 5
+				c.Write.LabelSets = []map[string]string{{"job": "a"}}
+				c.Write.Replicas = 3
+				c.Write.Replay = ReplayConfig{Path: "./captured", Speed: 60}
+				c.Debuginfo.Enabled = true
+				c.Debuginfo.Agents = 10
+				c.Debuginfo.Files = 4
+				c.Debuginfo.Shared = 1
+				c.Debuginfo.Restart = DebuginfoRestartConfig{Interval: Duration(10 * time.Minute), NewBuildIDs: true}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseConfig([]byte(tc.content))
+			if err != nil {
+				t.Fatalf("parseConfig() error = %v", err)
+			}
+			want := defaultConfig()
+			tc.want(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("parseConfig() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		// errs are the line-numbered errors in the order they are reported.
+		errs []string
+	}{
+		{
+			name:    "unsupported version",
+			content: "version: 2\n",
+			errs:    []string{"line 1: unsupported version 2, expected 1"},
+		},
+		{
+			name:    "unknown field",
+			content: "version: 1\nqueries:\n  merge:\n    reportType: [top]\n",
+			errs:    []string{"line 4: field reportType not found in type main.mergeQueryConfig"},
+		},
+		{
+			name:    "empty ranges",
+			content: "version: 1\nranges: []\n",
+			errs:    []string{"line 1: ranges must not be empty"},
+		},
+		{
+			name:    "invalid range",
+			content: "version: 1\nranges:\n  - 1h\n  - 1 hour\n",
+			errs:    []string{`line 4: invalid duration "1 hour"`},
+		},
+		{
+			name:    "negative range",
+			content: "version: 1\nranges: [-1h]\n",
+			errs:    []string{"line 1: range -1h0m0s must be positive"},
+		},
+		{
+			name:    "mix in closed mode",
+			content: "# A comment before the version.\nversion: 1\nmix:\n  kinds: {merge: 1}\n",
+			errs:    []string{"line 2: mix requires open mode"},
+		},
+		{
+			name:    "single without range",
+			content: "version: 1\nqueries:\n  single:\n    enabled: true\n  range:\n    enabled: false\n",
+			errs:    []string{"line 1: queries.single requires queries.range to be enabled"},
+		},
+		{
+			name:    "source without flamegraphs",
+			content: "version: 1\nqueries:\n  source:\n    enabled: true\n  merge:\n    reportTypes: [pprof]\n",
+			errs:    []string{"line 1: queries.source requires queries.merge to be enabled with the flamegraph_arrow report type"},
+		},
+		{
+			name:    "rounds in open mode",
+			content: "version: 1\nschedule:\n  mode: open\n  rate: 1\nlimits:\n  rounds: 1\n",
+			errs:    []string{"line 1: limits.rounds requires closed mode"},
+		},
+		{
+			name: "open mode without rate",
+			content: `version: 1
+schedule:
+  mode: open
+queries:
+  labels:
+    rate: 1
+  values:
+    enabled: false
+  range:
+    enabled: false
+  merge:
+    enabled: false
+`,
+			errs: []string{"line 1: queries.profileTypes needs a rate in open mode as schedule.rate is not set"},
+		},
+		{
+			name:    "target",
+			content: "version: 1\ntarget:\n  url: \"\"\n  timeout: 0s\n  headers:\n    \" \": x\n",
+			errs: []string{
+				"line 3: target.url must not be empty",
+				"line 3: target.timeout must be positive",
+				"line 3: target.headers contains an empty header name",
+			},
+		},
+		{
+			name:    "schedule",
+			content: "version: 1\nschedule:\n  mode: half-open\n  interval: 0s\n  rate: -1\n  maxInFlight: 0\n  arrival:\n    process: \"\"\n",
+			errs: []string{
+				`line 3: schedule.mode must be "closed" or "open"`,
+				"line 3: schedule.interval must be positive",
+				"line 3: schedule.rate must not be negative",
+				"line 3: schedule.maxInFlight must be at least 1",
+				"line 3: schedule.arrival.process must not be empty",
+			},
+		},
+		{
+			name:    "stages in closed mode",
+			content: "version: 1\nschedule:\n  stages:\n    - type: constant\n      duration: 1m\n      rate: 1\n",
+			errs:    []string{"line 3: schedule.stages require open mode"},
+		},
+		{
+			name: "stages",
+			content: `version: 1
+schedule:
+  mode: open
+  rate: 1
+  stages:
+    - type: constant
+      duration: 0s
+      rate: -1
+    - type: steps
+      duration: 1m
+      steps: 1
+    - type: spike
+      duration: 1m
+      hold: 2m
+    - type: wave
+      duration: 1m
+`,
+			errs: []string{
+				"line 6: stage duration must be positive",
+				"line 6: stage rates must not be negative",
+				"line 9: steps stage needs at least 2 steps",
+				"line 12: spike stage needs a hold that is positive and within its duration",
+				`line 15: stage type must be one of "constant", "ramp", "steps" or "spike"`,
+			},
+		},
+		{
+			name:    "arrivals",
+			content: "version: 1\nqueries:\n  labels:\n    arrival:\n      process: uniform\n      jitter: 2\n  values:\n    arrival:\n      process: burst\n      burst: 1\n  range:\n    arrival:\n      process: random\n",
+			errs: []string{
+				"line 5: uniform arrivals need a jitter above 0 and at most 1",
+				"line 9: burst arrivals need a burst of at least 2",
+				`line 13: arrival process must be one of "fixed", "uniform", "poisson" or "burst"`,
+			},
+		},
+		{
+			name:    "query kind",
+			content: "version: 1\nqueries:\n  labels:\n    interval: -1s\n    concurrency: 0\n    workers: 0\n    rate: -1\n",
+			errs: []string{
+				"line 4: interval must not be negative",
+				"line 4: concurrency must be at least 1",
+				"line 4: workers must be at least 1",
+				"line 4: rate must not be negative",
+			},
+		},
+		{
+			name: "sum-by",
+			content: `version: 1
+queries:
+  range:
+    sumBy:
+      - labels: [a]
+      - name: a
+        sampleLabels: -1
+      - name: a
+`,
+			errs: []string{
+				"line 4: sum-by name must not be empty",
+				`line 4: sum-by "a" sampleLabels must not be negative`,
+				`line 4: sum-by name "a" is not unique`,
+				`line 4: sum-by "a" needs labels or sampleLabels`,
+			},
+		},
+		{
+			name:    "unknown report type",
+			content: "version: 1\nqueries:\n  merge:\n    reportTypes: [flamegraph_svg]\n",
+			errs:    []string{`line 4: unknown report type "flamegraph_svg", expected one of `},
+		},
+		{
+			name: "merge",
+			content: `version: 1
+queries:
+  merge:
+    reportTypes: []
+    filters:
+      - functions: [f]
+      - name: b
+      - name: c
+        sampleFunctions: -1
+        binaries: [x]
+      - name: d
+        binaries: [x]
+        sandwich: true
+      - name: d
+        functions: [f]
+      - name: f
+        sampleFunctions: 1
+    groupBy:
+      - fields: [function_name]
+      - name: e
+        fields: [""]
+      - name: e
+`,
+			errs: []string{
+				"line 4: reportTypes must not be empty",
+				"line 4: filter set name must not be empty",
+				`line 4: filter set "b" needs functions, sampleFunctions or binaries`,
+				`line 4: filter set "c" sampleFunctions must not be negative`,
+				`line 4: filter set "d" needs functions for sandwich or exclude`,
+				`line 4: filter set name "d" is not unique`,
+				`line 4: filter set "f" sampleFunctions needs the flamegraph_arrow report type to sample from`,
+				"line 4: group-by name must not be empty",
+				`line 4: group-by "e" needs fields that are not empty`,
+				`line 4: group-by name "e" is not unique`,
+				`line 4: group-by "e" needs fields that are not empty`,
+			},
+		},
+		{
+			name:    "single and source samples",
+			content: "version: 1\nqueries:\n  single:\n    samples: 0\n  source:\n    samples: 0\n",
+			errs: []string{
+				"line 4: samples must be at least 1",
+				"line 6: samples must be at least 1",
+			},
+		},
+		{
+			name:    "targets",
+			content: "version: 1\nqueries:\n  targets:\n    states: [unhealthy]\n",
+			errs:    []string{`line 4: unknown target state "unhealthy", expected one of active, any, dropped`},
+		},
+		{
+			name:    "no target states",
+			content: "version: 1\nqueries:\n  targets:\n    states: []\n",
+			errs:    []string{"line 4: states must not be empty"},
+		},
+		{
+			name: "diff",
+			content: `version: 1
+queries:
+  diff:
+    comparisons:
+      - offset: 1h
+      - name: a
+        offset: -1h
+      - name: a
+`,
+			errs: []string{
+				"line 4: comparison name must not be empty",
+				`line 4: comparison "a" offset must not be negative`,
+				`line 4: comparison name "a" is not unique`,
+			},
+		},
+		{
+			name:    "no comparisons",
+			content: "version: 1\nqueries:\n  diff:\n    comparisons: []\n",
+			errs:    []string{"line 4: comparisons must not be empty"},
+		},
+		{
+			name: "mix",
+			content: `version: 1
+schedule:
+  mode: open
+  rate: 1
+mix:
+  kinds: {merge: 0, search: -1}
+  profileTypes: {memory: -1}
+`,
+			errs: []string{
+				`line 6: mix.kinds contains unknown query kind "search"`,
+				`line 6: mix.kinds weight of "search" must not be negative`,
+				`line 6: mix.profileTypes weight of "memory" must not be negative`,
+			},
+		},
+		{
+			name:    "no positive mix weight",
+			content: "version: 1\nschedule:\n  mode: open\n  rate: 1\nmix:\n  kinds: {merge: 0}\n",
+			errs:    []string{"line 6: mix.kinds needs at least one positive weight"},
+		},
+		{
+			name:    "limits",
+			content: "version: 1\nlimits:\n  requests: -1\n  maxErrorRatio: 2\n",
+			errs: []string{
+				"line 3: limits must not be negative",
+				"line 3: limits.maxErrorRatio must be between 0 and 1",
+			},
+		},
+		{
+			name:    "selector",
+			content: "version: 1\nselectors:\n  - job=\"api\"\n",
+			errs:    []string{`line 3: label selector "job=\"api\"" must be enclosed in curly braces`},
+		},
+		{
+			name:    "profile type",
+			content: "version: 1\nprofileTypes:\n  - cpu:nanoseconds\n",
+			errs:    []string{`line 3: profile type "cpu:nanoseconds" must be name:sample_type:sample_unit:period_type:period_unit[:delta]`},
+		},
+		{
+			name: "profile type rules",
+			content: `version: 1
+profileTypeRules:
+  - exclude: [flamegraph]
+    maxRange: -1h
+    mode: snapshot
+`,
+			errs: []string{
+				`line 3: unknown query kind "flamegraph", expected one of `,
+				"line 3: maxRange must not be negative",
+				`line 3: mode must be "merge" or "single"`,
+			},
+		},
+		{
+			name: "single mode without range",
+			content: `version: 1
+profileTypeRules:
+  - mode: single
+queries:
+  range:
+    enabled: false
+`,
+			errs: []string{"line 1: profile type rules with mode single require queries.range to be enabled"},
+		},
+		{
+			name: "viewports",
+			content: `version: 1
+viewports:
+  mode: zoom
+  profiles:
+    - width: 100
+    - name: a
+      width: 0
+    - name: a
+      width: 100
+`,
+			errs: []string{
+				`line 3: viewports.mode must be "sweep" or "rotate"`,
+				"line 3: viewport name must not be empty",
+				`line 3: viewport "a" width must be at least 1`,
+				`line 3: viewport name "a" is not unique`,
+			},
+		},
+		{
+			name:    "no viewports",
+			content: "version: 1\nviewports:\n  profiles: []\n",
+			errs:    []string{"line 3: viewports.profiles must not be empty"},
+		},
+		{
+			name: "write",
+			content: `version: 1
+write:
+  rate: 0
+  maxInFlight: 0
+  name: ""
+  labelSets:
+    - {__name__: x, replica: "1"}
+  replicas: 2
+  replay:
+    speed: 0
+  profile:
+    samples: 0
+`,
+			errs: []string{
+				"line 3: write.rate must be positive",
+				"line 3: write.maxInFlight must be at least 1",
+				"line 3: write.name must not be empty",
+				"line 3: write.labelSets must not set __name__, which is write.name",
+				"line 3: write.labelSets must not set replica if write.replicas is above 1",
+				"line 3: write.replay.speed must be positive",
+				"line 3: write.profile functions, mappings, stackDepth and samples must be at least 1",
+			},
+		},
+		{
+			name:    "write mode",
+			content: "version: 1\nwrite:\n  mode: grpc\n",
+			errs:    []string{`line 3: write.mode must be "raw" or "arrow"`},
+		},
+		{
+			name:    "replay in arrow mode",
+			content: "version: 1\nwrite:\n  mode: arrow\n  replay:\n    path: ./captured\n",
+			errs:    []string{"line 3: write.replay requires write.mode raw, as only pprof profiles are replayed"},
+		},
+		{
+			name:    "no write label sets and replicas",
+			content: "version: 1\nwrite:\n  labelSets: []\n  replicas: 0\n",
+			errs: []string{
+				"line 3: write.labelSets must not be empty",
+				"line 3: write.replicas must be at least 1",
+			},
+		},
+		{
+			name: "debuginfo",
+			content: `version: 1
+debuginfo:
+  agents: 0
+  files: 1
+  shared: 2
+  size: -1
+  chunkSize: 0
+  startup: -1s
+  restart:
+    interval: -1s
+`,
+			errs: []string{
+				"line 3: debuginfo.agents must be at least 1",
+				"line 3: debuginfo.shared must be between 0 and debuginfo.files",
+				"line 3: debuginfo.size must not be negative",
+				"line 3: debuginfo.chunkSize must be at least 1",
+				"line 3: debuginfo.startup must not be negative",
+				"line 3: debuginfo.restart.interval must not be negative",
+			},
+		},
+		{
+			name:    "no debuginfo files",
+			content: "version: 1\ndebuginfo:\n  files: 0\n",
+			errs:    []string{"line 3: debuginfo.files must be at least 1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseConfig([]byte(tc.content))
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				t.Fatalf("parseConfig() error = %v, want line-numbered errors", err)
+			}
+			// Errors that list the valid values are only compared up to
+			// the list.
+			match := func(got, want string) bool {
+				if strings.HasSuffix(want, "expected one of ") {
+					return strings.HasPrefix(got, want)
+				}
+				return got == want
+			}
+			if !slices.EqualFunc(typeErr.Errors, tc.errs, match) {
+				t.Errorf("parseConfig() errors =\n%s\nwant\n%s", strings.Join(typeErr.Errors, "\n"), strings.Join(tc.errs, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseConfigWithoutVersion(t *testing.T) {
+	for _, content := range []string{"", "# nothing but a comment\n"} {
+		if _, err := parseConfig([]byte(content)); err == nil || err.Error() != "config is empty or missing the version field" {
+			t.Errorf("parseConfig(%q) error = %v, want missing version", content, err)
+		}
+	}
+
+	_, err := parseConfig([]byte("ranges: [1h]\n"))
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) || !slices.Equal(typeErr.Errors, []string{"line 1: version is required"}) {
+		t.Errorf("parseConfig() error = %v, want version is required", err)
+	}
+}
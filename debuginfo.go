@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/debuginfo/v1alpha1/debuginfov1alpha1connect"
+	debuginfov1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/debuginfo/v1alpha1"
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The steps of the upload handshake.
+const (
+	debuginfoStepShouldInitiate = "should_initiate_upload"
+	debuginfoStepInitiate       = "initiate_upload"
+	debuginfoStepUpload         = "upload"
+	debuginfoStepMarkFinished   = "mark_upload_finished"
+)
+
+// The results of a handshake.
+const (
+	debuginfoResultUploaded      = "uploaded"
+	debuginfoResultSkipped       = "skipped"
+	debuginfoResultAlreadyExists = "already_exists"
+	debuginfoResultFailed        = "failed"
+	debuginfoResultAborted       = "aborted"
+)
+
+type debuginfoMetrics struct {
+	stepHistogram    *prometheus.HistogramVec
+	stepCounter      *prometheus.CounterVec
+	handshakeCounter *prometheus.CounterVec
+	uploadedBytes    prometheus.Counter
+	agentsGauge      prometheus.Gauge
+}
+
+// Uploader simulates Parca Agents that upload the debuginfo files of the
+// binaries they profile through the debuginfo service's upload handshake.
+type Uploader struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	metrics debuginfoMetrics
+
+	client debuginfov1alpha1connect.DebuginfoServiceClient
+	// httpClient uploads to signed URLs, if Parca hands them out.
+	httpClient *http.Client
+	conf       DebuginfoConfig
+}
+
+func NewUploader(
+	reg *prometheus.Registry,
+	client debuginfov1alpha1connect.DebuginfoServiceClient,
+	httpClient *http.Client,
+	conf DebuginfoConfig,
+) *Uploader {
+	return &Uploader{
+		done: make(chan struct{}),
+		metrics: debuginfoMetrics{
+			stepHistogram: promauto.With(reg).NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_debuginfo_seconds",
+					Help:                        "The seconds it takes to make the requests of each debuginfo upload step against a Parca",
+					NativeHistogramBucketFactor: 1.1,
+				},
+				[]string{"grpc_code", "step"},
+			),
+			stepCounter: promauto.With(reg).NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "parca_client_debuginfo_total",
+					Help: "Total number of requests of each debuginfo upload step against Parca",
+				},
+				[]string{"grpc_code", "step"},
+			),
+			handshakeCounter: promauto.With(reg).NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "parca_client_debuginfo_handshakes_total",
+					Help: "Total number of debuginfo upload handshakes by how they ended",
+				},
+				[]string{"result"},
+			),
+			uploadedBytes: promauto.With(reg).NewCounter(
+				prometheus.CounterOpts{
+					Name: "parca_client_debuginfo_uploaded_bytes_total",
+					Help: "Total number of bytes of debuginfo files uploaded to Parca",
+				},
+			),
+			agentsGauge: promauto.With(reg).NewGauge(
+				prometheus.GaugeOpts{
+					Name: "parca_client_debuginfo_active_agents",
+					Help: "The number of simulated agents currently working through their debuginfo files",
+				},
+			),
+		},
+		client:     client,
+		httpClient: httpClient,
+		conf:       conf,
+	}
+}
+
+// Run starts all agents, restarts them at the same time every restart
+// interval, and returns once Stop is called and the agents stopped.
+func (u *Uploader) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	u.cancel = cancel
+
+	defer close(u.done)
+
+	seed := u.conf.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	log.Printf(
+		"debuginfo: %d agents uploading %d files of %d bytes each, with seed %d\n",
+		u.conf.Agents, u.conf.Files, u.conf.Size, seed,
+	)
+
+	for generation, restarted := 0, false; ; restarted = true {
+		// Restarting agents abort the uploads they have in progress.
+		agentsCtx, stopAgents := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		for agent := range u.conf.Agents {
+			// Only the first start is spread; restarts are thundering.
+			var delay time.Duration
+			if !restarted {
+				delay = time.Duration(u.conf.Startup) * time.Duration(agent) / time.Duration(u.conf.Agents)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				u.runAgent(agentsCtx, seed, generation, agent, delay)
+			}()
+		}
+
+		var restart <-chan time.Time
+		if u.conf.Restart.Interval > 0 {
+			restart = time.After(time.Duration(u.conf.Restart.Interval))
+		}
+		select {
+		case <-ctx.Done():
+		case <-restart:
+		}
+		stopAgents()
+		wg.Wait()
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if u.conf.Restart.NewBuildIDs {
+			generation++
+		}
+		log.Printf("debuginfo: restarting all %d agents\n", u.conf.Agents)
+	}
+}
+
+func (u *Uploader) Stop() {
+	u.cancel()
+	<-u.done
+}
+
+// runAgent uploads the files of an agent one after the other, like an agent
+// does after starting up, which it does after the delay.
+func (u *Uploader) runAgent(ctx context.Context, seed uint64, generation, agent int, delay time.Duration) {
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	u.metrics.agentsGauge.Inc()
+	defer u.metrics.agentsGauge.Dec()
+
+	for i := range u.conf.Files {
+		f := u.file(seed, generation, agent, i)
+		result, err := u.handshake(ctx, f)
+		if ctx.Err() != nil {
+			result = debuginfoResultAborted
+		} else if err != nil {
+			log.Printf("debuginfo(agent=%d,build_id=%s): %s: %v\n", agent, f.buildIDHex(), result, err)
+		}
+		u.metrics.handshakeCounter.WithLabelValues(result).Inc()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// file returns the i-th file of an agent. The shared files have the same build
+// ID on every agent, all others are unique to the agent.
+func (u *Uploader) file(seed uint64, generation, agent, i int) syntheticELF {
+	if i < u.conf.Shared {
+		agent = -1
+	}
+	// GNU build IDs are usually a SHA-1 hash.
+	id := sha1.Sum(fmt.Appendf(nil, "%d/%d/%d/%d", seed, generation, agent, i))
+	return syntheticELF{buildID: id[:], textSize: u.conf.Size}
+}
+
+// handshake asks Parca whether the file should be uploaded, initiates the
+// upload, uploads the file as instructed and marks the upload as finished. It
+// returns how the handshake ended.
+func (u *Uploader) handshake(ctx context.Context, f syntheticELF) (string, error) {
+	hash, err := f.hash()
+	if err != nil {
+		return debuginfoResultFailed, err
+	}
+	buildID := f.buildIDHex()
+
+	should, err := debuginfoStep(u, debuginfoStepShouldInitiate, func() (*connect.Response[debuginfov1alpha1.ShouldInitiateUploadResponse], error) {
+		return u.client.ShouldInitiateUpload(ctx, connect.NewRequest(&debuginfov1alpha1.ShouldInitiateUploadRequest{
+			BuildId:     buildID,
+			Hash:        hash,
+			Type:        debuginfov1alpha1.DebuginfoType_DEBUGINFO_TYPE_DEBUGINFO_UNSPECIFIED,
+			BuildIdType: debuginfov1alpha1.BuildIDType_BUILD_ID_TYPE_GNU,
+		}))
+	})
+	if err != nil {
+		return debuginfoResultFailed, err
+	}
+	if !should.Msg.ShouldInitiateUpload {
+		return debuginfoResultSkipped, nil
+	}
+
+	initiated, err := debuginfoStep(u, debuginfoStepInitiate, func() (*connect.Response[debuginfov1alpha1.InitiateUploadResponse], error) {
+		return u.client.InitiateUpload(ctx, connect.NewRequest(&debuginfov1alpha1.InitiateUploadRequest{
+			BuildId:     buildID,
+			Size:        f.size(),
+			Hash:        hash,
+			Type:        debuginfov1alpha1.DebuginfoType_DEBUGINFO_TYPE_DEBUGINFO_UNSPECIFIED,
+			BuildIdType: debuginfov1alpha1.BuildIDType_BUILD_ID_TYPE_GNU,
+		}))
+	})
+	if connect.CodeOf(err) == connect.CodeAlreadyExists {
+		// Another agent with the same binary got to upload it first.
+		return debuginfoResultAlreadyExists, nil
+	}
+	if err != nil {
+		return debuginfoResultFailed, err
+	}
+	instructions := initiated.Msg.UploadInstructions
+
+	_, err = debuginfoStep(u, debuginfoStepUpload, func() (struct{}, error) {
+		switch instructions.UploadStrategy {
+		case debuginfov1alpha1.UploadInstructions_UPLOAD_STRATEGY_GRPC:
+			return struct{}{}, u.uploadGRPC(ctx, f, instructions)
+		case debuginfov1alpha1.UploadInstructions_UPLOAD_STRATEGY_SIGNED_URL:
+			return struct{}{}, u.uploadSignedURL(ctx, f, instructions.SignedUrl)
+		default:
+			return struct{}{}, fmt.Errorf("unsupported upload strategy %s", instructions.UploadStrategy)
+		}
+	})
+	if err != nil {
+		return debuginfoResultFailed, err
+	}
+	u.metrics.uploadedBytes.Add(float64(f.size()))
+
+	_, err = debuginfoStep(u, debuginfoStepMarkFinished, func() (*connect.Response[debuginfov1alpha1.MarkUploadFinishedResponse], error) {
+		return u.client.MarkUploadFinished(ctx, connect.NewRequest(&debuginfov1alpha1.MarkUploadFinishedRequest{
+			BuildId:  buildID,
+			UploadId: instructions.UploadId,
+			Type:     instructions.Type,
+		}))
+	})
+	if err != nil {
+		return debuginfoResultFailed, err
+	}
+	return debuginfoResultUploaded, nil
+}
+
+// debuginfoStep makes the request of a handshake step and records how long it
+// took and its code.
+func debuginfoStep[T any](u *Uploader, step string, request func() (T, error)) (T, error) {
+	start := time.Now()
+	res, err := request()
+	latency := time.Since(start)
+
+	code := grpcCodeOK
+	if err != nil {
+		code = connect.CodeOf(err).String()
+	}
+	u.metrics.stepHistogram.WithLabelValues(code, step).Observe(latency.Seconds())
+	u.metrics.stepCounter.WithLabelValues(code, step).Inc()
+	return res, err
+}
+
+// uploadGRPC streams the file to Parca, first the upload info and then the
+// content in chunks.
+func (u *Uploader) uploadGRPC(ctx context.Context, f syntheticELF, instructions *debuginfov1alpha1.UploadInstructions) error {
+	stream := u.client.Upload(ctx)
+	send := func() error {
+		err := stream.Send(&debuginfov1alpha1.UploadRequest{
+			Data: &debuginfov1alpha1.UploadRequest_Info{Info: &debuginfov1alpha1.UploadInfo{
+				BuildId:  instructions.BuildId,
+				UploadId: instructions.UploadId,
+				Type:     instructions.Type,
+			}},
+		})
+		if err != nil {
+			return err
+		}
+
+		r := f.reader()
+		chunk := make([]byte, u.conf.ChunkSize)
+		for {
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				err := stream.Send(&debuginfov1alpha1.UploadRequest{
+					Data: &debuginfov1alpha1.UploadRequest_ChunkData{ChunkData: chunk[:n]},
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	sendErr := send()
+	// If sending failed because Parca responded early, closing the stream
+	// returns Parca's error.
+	if _, err := stream.CloseAndReceive(); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// uploadSignedURL puts the file to the signed URL of an object storage.
+func (u *Uploader) uploadSignedURL(ctx context.Context, f syntheticELF, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, f.reader())
+	if err != nil {
+		return err
+	}
+	req.ContentLength = f.size()
+
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("signed URL upload: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/debuginfo/v1alpha1/debuginfov1alpha1connect"
+	debuginfov1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/debuginfo/v1alpha1"
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeDebuginfoClient hands out signed URLs of its own server, and asks for
+// every build ID to be uploaded until an upload of it finished.
+type fakeDebuginfoClient struct {
+	debuginfov1alpha1connect.DebuginfoServiceClient
+	url string
+
+	mu sync.Mutex
+	// asked counts the ShouldInitiateUpload requests by build ID.
+	asked    map[string]int
+	uploaded map[string]int64
+	finished map[string]bool
+	// initiated are the build IDs whose upload another agent initiated.
+	initiated map[string]bool
+}
+
+func newFakeDebuginfoClient(t *testing.T) *fakeDebuginfoClient {
+	c := &fakeDebuginfoClient{
+		asked:     map[string]int{},
+		uploaded:  map[string]int64{},
+		finished:  map[string]bool{},
+		initiated: map[string]bool{},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		c.mu.Lock()
+		c.uploaded[r.URL.Path[1:]] = n
+		c.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	c.url = srv.URL
+	return c
+}
+
+func (c *fakeDebuginfoClient) ShouldInitiateUpload(_ context.Context, req *connect.Request[debuginfov1alpha1.ShouldInitiateUploadRequest]) (*connect.Response[debuginfov1alpha1.ShouldInitiateUploadResponse], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.asked[req.Msg.BuildId]++
+	return connect.NewResponse(&debuginfov1alpha1.ShouldInitiateUploadResponse{
+		ShouldInitiateUpload: !c.finished[req.Msg.BuildId],
+	}), nil
+}
+
+func (c *fakeDebuginfoClient) InitiateUpload(_ context.Context, req *connect.Request[debuginfov1alpha1.InitiateUploadRequest]) (*connect.Response[debuginfov1alpha1.InitiateUploadResponse], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.initiated[req.Msg.BuildId] {
+		return nil, connect.NewError(connect.CodeAlreadyExists, nil)
+	}
+	c.initiated[req.Msg.BuildId] = true
+	return connect.NewResponse(&debuginfov1alpha1.InitiateUploadResponse{
+		UploadInstructions: &debuginfov1alpha1.UploadInstructions{
+			BuildId:        req.Msg.BuildId,
+			UploadId:       "upload-" + req.Msg.BuildId,
+			UploadStrategy: debuginfov1alpha1.UploadInstructions_UPLOAD_STRATEGY_SIGNED_URL,
+			SignedUrl:      c.url + "/" + req.Msg.BuildId,
+			Type:           req.Msg.Type,
+		},
+	}), nil
+}
+
+func (c *fakeDebuginfoClient) MarkUploadFinished(_ context.Context, req *connect.Request[debuginfov1alpha1.MarkUploadFinishedRequest]) (*connect.Response[debuginfov1alpha1.MarkUploadFinishedResponse], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req.Msg.UploadId != "upload-"+req.Msg.BuildId {
+		return nil, connect.NewError(connect.CodeInvalidArgument, nil)
+	}
+	c.finished[req.Msg.BuildId] = true
+	return connect.NewResponse(&debuginfov1alpha1.MarkUploadFinishedResponse{}), nil
+}
+
+func TestHandshake(t *testing.T) {
+	client := newFakeDebuginfoClient(t)
+	conf := defaultConfig().Debuginfo
+	conf.Size = 1000
+	u := NewUploader(prometheus.NewRegistry(), client, http.DefaultClient, conf)
+	f := u.file(1, 0, 0, 0)
+
+	result, err := u.handshake(context.Background(), f)
+	if err != nil || result != debuginfoResultUploaded {
+		t.Fatalf("handshake() = %s, %v, want %s", result, err, debuginfoResultUploaded)
+	}
+	if got := client.uploaded[f.buildIDHex()]; got != f.size() {
+		t.Errorf("uploaded %d bytes to the signed URL, want %d", got, f.size())
+	}
+	if got := testutil.ToFloat64(u.metrics.uploadedBytes); got != float64(f.size()) {
+		t.Errorf("parca_client_debuginfo_uploaded_bytes_total = %g, want %d", got, f.size())
+	}
+	for _, step := range []string{debuginfoStepShouldInitiate, debuginfoStepInitiate, debuginfoStepUpload, debuginfoStepMarkFinished} {
+		if got := testutil.ToFloat64(u.metrics.stepCounter.WithLabelValues(grpcCodeOK, step)); got != 1 {
+			t.Errorf("parca_client_debuginfo_total{grpc_code=%q,step=%q} = %g, want 1", grpcCodeOK, step, got)
+		}
+	}
+
+	if result, err := u.handshake(context.Background(), f); err != nil || result != debuginfoResultSkipped {
+		t.Errorf("handshake() of an uploaded file = %s, %v, want %s", result, err, debuginfoResultSkipped)
+	}
+
+	// Another agent initiated the upload, but hasn't finished it yet.
+	other := u.file(1, 0, 0, 1)
+	client.initiated[other.buildIDHex()] = true
+	if result, err := u.handshake(context.Background(), other); err != nil || result != debuginfoResultAlreadyExists {
+		t.Errorf("handshake() of a file another agent uploads = %s, %v, want %s", result, err, debuginfoResultAlreadyExists)
+	}
+	if got := testutil.ToFloat64(u.metrics.stepCounter.WithLabelValues(connect.CodeAlreadyExists.String(), debuginfoStepInitiate)); got != 1 {
+		t.Errorf("parca_client_debuginfo_total{grpc_code=%q,step=%q} = %g, want 1", connect.CodeAlreadyExists, debuginfoStepInitiate, got)
+	}
+}
+
+func TestUploaderFiles(t *testing.T) {
+	conf := defaultConfig().Debuginfo
+	conf.Files, conf.Shared = 3, 1
+	u := NewUploader(prometheus.NewRegistry(), nil, nil, conf)
+
+	if u.file(1, 0, 0, 0).buildIDHex() != u.file(1, 0, 1, 0).buildIDHex() {
+		t.Error("the shared file has a different build ID on every agent")
+	}
+	if u.file(1, 0, 0, 1).buildIDHex() == u.file(1, 0, 1, 1).buildIDHex() {
+		t.Error("agents share a file that isn't shared")
+	}
+	if u.file(1, 0, 0, 1).buildIDHex() == u.file(1, 1, 0, 1).buildIDHex() {
+		t.Error("a new generation kept the build ID")
+	}
+}
+
+func TestUploaderRestartsAtOnce(t *testing.T) {
+	client := newFakeDebuginfoClient(t)
+	conf := defaultConfig().Debuginfo
+	conf.Agents, conf.Files, conf.Shared, conf.Size = 2, 1, 0, 100
+	// Without restarts, the second agent would only start after an hour.
+	conf.Startup = Duration(2 * time.Hour)
+	conf.Restart.Interval = Duration(50 * time.Millisecond)
+	conf.Seed = 1
+	u := NewUploader(prometheus.NewRegistry(), client, http.DefaultClient, conf)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = u.Run(context.Background())
+	}()
+	t.Cleanup(func() {
+		u.Stop()
+		<-done
+	})
+
+	second := u.file(conf.Seed, 0, 1, 0).buildIDHex()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		client.mu.Lock()
+		asked := client.asked[second]
+		client.mu.Unlock()
+		if asked > 0 {
+			return
+		}
+	}
+	t.Error("the second agent didn't start after a restart, which was spread like the first start")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// joinSelectors returns a selector that matches both selectors. Empty
+// selectors and "all" match everything.
+func joinSelectors(a, b string) string {
+	var matchers []string
+	for _, s := range []string{a, b} {
+		if s == "all" {
+			continue
+		}
+		if m := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")); m != "" {
+			matchers = append(matchers, m)
+		}
+	}
+	if len(matchers) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+// diffRequests compares two windows of the same range for every profile type,
+// range, selector and comparison.
+func (q *Querier) diffRequests() []request {
+	w := q.workload.Load()
+	comparisons := q.queries.Diff.Comparisons
+	viewports := q.viewports()
+	reqs := make([]request, 0, len(w.profileTypes)*len(w.queryTimeRanges)*len(w.labelSelectors)*len(comparisons)*len(viewports))
+	for _, profileType := range w.profileTypesFor("diff") {
+		for _, tr := range w.rangesFor(profileType) {
+			for _, labelSelector := range w.labelSelectors {
+				for _, comparison := range comparisons {
+					for _, vp := range viewports {
+						reqs = append(reqs, request{profileType: profileType, do: func(ctx context.Context) error {
+							vp := q.viewport(vp)
+							offset := tr
+							if comparison.Offset != nil {
+								offset = time.Duration(*comparison.Offset)
+							}
+							rangeEnd := time.Now()
+							rangeStart := rangeEnd.Add(-1 * tr)
+
+							queryA := profileType + joinSelectors(labelSelector, string(comparison.A))
+							queryB := profileType + joinSelectors(labelSelector, string(comparison.B))
+
+							labels := queryLabels{mode: "diff", reportType: reportTypeFlamegraphArrow, tr: tr.String(), labels: labelSelector, comparison: comparison.Name, viewport: vp.Name}
+							queryStart := time.Now()
+							resp, err := q.client.Query(
+								ctx, connect.NewRequest(
+									&queryv1alpha1.QueryRequest{
+										Mode: queryv1alpha1.QueryRequest_MODE_DIFF,
+										Options: &queryv1alpha1.QueryRequest_Diff{
+											Diff: &queryv1alpha1.DiffProfile{
+												A: &queryv1alpha1.ProfileDiffSelection{
+													Mode: queryv1alpha1.ProfileDiffSelection_MODE_MERGE,
+													Options: &queryv1alpha1.ProfileDiffSelection_Merge{
+														Merge: &queryv1alpha1.MergeProfile{
+															Query: queryA,
+															Start: timestamppb.New(rangeStart.Add(-offset)),
+															End:   timestamppb.New(rangeEnd.Add(-offset)),
+														},
+													},
+												},
+												B: &queryv1alpha1.ProfileDiffSelection{
+													Mode: queryv1alpha1.ProfileDiffSelection_MODE_MERGE,
+													Options: &queryv1alpha1.ProfileDiffSelection_Merge{
+														Merge: &queryv1alpha1.MergeProfile{
+															Query: queryB,
+															Start: timestamppb.New(rangeStart),
+															End:   timestamppb.New(rangeEnd),
+														},
+													},
+												},
+											},
+										},
+										ReportType:        reportTypeFlamegraphArrow.proto(),
+										NodeTrimThreshold: vp.nodeTrimThreshold(),
+									},
+								),
+							)
+							latency := time.Since(queryStart)
+							q.observeQuery(ctx, queryStart, latency, labels, resp, err)
+							if err != nil {
+								log.Printf(
+									"diff(a=%s,b=%s,over=%s,offset=%s,labels=%s,viewport=%s): failed to make request: %v\n",
+									queryA, queryB, tr, offset, labelSelector, vp.Name, err,
+								)
+								return err
+							}
+
+							log.Printf(
+								"diff(a=%s,b=%s,over=%s,offset=%s,labels=%s,viewport=%s): took %s\n",
+								queryA, queryB, tr, offset, labelSelector, vp.Name, latency,
+							)
+							return nil
+						}})
+					}
+				}
+			}
+		}
+	}
+	return reqs
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestJoinSelectors(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"", "", ""},
+		{"all", "", ""},
+		{`{job="a"}`, "", `{job="a"}`},
+		{"", `{pod="b"}`, `{pod="b"}`},
+		{`{job="a"}`, `{pod="b"}`, `{job="a",pod="b"}`},
+		{`{job="a"}`, "all", `{job="a"}`},
+		{"{}", `{ pod="b" }`, `{pod="b"}`},
+	}
+	for _, tt := range tests {
+		if got := joinSelectors(tt.a, tt.b); got != tt.want {
+			t.Errorf("joinSelectors(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/rand/v2"
+)
+
+// Constants of the ELF64 format used by the synthetic debuginfo files.
+const (
+	elfHeaderSize        = 64
+	elfSectionHeaderSize = 64
+
+	elfTypeExec      = 2
+	elfMachineX86_64 = 62
+
+	elfSectionProgbits = 1
+	elfSectionStrtab   = 3
+	elfSectionNote     = 7
+
+	elfFlagAlloc     = 0x2
+	elfFlagExecInstr = 0x4
+
+	elfNoteGNUBuildID = 3
+)
+
+const (
+	// elfNoteOffset is where the build ID note starts, right after the ELF
+	// header.
+	elfNoteOffset = elfHeaderSize
+	// elfTextOffset is where the .text section starts, after the note.
+	elfTextOffset = 128
+	// elfSectionNames is the .shstrtab section. The names start at offsets
+	// 1, 20 and 26.
+	elfSectionNames = "\x00.note.gnu.build-id\x00.text\x00.shstrtab\x00"
+)
+
+// syntheticELF is a debuginfo file with a GNU build ID note and a .text
+// section of random bytes. Its content is derived from the build ID, so it is
+// the same every time it is read and never needs to be held in memory.
+type syntheticELF struct {
+	buildID []byte
+	// textSize is the size of the .text section, which makes up almost all
+	// of the file.
+	textSize int64
+}
+
+func (f syntheticELF) buildIDHex() string {
+	return hex.EncodeToString(f.buildID)
+}
+
+// size returns the size of the whole file in bytes.
+func (f syntheticELF) size() int64 {
+	head, tail := f.encode()
+	return int64(len(head)) + f.textSize + int64(len(tail))
+}
+
+// reader returns a reader of the file's content.
+func (f syntheticELF) reader() io.Reader {
+	head, tail := f.encode()
+	seed := sha256.Sum256(f.buildID)
+	return io.MultiReader(
+		bytes.NewReader(head),
+		io.LimitReader(rand.NewChaCha8(seed), f.textSize),
+		bytes.NewReader(tail),
+	)
+}
+
+// hash returns the hex encoded SHA-256 of the file's content.
+func (f syntheticELF) hash() (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f.reader()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// encode returns what comes before the .text section, which is the ELF
+// header and the build ID note, and what comes after it, which is the
+// section names and the section header table.
+func (f syntheticELF) encode() (head, tail []byte) {
+	le := binary.LittleEndian
+	namesOffset := uint64(elfTextOffset + f.textSize)
+	sectionsOffset := (namesOffset + uint64(len(elfSectionNames)) + 7) &^ 7
+
+	head = append(head, 0x7f, 'E', 'L', 'F', 2 /* 64-bit */, 1 /* little endian */, 1 /* version */)
+	head = append(head, make([]byte, 16-len(head))...)
+	head = le.AppendUint16(head, elfTypeExec)
+	head = le.AppendUint16(head, elfMachineX86_64)
+	head = le.AppendUint32(head, 1)              // version
+	head = le.AppendUint64(head, 0)              // entry
+	head = le.AppendUint64(head, 0)              // program header offset
+	head = le.AppendUint64(head, sectionsOffset) // section header offset
+	head = le.AppendUint32(head, 0)              // flags
+	head = le.AppendUint16(head, elfHeaderSize)
+	head = le.AppendUint16(head, 0) // program header size
+	head = le.AppendUint16(head, 0) // program headers
+	head = le.AppendUint16(head, elfSectionHeaderSize)
+	head = le.AppendUint16(head, 4) // sections
+	head = le.AppendUint16(head, 3) // index of .shstrtab
+
+	head = le.AppendUint32(head, 4) // name size
+	head = le.AppendUint32(head, uint32(len(f.buildID)))
+	head = le.AppendUint32(head, elfNoteGNUBuildID)
+	head = append(head, "GNU\x00"...)
+	head = append(head, f.buildID...)
+	noteSize := uint64(len(head) - elfNoteOffset)
+	head = append(head, make([]byte, elfTextOffset-len(head))...)
+
+	tail = append(tail, elfSectionNames...)
+	tail = append(tail, make([]byte, sectionsOffset-namesOffset-uint64(len(elfSectionNames)))...)
+	section := func(name, typ uint32, flags, offset, size, align uint64) {
+		tail = le.AppendUint32(tail, name)
+		tail = le.AppendUint32(tail, typ)
+		tail = le.AppendUint64(tail, flags)
+		tail = le.AppendUint64(tail, 0) // address
+		tail = le.AppendUint64(tail, offset)
+		tail = le.AppendUint64(tail, size)
+		tail = le.AppendUint32(tail, 0) // link
+		tail = le.AppendUint32(tail, 0) // info
+		tail = le.AppendUint64(tail, align)
+		tail = le.AppendUint64(tail, 0) // entry size
+	}
+	section(0, 0, 0, 0, 0, 0)
+	section(1, elfSectionNote, elfFlagAlloc, elfNoteOffset, noteSize, 4)
+	section(20, elfSectionProgbits, elfFlagAlloc|elfFlagExecInstr, elfTextOffset, uint64(f.textSize), 16)
+	section(26, elfSectionStrtab, 0, namesOffset, uint64(len(elfSectionNames)), 1)
+	return head, tail
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func TestSyntheticELF(t *testing.T) {
+	buildID := bytes.Repeat([]byte{0xab, 0xcd}, 10)
+	for _, textSize := range []int64{0, 1, 1000, 1 << 16} {
+		f := syntheticELF{buildID: buildID, textSize: textSize}
+		content, err := io.ReadAll(f.reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(content)) != f.size() {
+			t.Errorf("textSize %d: read %d bytes, size() = %d", textSize, len(content), f.size())
+		}
+
+		file, err := elf.NewFile(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("textSize %d: not an ELF file: %v", textSize, err)
+		}
+		if file.Class != elf.ELFCLASS64 || file.Machine != elf.EM_X86_64 || file.Type != elf.ET_EXEC {
+			t.Errorf("textSize %d: got %s %s %s", textSize, file.Class, file.Machine, file.Type)
+		}
+		text := file.Section(".text")
+		if text == nil || text.Type != elf.SHT_PROGBITS || int64(text.Size) != textSize {
+			t.Errorf("textSize %d: .text section = %+v", textSize, text)
+		}
+
+		note := file.Section(".note.gnu.build-id")
+		if note == nil || note.Type != elf.SHT_NOTE {
+			t.Fatalf("textSize %d: no build ID note", textSize)
+		}
+		data, err := note.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The note is the name and descriptor sizes, the type, "GNU\0" and
+		// the build ID.
+		if got := hex.EncodeToString(data[16:]); got != f.buildIDHex() {
+			t.Errorf("textSize %d: build ID = %s, want %s", textSize, got, f.buildIDHex())
+		}
+		if string(data[12:16]) != "GNU\x00" || file.ByteOrder.Uint32(data[8:12]) != elfNoteGNUBuildID {
+			t.Errorf("textSize %d: note is not a GNU build ID: %x", textSize, data[:16])
+		}
+
+		sum := sha256.Sum256(content)
+		hash, err := f.hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != hex.EncodeToString(sum[:]) {
+			t.Errorf("textSize %d: hash() = %s, want the SHA-256 of the content", textSize, hash)
+		}
+	}
+}
+
+func TestSyntheticELFContent(t *testing.T) {
+	a := syntheticELF{buildID: []byte{1, 2, 3}, textSize: 4096}
+	b := syntheticELF{buildID: []byte{1, 2, 4}, textSize: 4096}
+
+	first, _ := io.ReadAll(a.reader())
+	second, _ := io.ReadAll(a.reader())
+	if !bytes.Equal(first, second) {
+		t.Error("reading the same file twice returned different content")
+	}
+	other, _ := io.ReadAll(b.reader())
+	if bytes.Equal(first[elfTextOffset:elfTextOffset+4096], other[elfTextOffset:elfTextOffset+4096]) {
+		t.Error("files with different build IDs have the same .text")
+	}
+}
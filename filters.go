@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+)
+
+// filter returns the filters and the function to sandwich by of the filter
+// set. Sampled function names are taken from earlier flamegraphs of the
+// profile type, so filter sets that sample them are only requested once a
+// flamegraph listed any.
+func (q *Querier) filter(set FilterSetConfig, profileType string) ([]*queryv1alpha1.Filter, *string, error) {
+	functions := set.Functions
+	if set.SampleFunctions > 0 {
+		sampled := q.functions.sample(profileType, set.SampleFunctions)
+		if len(sampled) == 0 {
+			return nil, nil, fmt.Errorf("no function names known for %s to sample filters from", profileType)
+		}
+		functions = append(functions[:len(functions):len(functions)], sampled...)
+	}
+
+	var filters []*queryv1alpha1.Filter
+	var sandwich *string
+	if set.Sandwich {
+		sandwich = &functions[0]
+		functions = functions[1:]
+	}
+	for _, function := range functions {
+		filters = append(filters, &queryv1alpha1.Filter{
+			Filter: &queryv1alpha1.Filter_StackFilter{
+				StackFilter: &queryv1alpha1.StackFilter{
+					Filter: &queryv1alpha1.StackFilter_FunctionNameStackFilter{
+						FunctionNameStackFilter: &queryv1alpha1.FunctionNameStackFilter{
+							FunctionToFilter: function,
+							Exclude:          set.Exclude,
+						},
+					},
+				},
+			},
+		})
+	}
+	if len(set.Binaries) > 0 {
+		filters = append(filters, &queryv1alpha1.Filter{
+			Filter: &queryv1alpha1.Filter_FrameFilter{
+				FrameFilter: &queryv1alpha1.FrameFilter{
+					Filter: &queryv1alpha1.FrameFilter_BinaryFrameFilter{
+						BinaryFrameFilter: &queryv1alpha1.BinaryFrameFilter{
+							IncludeBinaries: set.Binaries,
+						},
+					},
+				},
+			},
+		})
+	}
+	return filters, sandwich, nil
+}
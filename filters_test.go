@@ -0,0 +1,131 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+)
+
+const testProfileType = "memory:inuse_space:bytes:space:bytes"
+
+// filterFunctions returns the function names of the stack filters and whether
+// they exclude, and the binaries of the frame filters.
+func filterFunctions(filters []*queryv1alpha1.Filter) (functions []string, exclude bool, binaries []string) {
+	for _, f := range filters {
+		if fn := f.GetStackFilter().GetFunctionNameStackFilter(); fn != nil {
+			functions = append(functions, fn.GetFunctionToFilter())
+			exclude = exclude || fn.GetExclude()
+		}
+		if b := f.GetFrameFilter().GetBinaryFrameFilter(); b != nil {
+			binaries = append(binaries, b.GetIncludeBinaries()...)
+		}
+	}
+	return functions, exclude, binaries
+}
+
+func TestFilter(t *testing.T) {
+	q, _ := newTestQuerier(t, LimitsConfig{})
+
+	filters, sandwich, err := q.filter(FilterSetConfig{}, testProfileType)
+	if err != nil || filters != nil || sandwich != nil {
+		t.Errorf("filter() of the unfiltered set = %v, %v, %v, want no filters", filters, sandwich, err)
+	}
+
+	filters, sandwich, err = q.filter(FilterSetConfig{
+		Name:      "hide-runtime",
+		Functions: []string{"runtime."},
+		Exclude:   true,
+		Binaries:  []string{"parca-agent"},
+	}, testProfileType)
+	if err != nil {
+		t.Fatalf("filter() error = %v", err)
+	}
+	functions, exclude, binaries := filterFunctions(filters)
+	if !slices.Equal(functions, []string{"runtime."}) || !exclude || !slices.Equal(binaries, []string{"parca-agent"}) || sandwich != nil {
+		t.Errorf("filter() = functions %q, exclude %t, binaries %q, sandwich %v", functions, exclude, binaries, sandwich)
+	}
+
+	sampled := FilterSetConfig{Name: "sandwich", SampleFunctions: 1, Sandwich: true}
+	if _, _, err := q.filter(sampled, testProfileType); err == nil {
+		t.Error("filter() sampled function names before any were known")
+	}
+
+	q.functions.store(testProfileType, []string{"main"})
+	filters, sandwich, err = q.filter(sampled, testProfileType)
+	if err != nil {
+		t.Fatalf("filter() error = %v", err)
+	}
+	if sandwich == nil || *sandwich != "main" || len(filters) != 0 {
+		t.Errorf("filter() = %v, sandwich %v, want only a sandwich by main", filters, sandwich)
+	}
+}
+
+func TestFilterKeepsConfiguredFunctions(t *testing.T) {
+	q, _ := newTestQuerier(t, LimitsConfig{})
+	q.functions.store(testProfileType, []string{"main"})
+
+	functions := make([]string, 1, 2)
+	functions[0] = "runtime.mallocgc"
+	set := FilterSetConfig{Functions: functions, SampleFunctions: 1}
+	filters, _, err := q.filter(set, testProfileType)
+	if err != nil {
+		t.Fatalf("filter() error = %v", err)
+	}
+	if got, _, _ := filterFunctions(filters); !slices.Equal(got, []string{"runtime.mallocgc", "main"}) {
+		t.Errorf("filter() functions = %q, want the configured and the sampled one", got)
+	}
+	// Sampling must not write into the spare capacity of the configuration.
+	if got := functions[:2][1]; got != "" {
+		t.Errorf("filter() appended %q to the configured functions", got)
+	}
+}
+
+func TestStoreFlamegraph(t *testing.T) {
+	q, _ := newTestQuerier(t, LimitsConfig{})
+	fg := &queryv1alpha1.FlamegraphArrow{Record: testFlamegraph()}
+
+	q.storeFlamegraph(testProfileType, fg)
+	if q.functions.known(testProfileType) {
+		t.Error("storeFlamegraph() decoded the flamegraph without a filter set sampling functions")
+	}
+
+	q.queries.Merge.Filters = []FilterSetConfig{{Name: "sampled", SampleFunctions: 2}}
+	q.storeFlamegraph(testProfileType, fg)
+	got := q.functions.sample(testProfileType, 4)
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"main", "runtime.gcBgMarkWorker", "runtime.mallocgc"}) {
+		t.Errorf("storeFlamegraph() stored %q, want the function names of the flamegraph", got)
+	}
+
+	if q.sources.known(testProfileType) {
+		t.Error("storeFlamegraph() stored source files while source reports are disabled")
+	}
+
+	// A record that can't be decoded keeps the names known so far.
+	q.storeFlamegraph(testProfileType, &queryv1alpha1.FlamegraphArrow{Record: []byte{1, 2, 3}})
+	if !q.functions.known(testProfileType) {
+		t.Error("storeFlamegraph() forgot the function names after a broken record")
+	}
+}
+
+func TestMergeRequestsWaitForFunctions(t *testing.T) {
+	q, _ := newTestQuerier(t, LimitsConfig{})
+	q.queries.Merge.ReportTypes = []ReportType{reportTypeFlamegraphArrow}
+	q.queries.Merge.Filters = []FilterSetConfig{{Name: "sampled", SampleFunctions: 1}}
+	q.workload.Store(&workload{
+		profileTypes:    []string{testProfileType},
+		queryTimeRanges: []time.Duration{time.Hour},
+		labelSelectors:  []string{"all"},
+	})
+
+	unfiltered := len(q.mergeRequests())
+	if unfiltered == 0 {
+		t.Fatal("mergeRequests() returned no requests")
+	}
+	q.functions.store(testProfileType, []string{"main"})
+	if got := len(q.mergeRequests()); got != 2*unfiltered {
+		t.Errorf("mergeRequests() = %d requests once functions are known, want %d", got, 2*unfiltered)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+)
+
+// The columns of flamegraph records that hold the names of each node.
+const (
+	flamegraphFunctionName = "function_name"
+	flamegraphBuildID      = "mapping_build_id"
+	flamegraphFileName     = "function_file_name"
+)
+
+// flamegraphNames are the names listed by a flamegraph that later requests
+// are sampled from.
+type flamegraphNames struct {
+	// functions are the distinct function names.
+	functions []string
+	// sources are the distinct source files of binaries with a build ID.
+	sources []sourceRef
+}
+
+// readFlamegraphNames decodes the Arrow record of a flamegraph and returns
+// the names of its nodes. Nodes without a function name, like the root node,
+// are left out, and so are the source files of nodes without a build ID or
+// filename, as they can't be looked up.
+func readFlamegraphNames(record []byte) (flamegraphNames, error) {
+	columns, err := readArrowStrings(record, flamegraphFunctionName, flamegraphBuildID, flamegraphFileName)
+	if err != nil {
+		return flamegraphNames{}, err
+	}
+
+	var names flamegraphNames
+	seen := map[string]bool{}
+	for _, name := range columns[flamegraphFunctionName] {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names.functions = append(names.functions, name)
+	}
+
+	buildIDs, fileNames := columns[flamegraphBuildID], columns[flamegraphFileName]
+	seenSources := map[sourceRef]bool{}
+	for i := range min(len(buildIDs), len(fileNames)) {
+		ref := sourceRef{buildID: buildIDs[i], filename: fileNames[i]}
+		if ref.buildID == "" || ref.filename == "" || seenSources[ref] {
+			continue
+		}
+		seenSources[ref] = true
+		names.sources = append(names.sources, ref)
+	}
+	return names, nil
+}
+
+// storeFlamegraph keeps the names of an unfiltered flamegraph of the profile
+// type to sample filters and source reports from. Flamegraphs are only
+// decoded if a filter set samples function names or source reports are
+// enabled.
+func (q *Querier) storeFlamegraph(profileType string, fg *queryv1alpha1.FlamegraphArrow) {
+	samplesFunctions := q.queries.Merge.samplesFunctions()
+	samplesSources := q.queries.Source.Kind.Enabled
+	if !samplesFunctions && !samplesSources {
+		return
+	}
+	names, err := readFlamegraphNames(fg.GetRecord())
+	if err != nil {
+		log.Printf("merge(type=%s): failed to read the names of the flamegraph: %v\n", profileType, err)
+		return
+	}
+	if samplesFunctions {
+		q.functions.store(profileType, names.functions)
+	}
+	if samplesSources {
+		q.sources.store(profileType, names.sources)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type scheduledKey struct{}
+
+// withScheduled returns a context that carries the time at which the request
+// made with it was meant to be sent.
+func withScheduled(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, scheduledKey{}, t)
+}
+
+// scheduledAt returns the time at which the request made with ctx was meant to
+// be sent, or sent if the request was not scheduled.
+func scheduledAt(ctx context.Context, sent time.Time) time.Time {
+	if t, ok := ctx.Value(scheduledKey{}).(time.Time); ok && t.Before(sent) {
+		return t
+	}
+	return sent
+}
+
+type stageKey struct{}
+
+// withStage returns a context that carries the load stage during which the
+// request made with it was scheduled.
+func withStage(ctx context.Context, stage string) context.Context {
+	return context.WithValue(ctx, stageKey{}, stage)
+}
+
+// stageOf returns the load stage of the request made with ctx, or an empty
+// string, which omits the stage label, if the run has no stages.
+func stageOf(ctx context.Context) string {
+	stage, _ := ctx.Value(stageKey{}).(string)
+	return stage
+}
+
+// latencyHistograms records the latency of requests twice. The raw histogram
+// measures from when a request was actually sent, and the corrected histogram
+// from when it was meant to be sent, so time spent waiting behind slow
+// requests is not omitted.
+type latencyHistograms struct {
+	raw       *prometheus.HistogramVec
+	corrected *prometheus.HistogramVec
+}
+
+// newLatencyHistograms registers the raw histogram under the name of opts,
+// and the corrected histogram with "_corrected" inserted before the unit.
+// Both have a stage label in addition to labelNames.
+func newLatencyHistograms(reg prometheus.Registerer, opts prometheus.HistogramOpts, labelNames []string) latencyHistograms {
+	labelNames = append(labelNames[:len(labelNames):len(labelNames)], "stage")
+	corrected := opts
+	corrected.Name = strings.TrimSuffix(opts.Name, "_seconds") + "_corrected_seconds"
+	corrected.Help = opts.Help + ", measured from when they were scheduled to be sent"
+	opts.Help += ", measured from when they were actually sent"
+
+	return latencyHistograms{
+		raw:       promauto.With(reg).NewHistogramVec(opts, labelNames),
+		corrected: promauto.With(reg).NewHistogramVec(corrected, labelNames),
+	}
+}
+
+// observe records the latency of a request made with ctx that was sent at
+// sent and took latency to complete.
+func (h latencyHistograms) observe(ctx context.Context, sent time.Time, latency time.Duration, labelValues ...string) {
+	labelValues = append(labelValues[:len(labelValues):len(labelValues)], stageOf(ctx))
+	waited := sent.Sub(scheduledAt(ctx, sent))
+	h.raw.WithLabelValues(labelValues...).Observe(latency.Seconds())
+	h.corrected.WithLabelValues(labelValues...).Observe((waited + latency).Seconds())
+}
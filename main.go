@@ -12,7 +12,10 @@ import (
 	"syscall"
 	"time"
 
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/debuginfo/v1alpha1/debuginfov1alpha1connect"
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/profilestore/v1alpha1/profilestorev1alpha1connect"
 	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/query/v1alpha1/queryv1alpha1connect"
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/scrape/v1alpha1/scrapev1alpha1connect"
 	"connectrpc.com/connect"
 	vault "github.com/hashicorp/vault/api"
 	auth "github.com/hashicorp/vault/api/auth/kubernetes"
@@ -28,6 +31,8 @@ const (
 )
 
 func main() {
+	configPath := flag.String("config", "", "Path to a YAML or JSON workload file. Replaces all flags except -addr and the limits.")
+	configReloadInterval := flag.Duration("config-reload-interval", 10*time.Second, "How often to check the workload file for changes. The file is always reloaded on SIGHUP. Set to 0 to disable.")
 	url := flag.String("url", "http://localhost:7070", "The URL for the Parca instance to query")
 	addr := flag.String("addr", "127.0.0.1:7171", "The address the HTTP server binds to")
 	token := flag.String("token", "", "A bearer token that can be send along each request")
@@ -43,23 +48,97 @@ func main() {
 	typesStr := flag.String("types", "", "Semicolon-separated profile types to query. If empty, types are auto-discovered from the backend.")
 	valuesForLabelsStr := flag.String("values-for-labels", "", "Semicolon-separated label names to query values for (e.g., 'job;namespace'). If empty, values queries are skipped.")
 
+	duration := flag.Duration("duration", 0, "Stop sending requests after this duration, print a summary and exit. 0 runs until terminated.")
+	rounds := flag.Int("rounds", 0, "Stop after each query kind ran this many rounds, print a summary and exit. Closed mode only. 0 runs until terminated.")
+	requests := flag.Int64("requests", 0, "Stop after sending this many requests in total, print a summary and exit. 0 runs until terminated.")
+	maxErrorRatio := flag.Float64("max-error-ratio", 1, "Exit with status 1 if the ratio of failed requests of a bounded run exceeds this")
+
 	flag.Parse()
 
 	ctx, stop := context.WithCancel(context.Background())
 	defer stop()
 
+	var cfg *Config
+	if *configPath != "" {
+		if conflicting := workloadFlagsSet(); len(conflicting) > 0 {
+			log.Fatalf("flags -%s cannot be combined with -config", strings.Join(conflicting, ", -"))
+		}
+
+		var err error
+		cfg, err = LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("load config %s: %v", *configPath, err)
+		}
+	} else {
+		queryRanges, err := parseTimeRanges(*queryRangeStr)
+		if err != nil {
+			log.Fatalf("parse time range string error: %v", err)
+		}
+
+		customHeaders, err := parseHeaders(*customHeadersStr)
+		if err != nil {
+			log.Fatalf("parse custom headers error: %v", err)
+		}
+
+		// Start from the config defaults so that settings without a flag
+		// behave the same as when they are omitted from a workload file.
+		cfg = defaultConfig()
+		cfg.Target = TargetConfig{
+			URL:     *url,
+			Timeout: Duration(*clientTimeout),
+			Headers: customHeaders,
+		}
+		cfg.Auth = AuthConfig{
+			Token: *token,
+			Vault: VaultConfig{
+				URL:       *vaultURL,
+				TokenPath: *vaultTokenPath,
+				Role:      *vaultRole,
+			},
+		}
+		cfg.Schedule.Interval = Duration(*queryInterval)
+		cfg.Queries.Values.Labels = parseValuesForLabels(*valuesForLabelsStr)
+		cfg.ProfileTypes = parseProfileTypes(*typesStr)
+		cfg.Ranges = queryRanges
+		cfg.Selectors = parseLabels(*labelsStr)
+	}
+
+	// The limits can be given as flags in addition to a workload file, so
+	// that the same scenario can be run as a benchmark.
+	limitFlags := func(cfg *Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "duration":
+				cfg.Limits.Duration = Duration(*duration)
+			case "rounds":
+				cfg.Limits.Rounds = *rounds
+			case "requests":
+				cfg.Limits.Requests = *requests
+			case "max-error-ratio":
+				cfg.Limits.MaxErrorRatio = *maxErrorRatio
+			}
+		})
+	}
+	limitFlags(cfg)
+	if problems := cfg.Limits.problems(); len(problems) > 0 {
+		log.Fatalf("invalid limits: %s", strings.Join(problems, "; "))
+	}
+	if cfg.Limits.Rounds > 0 && cfg.Schedule.Mode != scheduleModeClosed {
+		log.Fatal("-rounds requires closed mode")
+	}
+
 	// If a vault URL is given we'll try to get the token from Vault.
-	// If successful the contents are written in place of the token flag.
-	// Further down the token is retrieved from that flag's content.
-	if *vaultURL != "" {
+	// If successful the contents are written in place of the configured token.
+	// Further down the token is retrieved from the config.
+	if cfg.Auth.Vault.URL != "" {
 		config := vault.DefaultConfig()
-		config.Address = *vaultURL
+		config.Address = cfg.Auth.Vault.URL
 
 		client, err := vault.NewClient(config)
 		if err != nil {
 			log.Fatalf("unable to initialize Vault client: %v", err)
 		}
-		kubernetesAuth, err := auth.NewKubernetesAuth(*vaultRole)
+		kubernetesAuth, err := auth.NewKubernetesAuth(cfg.Auth.Vault.Role)
 		if err != nil {
 			log.Fatalf("unable to initialize Kubernetes auth method: %v", err)
 		}
@@ -72,7 +151,7 @@ func main() {
 		}
 
 		// get secret from Vault, from the default mount path for KV v2 in dev mode, "secret"
-		secret, err := client.KVv2("secret").Get(ctx, *vaultTokenPath)
+		secret, err := client.KVv2("secret").Get(ctx, cfg.Auth.Vault.TokenPath)
 		if err != nil {
 			log.Fatalf("unable to read secret: %v", err)
 		}
@@ -82,51 +161,51 @@ func main() {
 			log.Fatalf("value type assertion failed: %T %#v", secret.Data["token"], secret.Data["token"])
 		}
 
-		// Override the flag content with the token from Vault.
-		*token = tokenContent
-	}
-
-	queryRanges, err := parseTimeRanges(*queryRangeStr)
-	if err != nil {
-		log.Fatalf("parse time range string error: %v", err)
-	}
-
-	labelSelectors := parseLabels(*labelsStr)
-
-	profileTypes := parseProfileTypes(*typesStr)
-
-	valuesForLabels := parseValuesForLabels(*valuesForLabelsStr)
-
-	customHeaders, err := parseHeaders(*customHeadersStr)
-	if err != nil {
-		log.Fatalf("parse custom headers error: %v", err)
+		// Override the configured token with the token from Vault.
+		cfg.Auth.Token = tokenContent
 	}
 
 	clientOptions := []connect.ClientOption{
 		connect.WithGRPCWeb(),
 	}
-	if *token != "" {
-		clientOptions = append(clientOptions, connect.WithInterceptors(&bearerTokenInterceptor{token: *token}))
+	if cfg.Auth.Token != "" {
+		clientOptions = append(clientOptions, connect.WithInterceptors(&bearerTokenInterceptor{token: cfg.Auth.Token}))
 	}
-	if len(customHeaders) > 0 {
-		clientOptions = append(clientOptions, connect.WithInterceptors(&customHeadersInterceptor{headers: customHeaders}))
+	if len(cfg.Target.Headers) > 0 {
+		clientOptions = append(clientOptions, connect.WithInterceptors(&customHeadersInterceptor{headers: cfg.Target.Headers}))
 	}
 
-	client := queryv1alpha1connect.NewQueryServiceClient(
-		&http.Client{Timeout: *clientTimeout},
-		*url,
-		clientOptions...,
-	)
+	httpClient := &http.Client{Timeout: time.Duration(cfg.Target.Timeout)}
+	client := queryv1alpha1connect.NewQueryServiceClient(httpClient, cfg.Target.URL, clientOptions...)
+	scrapeClient := scrapev1alpha1connect.NewScrapeServiceClient(httpClient, cfg.Target.URL, clientOptions...)
+	agentsClient := profilestorev1alpha1connect.NewAgentsServiceClient(httpClient, cfg.Target.URL, clientOptions...)
 
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(collectors.NewGoCollector())
 	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 
-	querier := NewQuerier(reg, client, queryRanges, labelSelectors, profileTypes, valuesForLabels)
+	querier := NewQuerier(reg, client, scrapeClient, agentsClient, cfg)
 
 	var gr run.Group
 	gr.Add(run.SignalHandler(ctx, os.Interrupt, syscall.SIGTERM))
 
+	if *configPath != "" {
+		reloader, err := newConfigReloader(reg, *configPath, *configReloadInterval, querier, limitFlags)
+		if err != nil {
+			log.Fatalf("watch config %s: %v", *configPath, err)
+		}
+		reloadCtx, cancel := context.WithCancel(ctx)
+		gr.Add(
+			func() error {
+				reloader.Run(reloadCtx)
+				return nil
+			},
+			func(error) {
+				cancel()
+			},
+		)
+	}
+
 	httpServer := newHTTPServer(reg, *addr)
 	gr.Add(
 		func() error {
@@ -143,8 +222,7 @@ func main() {
 	)
 	gr.Add(
 		func() error {
-			querier.Run(ctx, *queryInterval)
-			return nil
+			return querier.Run(ctx)
 		},
 		func(error) {
 			log.Println("querier: stopping")
@@ -152,12 +230,53 @@ func main() {
 			log.Println("querier: stopped")
 		},
 	)
-
-	if err := gr.Run(); err != nil {
-		if _, ok := err.(run.SignalError); ok {
-			log.Println("terminated:", err)
-			return
+	if cfg.Write.Enabled {
+		writer, err := NewWriter(
+			reg,
+			profilestorev1alpha1connect.NewProfileStoreServiceClient(httpClient, cfg.Target.URL, clientOptions...),
+			cfg.Write,
+		)
+		if err != nil {
+			log.Fatalf("writer: %v", err)
 		}
+		gr.Add(
+			func() error {
+				return writer.Run(ctx)
+			},
+			func(error) {
+				log.Println("writer: stopping")
+				writer.Stop()
+				log.Println("writer: stopped")
+			},
+		)
+	}
+	if cfg.Debuginfo.Enabled {
+		uploader := NewUploader(
+			reg,
+			debuginfov1alpha1connect.NewDebuginfoServiceClient(httpClient, cfg.Target.URL, clientOptions...),
+			httpClient,
+			cfg.Debuginfo,
+		)
+		gr.Add(
+			func() error {
+				return uploader.Run(ctx)
+			},
+			func(error) {
+				log.Println("debuginfo: stopping")
+				uploader.Stop()
+				log.Println("debuginfo: stopped")
+			},
+		)
+	}
+
+	err := gr.Run()
+	if _, ok := err.(run.SignalError); ok {
+		log.Println("terminated:", err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := querier.Summary(os.Stdout); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -214,49 +333,62 @@ func (i *customHeadersInterceptor) WrapStreamingHandler(handler connect.Streamin
 	return handler
 }
 
-func parseTimeRanges(input string) ([]time.Duration, error) {
+// workloadFlagsSet returns the names of the explicitly set flags that
+// describe the workload and are therefore replaced by -config.
+func workloadFlagsSet() []string {
+	var names []string
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "config-reload-interval", "addr",
+			"duration", "rounds", "requests", "max-error-ratio":
+		default:
+			names = append(names, f.Name)
+		}
+	})
+	return names
+}
+
+func parseTimeRanges(input string) ([]Duration, error) {
 	parts := strings.Split(input, flagSeparator)
-	durations := make([]time.Duration, len(parts))
-	var err error
+	durations := make([]Duration, len(parts))
 
 	for i, part := range parts {
-		durations[i], err = time.ParseDuration(strings.TrimSpace(part))
+		d, err := time.ParseDuration(strings.TrimSpace(part))
 		if err != nil {
 			return nil, err
 		}
+		durations[i] = Duration(d)
 	}
 
 	return durations, nil
 }
 
-func parseLabels(input string) []string {
+// parseLabels returns the label selectors, or nil for no filtering.
+func parseLabels(input string) []Selector {
 	if input == "" || input == "all" {
-		return []string{"all"}
+		return nil
 	}
 	parts := strings.Split(input, flagSeparator)
-	selectors := make([]string, 0, len(parts))
+	selectors := make([]Selector, 0, len(parts))
 	for _, p := range parts {
 		p = strings.TrimSpace(p)
 		if p != "" {
-			selectors = append(selectors, p)
+			selectors = append(selectors, Selector(p))
 		}
 	}
-	if len(selectors) == 0 {
-		return []string{"all"}
-	}
 	return selectors
 }
 
-func parseProfileTypes(input string) []string {
+func parseProfileTypes(input string) []ProfileTypeString {
 	if input == "" {
 		return nil
 	}
 	parts := strings.Split(input, flagSeparator)
-	types := make([]string, 0, len(parts))
+	types := make([]ProfileTypeString, 0, len(parts))
 	for _, p := range parts {
 		p = strings.TrimSpace(p)
 		if p != "" {
-			types = append(types, p)
+			types = append(types, ProfileTypeString(p))
 		}
 	}
 	return types
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mixReportInterval is how often the achieved traffic mix is logged.
+const mixReportInterval = time.Minute
+
+// weighted picks items with a probability proportional to their weight.
+type weighted[T any] struct {
+	items      []T
+	cumulative []float64
+}
+
+// add adds the item unless its weight is not positive.
+func (w *weighted[T]) add(item T, weight float64) {
+	if weight <= 0 {
+		return
+	}
+	if n := len(w.cumulative); n > 0 {
+		weight += w.cumulative[n-1]
+	}
+	w.items = append(w.items, item)
+	w.cumulative = append(w.cumulative, weight)
+}
+
+func (w *weighted[T]) total() float64 {
+	if len(w.cumulative) == 0 {
+		return 0
+	}
+	return w.cumulative[len(w.cumulative)-1]
+}
+
+// ratio returns the probability of the item at index i to be picked.
+func (w *weighted[T]) ratio(i int) float64 {
+	weight := w.cumulative[i]
+	if i > 0 {
+		weight -= w.cumulative[i-1]
+	}
+	return weight / w.total()
+}
+
+func (w *weighted[T]) pick(rng *rand.Rand) (T, bool) {
+	if len(w.items) == 0 {
+		var zero T
+		return zero, false
+	}
+	x := rng.Float64() * w.total()
+	i := sort.Search(len(w.cumulative), func(i int) bool { return w.cumulative[i] > x })
+	return w.items[min(i, len(w.items)-1)], true
+}
+
+// mixedKind holds the requests of a query kind grouped by profile type.
+type mixedKind struct {
+	kind   queryKind
+	groups weighted[[]request]
+	// generation is the generation of the kind the requests were built at.
+	generation uint64
+}
+
+// trafficMix samples the requests of several query kinds according to the
+// configured weights of the kinds and of the profile types they query.
+type trafficMix struct {
+	conf  MixConfig
+	all   []queryKind
+	rng   *rand.Rand
+	kinds weighted[*mixedKind]
+	// built are the requests of every kind by its key, including the kinds
+	// that currently have none.
+	built map[string]*mixedKind
+	// workload is the workload the requests to sample from were built from.
+	workload *workload
+
+	mu sync.Mutex
+	// configured are the ratios of requests by kind and by profile type
+	// that follow from the weights.
+	configuredKinds map[string]float64
+	configuredTypes map[string]float64
+	sent            int
+	sentKinds       map[string]int
+	sentTypes       map[string]int
+}
+
+func newTrafficMix(conf MixConfig, kinds []queryKind) *trafficMix {
+	seed := conf.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	log.Printf("mix: sampling requests with seed %d\n", seed)
+
+	return &trafficMix{
+		conf:      conf,
+		all:       kinds,
+		rng:       rand.New(rand.NewPCG(seed, seed)),
+		built:     map[string]*mixedKind{},
+		sentKinds: map[string]int{},
+		sentTypes: map[string]int{},
+	}
+}
+
+// refresh rebuilds the requests to sample from. The requests of all kinds
+// are rebuilt if the workload changed since they were last built, and the
+// requests of dynamic kinds whenever the responses of other kinds they are
+// built from changed.
+func (m *trafficMix) refresh(w *workload) {
+	changed := w != m.workload
+	stale := map[string]bool{}
+	for _, kind := range m.all {
+		mk, ok := m.built[kind.key]
+		if !ok || changed || (kind.generation != nil && kind.generation() != mk.generation) {
+			stale[kind.key] = true
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	m.workload = w
+
+	m.kinds = weighted[*mixedKind]{}
+	for _, kind := range m.all {
+		if stale[kind.key] {
+			m.built[kind.key] = m.build(kind)
+		}
+		mk := m.built[kind.key]
+		// Kinds without any requests, such as values without labels, are
+		// left out so they don't take a share of the rate.
+		if len(mk.groups.items) > 0 {
+			m.kinds.add(mk, m.conf.kindWeight(kind.key))
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configuredKinds = map[string]float64{}
+	m.configuredTypes = map[string]float64{}
+	for i, mk := range m.kinds.items {
+		kindRatio := m.kinds.ratio(i)
+		m.configuredKinds[mk.kind.key] = kindRatio
+		for j, group := range mk.groups.items {
+			m.configuredTypes[group[0].profileType] += kindRatio * mk.groups.ratio(j)
+		}
+	}
+}
+
+// build groups the current requests of the kind by profile type.
+func (m *trafficMix) build(kind queryKind) *mixedKind {
+	mk := &mixedKind{kind: kind}
+	// The generation is taken before the requests are built, so that
+	// responses stored in between cause another rebuild.
+	if kind.generation != nil {
+		mk.generation = kind.generation()
+	}
+
+	byType := map[string][]request{}
+	for _, r := range kind.requests() {
+		byType[r.profileType] = append(byType[r.profileType], r)
+	}
+
+	for _, pt := range slices.Sorted(maps.Keys(byType)) {
+		mk.groups.add(byType[pt], m.conf.profileTypeWeight(pt))
+	}
+	return mk
+}
+
+// sample picks a kind, then a profile type of that kind and then one of the
+// requests for that profile type at random.
+func (m *trafficMix) sample() (queryKind, request, bool) {
+	mk, ok := m.kinds.pick(m.rng)
+	if !ok {
+		return queryKind{}, request{}, false
+	}
+	group, _ := mk.groups.pick(m.rng)
+	return mk.kind, group[m.rng.IntN(len(group))], true
+}
+
+// record counts a request that was sent towards the achieved mix.
+func (m *trafficMix) record(kind queryKind, r request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent++
+	m.sentKinds[kind.key]++
+	m.sentTypes[r.profileType]++
+}
+
+// report returns the achieved ratio next to the configured ratio of every
+// kind and profile type.
+func (m *trafficMix) report() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d requests sent; kinds:", m.sent)
+	for _, key := range slices.Sorted(maps.Keys(m.configuredKinds)) {
+		fmt.Fprintf(&b, " %s=%.1f%% (configured %.1f%%)", key, m.achieved(m.sentKinds[key]), 100*m.configuredKinds[key])
+	}
+	b.WriteString("; profile types:")
+	for _, pt := range slices.Sorted(maps.Keys(m.configuredTypes)) {
+		name := pt
+		if name == "" {
+			name = "none"
+		}
+		fmt.Fprintf(&b, " %s=%.1f%% (configured %.1f%%)", name, m.achieved(m.sentTypes[pt]), 100*m.configuredTypes[pt])
+	}
+	return b.String()
+}
+
+func (m *trafficMix) achieved(n int) float64 {
+	if m.sent == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(m.sent)
+}
+
+// reportMix logs the achieved mix periodically and once more when the
+// context is cancelled, and keeps the mix metrics up to date.
+func (q *Querier) reportMix(ctx context.Context, m *trafficMix) {
+	ticker := time.NewTicker(mixReportInterval)
+	defer ticker.Stop()
+
+	update := func() {
+		m.mu.Lock()
+		for key, ratio := range m.configuredKinds {
+			q.metrics.mixConfiguredGauge.WithLabelValues(key).Set(ratio)
+			q.metrics.mixAchievedGauge.WithLabelValues(key).Set(m.achieved(m.sentKinds[key]) / 100)
+		}
+		m.mu.Unlock()
+		log.Printf("mix: %s\n", m.report())
+	}
+	update()
+
+	for {
+		select {
+		case <-ctx.Done():
+			update()
+			return
+		case <-ticker.C:
+			update()
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestWeightedPick(t *testing.T) {
+	var w weighted[string]
+	w.add("a", 1)
+	w.add("skipped", 0)
+	w.add("b", 3)
+
+	if got := w.total(); got != 4 {
+		t.Fatalf("total() = %v, want 4", got)
+	}
+	if got := w.ratio(1); got != 0.75 {
+		t.Errorf("ratio(1) = %v, want 0.75", got)
+	}
+
+	rng := rand.New(rand.NewPCG(1, 1))
+	counts := map[string]int{}
+	const n = 10000
+	for i := 0; i < n; i++ {
+		item, ok := w.pick(rng)
+		if !ok {
+			t.Fatal("pick() found no item")
+		}
+		counts[item]++
+	}
+	if counts["skipped"] != 0 {
+		t.Errorf("picked an item of weight 0 %d times", counts["skipped"])
+	}
+	if got := float64(counts["b"]) / n; math.Abs(got-0.75) > 0.02 {
+		t.Errorf("picked b in %.3f of the cases, want 0.75", got)
+	}
+
+	var empty weighted[string]
+	if _, ok := empty.pick(rng); ok {
+		t.Error("pick() on an empty set found an item")
+	}
+}
+
+// mixKind returns a kind with one request per profile type.
+func mixKind(key string, generation func() uint64, profileTypes ...string) (queryKind, *int) {
+	var builds int
+	return queryKind{
+		name:       key,
+		key:        key,
+		generation: generation,
+		requests: func() []request {
+			builds++
+			rs := make([]request, len(profileTypes))
+			for i, pt := range profileTypes {
+				rs[i] = request{profileType: pt}
+			}
+			return rs
+		},
+	}, &builds
+}
+
+func TestTrafficMixSample(t *testing.T) {
+	merge, _ := mixKind("merge", nil, "cpu:samples", "memory:inuse_space")
+	labels, _ := mixKind("labels", nil, "")
+	values, _ := mixKind("values", nil)
+	m := newTrafficMix(MixConfig{
+		Seed:         1,
+		Kinds:        map[string]float64{"merge": 3, "labels": 1, "values": 1},
+		ProfileTypes: map[string]float64{"cpu": 4},
+	}, []queryKind{merge, labels, values})
+	m.refresh(&workload{})
+
+	// values has no requests, so it doesn't take a share of the rate.
+	wantKinds := map[string]float64{"merge": 0.75, "labels": 0.25}
+	wantTypes := map[string]float64{"cpu:samples": 0.6, "memory:inuse_space": 0.15, "": 0.25}
+	for key, want := range wantKinds {
+		if got := m.configuredKinds[key]; math.Abs(got-want) > 1e-9 {
+			t.Errorf("configured ratio of %s = %v, want %v", key, got, want)
+		}
+	}
+	for pt, want := range wantTypes {
+		if got := m.configuredTypes[pt]; math.Abs(got-want) > 1e-9 {
+			t.Errorf("configured ratio of %q = %v, want %v", pt, got, want)
+		}
+	}
+
+	const n = 20000
+	for i := 0; i < n; i++ {
+		kind, r, ok := m.sample()
+		if !ok {
+			t.Fatal("sample() found no request")
+		}
+		m.record(kind, r)
+	}
+	for key, want := range wantKinds {
+		if got := float64(m.sentKinds[key]) / n; math.Abs(got-want) > 0.02 {
+			t.Errorf("achieved ratio of %s = %.3f, want %v", key, got, want)
+		}
+	}
+	for pt, want := range wantTypes {
+		if got := float64(m.sentTypes[pt]) / n; math.Abs(got-want) > 0.02 {
+			t.Errorf("achieved ratio of %q = %.3f, want %v", pt, got, want)
+		}
+	}
+}
+
+func TestTrafficMixRefresh(t *testing.T) {
+	merge, builds := mixKind("merge", nil, "cpu:samples")
+	m := newTrafficMix(MixConfig{Seed: 1}, []queryKind{merge})
+
+	w := &workload{}
+	m.refresh(w)
+	m.refresh(w)
+	if *builds != 1 {
+		t.Errorf("built requests %d times for the same workload, want 1", *builds)
+	}
+
+	m.refresh(&workload{})
+	if *builds != 2 {
+		t.Errorf("built requests %d times after the workload changed, want 2", *builds)
+	}
+}
+
+func TestTrafficMixRefreshDynamic(t *testing.T) {
+	var generation uint64
+	single, builds := mixKind("single", func() uint64 { return generation }, "cpu:samples")
+	merge, mergeBuilds := mixKind("merge", nil, "cpu:samples")
+	m := newTrafficMix(MixConfig{Seed: 1}, []queryKind{single, merge})
+
+	w := &workload{}
+	m.refresh(w)
+	m.refresh(w)
+	if *builds != 1 {
+		t.Errorf("built dynamic requests %d times without new responses, want 1", *builds)
+	}
+
+	generation++
+	m.refresh(w)
+	if *builds != 2 {
+		t.Errorf("built dynamic requests %d times after new responses, want 2", *builds)
+	}
+	if *mergeBuilds != 1 {
+		t.Errorf("rebuilt the requests of a kind that isn't dynamic %d times", *mergeBuilds-1)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// learnRetry is how long to wait before learning the names of a profile type
+// again after a response had none, such as the function names of binaries
+// without symbols.
+const learnRetry = time.Minute
+
+// knownNames holds names learned from earlier responses by profile type, such
+// as function or label names, or source files, to sample requests from.
+type knownNames[T any] struct {
+	mu    sync.Mutex
+	names map[string][]T
+	// stored is when names of the profile type were last stored, even if
+	// there were none.
+	stored map[string]time.Time
+}
+
+// known reports whether any names of the profile type are known.
+func (k *knownNames[T]) known(profileType string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.names[profileType]) > 0
+}
+
+// generation returns the number of profile types with known names. As names
+// are never forgotten, it changes whenever names of another profile type
+// become known.
+func (k *knownNames[T]) generation() uint64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return uint64(len(k.names))
+}
+
+// store replaces the names of the profile type, unless there are none.
+func (k *knownNames[T]) store(profileType string, names []T) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.names == nil {
+		k.names = map[string][]T{}
+		k.stored = map[string]time.Time{}
+	}
+	k.stored[profileType] = time.Now()
+	if len(names) > 0 {
+		k.names[profileType] = names
+	}
+}
+
+// shouldLearn reports whether no names of the profile type are known and
+// none were stored within learnRetry, so that they are worth requesting.
+func (k *knownNames[T]) shouldLearn(profileType string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.names[profileType]) > 0 {
+		return false
+	}
+	stored, ok := k.stored[profileType]
+	return !ok || time.Since(stored) >= learnRetry
+}
+
+// sample returns up to n distinct names of the profile type.
+func (k *knownNames[T]) sample(profileType string, n int) []T {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	names := k.names[profileType]
+	sampled := make([]T, 0, min(n, len(names)))
+	for _, i := range rand.Perm(len(names))[:min(n, len(names))] {
+		sampled = append(sampled, names[i])
+	}
+	return sampled
+}
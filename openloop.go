@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// requestCycle hands out the requests of a query kind in order and starts
+// over with a fresh round once all of them were handed out.
+type requestCycle struct {
+	kind    queryKind
+	pending []request
+}
+
+// next returns the next request of the kind, or false if the kind currently
+// has no requests to make.
+func (c *requestCycle) next() (request, bool) {
+	if len(c.pending) == 0 {
+		c.pending = c.kind.requests()
+		if len(c.pending) == 0 {
+			return request{}, false
+		}
+	}
+	r := c.pending[0]
+	c.pending = c.pending[1:]
+	return r, true
+}
+
+// runOpenLoop issues requests at the configured rates until issue is
+// cancelled, independently of how long earlier requests take. Kinds with
+// their own rate get a dedicated stream of requests and all other kinds
+// share schedule.rate, either taking turns or sampled from the traffic mix.
+func (q *Querier) runOpenLoop(ctx, issue context.Context, kinds []queryKind) {
+	inflight := make(chan struct{}, q.schedule.MaxInFlight)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// All open-loop requests are labelled with the stage they were scheduled
+	// in, including those of kinds with their own rate.
+	var shape *loadShape
+	if len(q.schedule.Stages) > 0 {
+		shape = newLoadShape(q.schedule.Stages, time.Now())
+	}
+	scheduledCtx := func(scheduled time.Time) context.Context {
+		return withStage(withScheduled(ctx, scheduled), shape.stage(scheduled))
+	}
+
+	var shared []*requestCycle
+	for _, kind := range kinds {
+		cycle := &requestCycle{kind: kind}
+		if kind.conf.Rate == 0 {
+			shared = append(shared, cycle)
+			continue
+		}
+		log.Printf("%s: sending %g requests per second\n", kind.name, kind.conf.Rate)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pace(issue, constantRate(kind.conf.Rate), newArrivals(q.arrival(kind), kind.name), func(scheduled time.Time) {
+				if r, ok := cycle.next(); ok {
+					q.dispatch(scheduledCtx(scheduled), &wg, inflight, kind, r)
+				}
+			})
+		}()
+	}
+
+	sharedRate := constantRate(q.schedule.Rate)
+	if shape != nil {
+		sharedRate = q.stagedRate(shape)
+	} else if q.schedule.Rate > 0 {
+		log.Printf("sending %g requests per second shared by %d query kinds\n", q.schedule.Rate, len(shared))
+		q.metrics.targetRateGauge.Set(q.schedule.Rate)
+	}
+
+	if len(shared) == 0 || (q.schedule.Rate == 0 && len(q.schedule.Stages) == 0) {
+		<-issue.Done()
+		return
+	}
+
+	arrivals := newArrivals(q.schedule.Arrival, "shared")
+	if q.mix.enabled() {
+		kinds := make([]queryKind, len(shared))
+		for i, cycle := range shared {
+			kinds[i] = cycle.kind
+		}
+		mix := newTrafficMix(q.mix, kinds)
+		mix.refresh(q.workload.Load())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.reportMix(issue, mix)
+		}()
+		pace(issue, sharedRate, arrivals, func(scheduled time.Time) {
+			mix.refresh(q.workload.Load())
+			kind, r, ok := mix.sample()
+			if ok && q.dispatch(scheduledCtx(scheduled), &wg, inflight, kind, r) {
+				mix.record(kind, r)
+			}
+		})
+		return
+	}
+
+	var turn int
+	pace(issue, sharedRate, arrivals, func(scheduled time.Time) {
+		// Skip kinds that currently have nothing to send, such as values
+		// without any configured labels.
+		for range shared {
+			cycle := shared[turn%len(shared)]
+			turn++
+			if r, ok := cycle.next(); ok {
+				q.dispatch(scheduledCtx(scheduled), &wg, inflight, cycle.kind, r)
+				return
+			}
+		}
+	})
+}
+
+// idleRecheck is how often a paced stream whose rate is zero checks whether
+// its rate went up again.
+const idleRecheck = 100 * time.Millisecond
+
+func constantRate(rate float64) func(time.Time) float64 {
+	return func(time.Time) float64 { return rate }
+}
+
+// stagedRate returns the rate of the load shape and keeps the stage metrics
+// up to date as the stages progress.
+func (q *Querier) stagedRate(shape *loadShape) func(time.Time) float64 {
+	current := -1
+	return func(now time.Time) float64 {
+		rate, i := shape.at(now)
+		if i != current {
+			if current >= 0 {
+				q.metrics.stageGauge.WithLabelValues(stageName(shape.stages, current)).Set(0)
+			}
+			current = i
+			name := stageName(shape.stages, current)
+			q.metrics.stageGauge.WithLabelValues(name).Set(1)
+			log.Printf("stage %s: started\n", name)
+		}
+		q.metrics.targetRateGauge.Set(rate)
+		return rate
+	}
+}
+
+// pace calls fn at the rate per second returned by rate until the context is
+// cancelled, spacing the calls by the arrival process. Calls are scheduled at
+// fixed points in time, so if fn or the scheduler falls behind, the missed
+// calls are made immediately to keep the average rate. fn is passed the time
+// its call was scheduled at.
+//
+// The rate is integrated over time in steps of at most idleRecheck, so a rate
+// that changes between two calls, like a ramp starting at zero, takes effect
+// within one step instead of after the gap of the rate at the previous call.
+func pace(ctx context.Context, rate func(time.Time) float64, arrivals *arrivals, fn func(scheduled time.Time)) {
+	// The arrival process spaces the calls in units of one call per second,
+	// so need is how many calls worth of rate are left until the next one.
+	// The first call is made right away.
+	var need float64
+	// The rate was integrated up to reached.
+	reached := time.Now()
+
+	timer := time.NewTimer(idleRecheck)
+	defer timer.Stop()
+
+	for {
+		r := rate(reached)
+		step, call := idleRecheck, false
+		if r > 0 && need <= r*idleRecheck.Seconds() {
+			step, call = time.Duration(need/r*float64(time.Second)), true
+		}
+
+		due := reached.Add(step)
+		if wait := time.Until(due); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		reached = due
+		if call {
+			fn(due)
+			need = arrivals.next(time.Second).Seconds()
+		} else {
+			need -= r * step.Seconds()
+		}
+	}
+}
+
+// dispatch sends the request in the background unless the in-flight limit
+// is reached, in which case the request is dropped, or the request limit is
+// used up. Dropped requests don't count towards the request limit. It returns
+// whether the request was sent.
+func (q *Querier) dispatch(ctx context.Context, wg *sync.WaitGroup, inflight chan struct{}, kind queryKind, r request) bool {
+	select {
+	case inflight <- struct{}{}:
+	default:
+		q.metrics.droppedCounter.WithLabelValues(kind.name).Inc()
+		return false
+	}
+	if !q.take() {
+		<-inflight
+		return false
+	}
+
+	q.metrics.inflightGauge.Inc()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			q.metrics.inflightGauge.Dec()
+			<-inflight
+		}()
+		_ = q.do(ctx, kind, r)
+	}()
+	return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPaceRamp(t *testing.T) {
+	// A ramp from 0 to 100 requests per second over 10s sends 5 requests in
+	// its first second. Spacing the calls by the rate at the previous call
+	// would only send one, as the rate is tiny when it is first seen.
+	start := time.Now()
+	shape := newLoadShape([]StageConfig{{Type: stageTypeRamp, Duration: Duration(10 * time.Second), From: 0, To: 100}}, start)
+	rate := func(now time.Time) float64 {
+		r, _ := shape.at(now)
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var calls int
+	var last time.Time
+	pace(ctx, rate, newArrivals(ArrivalConfig{Process: arrivalFixed}, "test"), func(scheduled time.Time) {
+		if scheduled.Before(last) {
+			t.Errorf("call scheduled at %v before the previous one at %v", scheduled, last)
+		}
+		last = scheduled
+		calls++
+	})
+	if calls < 3 || calls > 6 {
+		t.Errorf("pace made %d calls in the first second of the ramp, want about 5", calls)
+	}
+}
+
+func TestPaceConstant(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var calls int
+	pace(ctx, constantRate(100), newArrivals(ArrivalConfig{Process: arrivalFixed}, "test"), func(time.Time) {
+		calls++
+	})
+	if calls < 40 || calls > 55 {
+		t.Errorf("pace made %d calls in 500ms at 100/s, want about 50", calls)
+	}
+}
+
+func TestPaceZeroRate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	var calls int
+	pace(ctx, constantRate(0), newArrivals(ArrivalConfig{Process: arrivalFixed}, "test"), func(time.Time) {
+		calls++
+	})
+	if calls != 0 {
+		t.Errorf("pace made %d calls at a rate of zero", calls)
+	}
+}
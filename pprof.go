@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the pprof profile.proto messages.
+const (
+	pprofProfileSampleType    = 1
+	pprofProfileSample        = 2
+	pprofProfileMapping       = 3
+	pprofProfileLocation      = 4
+	pprofProfileFunction      = 5
+	pprofProfileStringTable   = 6
+	pprofProfileTimeNanos     = 9
+	pprofProfileDurationNanos = 10
+	pprofProfilePeriodType    = 11
+	pprofProfilePeriod        = 12
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationID = 1
+	pprofSampleValue      = 2
+
+	pprofMappingID           = 1
+	pprofMappingMemoryStart  = 2
+	pprofMappingMemoryLimit  = 3
+	pprofMappingFilename     = 5
+	pprofMappingBuildID      = 6
+	pprofMappingHasFunctions = 7
+
+	pprofLocationID        = 1
+	pprofLocationMappingID = 2
+	pprofLocationAddress   = 3
+	pprofLocationLine      = 4
+
+	pprofLineFunctionID = 1
+	pprofLineLine       = 2
+
+	pprofFunctionID       = 1
+	pprofFunctionName     = 2
+	pprofFunctionFilename = 4
+)
+
+const (
+	// syntheticPeriod is the sampling period of the generated profiles, as
+	// Parca Agent samples CPUs 19 times per second.
+	syntheticPeriod = int64(time.Second / 19)
+	// syntheticMappingSize is the address space of each generated mapping.
+	syntheticMappingSize = 1 << 24
+)
+
+// profileGenerator generates gzipped pprof CPU profiles. The functions,
+// locations and mappings are the same in every profile, only the samples
+// differ, so the profiles look like they were taken of the same binaries.
+type profileGenerator struct {
+	conf SyntheticProfileConfig
+	// static is the encoded part of the profile that never changes.
+	static []byte
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	zipf *rand.Zipf
+}
+
+func newProfileGenerator(conf SyntheticProfileConfig) *profileGenerator {
+	seed := conf.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	log.Printf("write: synthetic profiles with seed %d\n", seed)
+
+	rng := rand.New(rand.NewPCG(seed, 0))
+	return &profileGenerator{
+		conf:   conf,
+		static: encodeStaticProfile(conf),
+		rng:    rng,
+		// Like in real programs, a few functions appear in most stacks.
+		zipf: rand.NewZipf(rng, 1.1, 1, uint64(conf.Functions-1)),
+	}
+}
+
+// syntheticMapping is mapping m of the synthetic profiles.
+type syntheticMapping struct {
+	start, limit uint64
+	file         string
+	buildID      string
+}
+
+func newSyntheticMapping(m int) syntheticMapping {
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "parca-load-%d", m)
+	return syntheticMapping{
+		start:   uint64(m+1) * syntheticMappingSize,
+		limit:   uint64(m+2) * syntheticMappingSize,
+		file:    fmt.Sprintf("/usr/bin/synthetic-%d", m),
+		buildID: fmt.Sprintf("%016x", h.Sum64()),
+	}
+}
+
+// syntheticFunction is function f of the synthetic profiles, which is the
+// only function of its location.
+type syntheticFunction struct {
+	name     string
+	filename string
+	line     int64
+	// mapping is the index of the mapping of its location.
+	mapping int
+	address uint64
+}
+
+func newSyntheticFunction(conf SyntheticProfileConfig, f int) syntheticFunction {
+	m := f % conf.Mappings
+	return syntheticFunction{
+		name:     fmt.Sprintf("synthetic.function%d", f),
+		filename: fmt.Sprintf("synthetic/file%d.go", f/10),
+		line:     int64(f%10*10 + 1),
+		mapping:  m,
+		address:  uint64(m+1)*syntheticMappingSize + uint64(f/conf.Mappings)*16,
+	}
+}
+
+// encodeStaticProfile encodes the string table, sample and period types,
+// mappings, functions and locations. Function i is at location i+1 and in
+// mapping i%mappings+1.
+func encodeStaticProfile(conf SyntheticProfileConfig) []byte {
+	var strs []string
+	str := func(s string) uint64 {
+		strs = append(strs, s)
+		return uint64(len(strs) - 1)
+	}
+	str("")
+
+	var b []byte
+	valueType := func(field protowire.Number, typ, unit string) {
+		var vt []byte
+		vt = appendVarintField(vt, pprofValueTypeType, str(typ))
+		vt = appendVarintField(vt, pprofValueTypeUnit, str(unit))
+		b = protowire.AppendTag(b, field, protowire.BytesType)
+		b = protowire.AppendBytes(b, vt)
+	}
+	valueType(pprofProfileSampleType, "samples", "count")
+	valueType(pprofProfilePeriodType, "cpu", "nanoseconds")
+	b = appendVarintField(b, pprofProfilePeriod, uint64(syntheticPeriod))
+
+	for m := range conf.Mappings {
+		sm := newSyntheticMapping(m)
+
+		var mapping []byte
+		mapping = appendVarintField(mapping, pprofMappingID, uint64(m+1))
+		mapping = appendVarintField(mapping, pprofMappingMemoryStart, sm.start)
+		mapping = appendVarintField(mapping, pprofMappingMemoryLimit, sm.limit)
+		mapping = appendVarintField(mapping, pprofMappingFilename, str(sm.file))
+		mapping = appendVarintField(mapping, pprofMappingBuildID, str(sm.buildID))
+		mapping = appendVarintField(mapping, pprofMappingHasFunctions, 1)
+		b = protowire.AppendTag(b, pprofProfileMapping, protowire.BytesType)
+		b = protowire.AppendBytes(b, mapping)
+	}
+
+	for f := range conf.Functions {
+		id := uint64(f + 1)
+		sf := newSyntheticFunction(conf, f)
+
+		var function []byte
+		function = appendVarintField(function, pprofFunctionID, id)
+		function = appendVarintField(function, pprofFunctionName, str(sf.name))
+		function = appendVarintField(function, pprofFunctionFilename, str(sf.filename))
+		b = protowire.AppendTag(b, pprofProfileFunction, protowire.BytesType)
+		b = protowire.AppendBytes(b, function)
+
+		var line []byte
+		line = appendVarintField(line, pprofLineFunctionID, id)
+		line = appendVarintField(line, pprofLineLine, uint64(sf.line))
+
+		var location []byte
+		location = appendVarintField(location, pprofLocationID, id)
+		location = appendVarintField(location, pprofLocationMappingID, uint64(sf.mapping+1))
+		location = appendVarintField(location, pprofLocationAddress, sf.address)
+		location = protowire.AppendTag(location, pprofLocationLine, protowire.BytesType)
+		location = protowire.AppendBytes(location, line)
+		b = protowire.AppendTag(b, pprofProfileLocation, protowire.BytesType)
+		b = protowire.AppendBytes(b, location)
+	}
+
+	for _, s := range strs {
+		b = protowire.AppendTag(b, pprofProfileStringTable, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	return b
+}
+
+// syntheticSample is a sample of the synthetic profiles.
+type syntheticSample struct {
+	// functions are the indices of the functions of the stack, leaf first.
+	functions []int
+	value     int64
+}
+
+// samples returns the samples of a profile.
+func (g *profileGenerator) samples() []syntheticSample {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	samples := make([]syntheticSample, g.conf.Samples)
+	for i := range samples {
+		for range g.rng.IntN(g.conf.StackDepth) + 1 {
+			samples[i].functions = append(samples[i].functions, int(g.zipf.Uint64()))
+		}
+		samples[i].value = int64(g.rng.IntN(10) + 1)
+	}
+	return samples
+}
+
+// generate returns a gzipped profile of duration that ends at end.
+func (g *profileGenerator) generate(end time.Time, duration time.Duration) ([]byte, error) {
+	b := append([]byte(nil), g.static...)
+	b = appendVarintField(b, pprofProfileTimeNanos, uint64(end.Add(-duration).UnixNano()))
+	b = appendVarintField(b, pprofProfileDurationNanos, uint64(duration))
+
+	for _, sample := range g.samples() {
+		var locations []byte
+		for _, f := range sample.functions {
+			locations = protowire.AppendVarint(locations, uint64(f)+1)
+		}
+		var values []byte
+		values = protowire.AppendVarint(values, uint64(sample.value))
+
+		var encoded []byte
+		encoded = protowire.AppendTag(encoded, pprofSampleLocationID, protowire.BytesType)
+		encoded = protowire.AppendBytes(encoded, locations)
+		encoded = protowire.AppendTag(encoded, pprofSampleValue, protowire.BytesType)
+		encoded = protowire.AppendBytes(encoded, values)
+		b = protowire.AppendTag(b, pprofProfileSample, protowire.BytesType)
+		b = protowire.AppendBytes(b, encoded)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func appendVarintField(b []byte, field protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, field, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is a decoded field of a protobuf message.
+type protoField struct {
+	num   protowire.Number
+	value uint64
+	bytes []byte
+}
+
+func decodeFields(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := protoField{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", typ, num)
+		}
+		if n < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func decodePackedVarints(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var vs []uint64
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			t.Fatalf("invalid packed varint: %v", protowire.ParseError(n))
+		}
+		vs = append(vs, v)
+		b = b[n:]
+	}
+	return vs
+}
+
+func gunzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestProfileGenerator(t *testing.T) {
+	conf := SyntheticProfileConfig{Functions: 50, Mappings: 3, StackDepth: 8, Samples: 200, Seed: 1}
+	end := time.Unix(1700000000, 0)
+	gz, err := newProfileGenerator(conf).generate(end, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		strs                                    []string
+		samples, mappings, locations, functions int
+		timeNanos, durationNanos, period        uint64
+		sampleTypes                             int
+		locationMappings                        = map[uint64]uint64{}
+		functionNames                           = map[uint64]uint64{}
+		locationFunctions                       = map[uint64]uint64{}
+	)
+	for _, f := range decodeFields(t, gunzip(t, gz)) {
+		switch f.num {
+		case pprofProfileSampleType:
+			sampleTypes++
+		case pprofProfileSample:
+			samples++
+			for _, sf := range decodeFields(t, f.bytes) {
+				switch sf.num {
+				case pprofSampleLocationID:
+					ids := decodePackedVarints(t, sf.bytes)
+					if len(ids) < 1 || len(ids) > conf.StackDepth {
+						t.Errorf("sample has %d locations, want 1 to %d", len(ids), conf.StackDepth)
+					}
+					for _, id := range ids {
+						if id < 1 || id > uint64(conf.Functions) {
+							t.Errorf("sample references location %d, want 1 to %d", id, conf.Functions)
+						}
+					}
+				case pprofSampleValue:
+					if values := decodePackedVarints(t, sf.bytes); len(values) != sampleTypes || values[0] == 0 {
+						t.Errorf("sample values = %v, want one positive value per sample type", values)
+					}
+				}
+			}
+		case pprofProfileMapping:
+			mappings++
+		case pprofProfileLocation:
+			locations++
+			var id uint64
+			for _, lf := range decodeFields(t, f.bytes) {
+				switch lf.num {
+				case pprofLocationID:
+					id = lf.value
+				case pprofLocationMappingID:
+					locationMappings[id] = lf.value
+				case pprofLocationLine:
+					for _, line := range decodeFields(t, lf.bytes) {
+						if line.num == pprofLineFunctionID {
+							locationFunctions[id] = line.value
+						}
+					}
+				}
+			}
+		case pprofProfileFunction:
+			functions++
+			var id uint64
+			for _, ff := range decodeFields(t, f.bytes) {
+				switch ff.num {
+				case pprofFunctionID:
+					id = ff.value
+				case pprofFunctionName:
+					functionNames[id] = ff.value
+				}
+			}
+		case pprofProfileStringTable:
+			strs = append(strs, string(f.bytes))
+		case pprofProfileTimeNanos:
+			timeNanos = f.value
+		case pprofProfileDurationNanos:
+			durationNanos = f.value
+		case pprofProfilePeriod:
+			period = f.value
+		}
+	}
+
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatal("string table doesn't start with the empty string")
+	}
+	if sampleTypes != 1 || samples != conf.Samples || mappings != conf.Mappings || locations != conf.Functions || functions != conf.Functions {
+		t.Errorf(
+			"got %d sample types, %d samples, %d mappings, %d locations and %d functions, want 1, %d, %d, %d and %d",
+			sampleTypes, samples, mappings, locations, functions, conf.Samples, conf.Mappings, conf.Functions, conf.Functions,
+		)
+	}
+	for id, mapping := range locationMappings {
+		if mapping < 1 || mapping > uint64(conf.Mappings) {
+			t.Errorf("location %d is in mapping %d, want 1 to %d", id, mapping, conf.Mappings)
+		}
+	}
+	for id, function := range locationFunctions {
+		name, ok := functionNames[function]
+		if !ok || name >= uint64(len(strs)) || strs[name] == "" {
+			t.Errorf("location %d references function %d without a name", id, function)
+		}
+	}
+	if want := uint64(end.Add(-10 * time.Second).UnixNano()); timeNanos != want {
+		t.Errorf("time_nanos = %d, want %d", timeNanos, want)
+	}
+	if durationNanos != uint64(10*time.Second) {
+		t.Errorf("duration_nanos = %d, want %d", durationNanos, uint64(10*time.Second))
+	}
+	if period != uint64(syntheticPeriod) {
+		t.Errorf("period = %d, want %d", period, syntheticPeriod)
+	}
+}
+
+func TestProfileGeneratorSeed(t *testing.T) {
+	conf := SyntheticProfileConfig{Functions: 20, Mappings: 2, StackDepth: 4, Samples: 50, Seed: 7}
+	end := time.Unix(1700000000, 0)
+	generate := func(conf SyntheticProfileConfig) []byte {
+		gz, err := newProfileGenerator(conf).generate(end, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gunzip(t, gz)
+	}
+
+	if !bytes.Equal(generate(conf), generate(conf)) {
+		t.Error("profiles generated with the same seed differ")
+	}
+	other := conf
+	other.Seed = 8
+	if bytes.Equal(generate(conf), generate(other)) {
+		t.Error("profiles generated with different seeds are the same")
+	}
+}
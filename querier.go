@@ -2,28 +2,29 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
-	"golang.org/x/sync/errgroup"
-	"google.golang.org/protobuf/types/known/durationpb"
 
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/profilestore/v1alpha1/profilestorev1alpha1connect"
 	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/query/v1alpha1/queryv1alpha1connect"
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/scrape/v1alpha1/scrapev1alpha1connect"
 	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
 	"connectrpc.com/connect"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-const numHorizontalPixelsOn8KDisplay = 7680
-
-// Trim anything that can't be displayed by an 8K display (7680 horizontal
-// pixels). This is a var because the proto request requires an address.
-var nodeTrimThreshold = float32(1) / numHorizontalPixelsOn8KDisplay
-
 // profileTypeToString converts a ProfileType proto to its string representation.
 func profileTypeToString(pt *queryv1alpha1.ProfileType) string {
 	s := fmt.Sprintf("%s:%s:%s:%s:%s", pt.Name, pt.SampleType, pt.SampleUnit, pt.PeriodType, pt.PeriodUnit)
@@ -34,16 +35,31 @@ func profileTypeToString(pt *queryv1alpha1.ProfileType) string {
 }
 
 type querierMetrics struct {
-	labelsHistogram       *prometheus.HistogramVec
-	valuesHistogram       *prometheus.HistogramVec
-	profileTypesHistogram *prometheus.HistogramVec
-	rangeHistogram        *prometheus.HistogramVec
-	mergeHistogram        *prometheus.HistogramVec
+	labelsHistogram       latencyHistograms
+	valuesHistogram       latencyHistograms
+	profileTypesHistogram latencyHistograms
+	rangeHistogram        latencyHistograms
+	rangeSeriesHistogram  *prometheus.HistogramVec
+	queryHistogram        latencyHistograms
+	queryBytesHistogram   *prometheus.HistogramVec
+	shareHistogram        latencyHistograms
+	targetsHistogram      latencyHistograms
+	agentsHistogram       latencyHistograms
 	labelsCounter         *prometheus.CounterVec
 	valuesCounter         *prometheus.CounterVec
 	profileTypesCounter   *prometheus.CounterVec
 	rangeCounter          *prometheus.CounterVec
-	mergeCounter          *prometheus.CounterVec
+	queryCounter          *prometheus.CounterVec
+	shareCounter          *prometheus.CounterVec
+	targetsCounter        *prometheus.CounterVec
+	agentsCounter         *prometheus.CounterVec
+	droppedCounter        *prometheus.CounterVec
+	inflightGauge         prometheus.Gauge
+	stageGauge            *prometheus.GaugeVec
+	targetRateGauge       prometheus.Gauge
+	busyWorkersGauge      *prometheus.GaugeVec
+	mixConfiguredGauge    *prometheus.GaugeVec
+	mixAchievedGauge      *prometheus.GaugeVec
 }
 
 type Querier struct {
@@ -53,29 +69,82 @@ type Querier struct {
 	metrics querierMetrics
 
 	client queryv1alpha1connect.QueryServiceClient
+	scrape scrapev1alpha1connect.ScrapeServiceClient
+	agents profilestorev1alpha1connect.AgentsServiceClient
+
+	// config is the configuration the querier was created with. Only the
+	// workload can be changed afterwards.
+	config *Config
+	// reloaded is the configuration of the last reload, so that changes
+	// that are not applied are only logged once.
+	reloaded *Config
+	workload atomic.Pointer[workload]
+
+	schedule ScheduleConfig
+	queries  QueriesConfig
+	mix      MixConfig
+	limits   LimitsConfig
+
+	viewportConf ViewportsConfig
+	// viewportTurn counts the requests that took a viewport in rotate mode.
+	viewportTurn atomic.Uint64
+
+	// stopIssuing stops sending new requests once a limit is reached.
+	stopIssuing context.CancelFunc
+	// issued counts the requests taken from the request limit.
+	issued  atomic.Int64
+	summary *runSummary
+
+	// singles are the points of range query responses that single-profile
+	// queries are made for.
+	singles singlePoints
+	// functions are the function names of flamegraphs that filters are
+	// sampled from.
+	functions knownNames[string]
+	// sources are the source files that source reports are requested for.
+	sources knownNames[sourceRef]
+	// labelNames are the label names that range queries sum by.
+	labelNames knownNames[string]
+}
 
+// workload is the part of the configuration that can be reloaded while the
+// querier is running. It is never modified, but replaced as a whole, so that
+// each round sees a consistent workload.
+type workload struct {
 	profileTypes []string
-	// valuesForLabels are label names to query values for (from flag).
+	// valuesForLabels are label names to query values for.
 	valuesForLabels []string
 
 	// queryTimeRanges are used by range and merge queries.
 	queryTimeRanges []time.Duration
 	// labelSelectors are appended to profile types for filtering queries.
 	labelSelectors []string
+	// rules choose the kinds, modes and ranges of each profile type.
+	rules []ProfileTypeRule
+}
+
+func newWorkload(cfg *Config) *workload {
+	return &workload{
+		profileTypes:    profileTypeStrings(cfg.ProfileTypes),
+		valuesForLabels: cfg.Queries.Values.Labels,
+		queryTimeRanges: durations(cfg.Ranges),
+		labelSelectors:  selectorStrings(cfg.Selectors),
+		rules:           cfg.profileTypeRules(),
+	}
 }
 
 func NewQuerier(
 	reg *prometheus.Registry,
 	client queryv1alpha1connect.QueryServiceClient,
-	queryTimeRangesConf []time.Duration,
-	labelSelectors []string,
-	profileTypes []string,
-	valuesForLabels []string,
+	scrape scrapev1alpha1connect.ScrapeServiceClient,
+	agents profilestorev1alpha1connect.AgentsServiceClient,
+	cfg *Config,
 ) *Querier {
-	return &Querier{
+	q := &Querier{
 		done: make(chan struct{}),
 		metrics: querierMetrics{
-			labelsHistogram: promauto.With(reg).NewHistogramVec(
+			labelsHistogram: newLatencyHistograms(
+				reg,
 				prometheus.HistogramOpts{
 					Name:                        "parca_client_labels_seconds",
 					Help:                        "The seconds it takes to make Labels requests against a Parca",
@@ -83,15 +152,17 @@ func NewQuerier(
 				},
 				[]string{"grpc_code"},
 			),
-			valuesHistogram: promauto.With(reg).NewHistogramVec(
+			valuesHistogram: newLatencyHistograms(
+				reg,
 				prometheus.HistogramOpts{
 					Name:                        "parca_client_values_seconds",
 					Help:                        "The seconds it takes to make Values requests against a Parca",
 					NativeHistogramBucketFactor: 1.1,
 				},
-				[]string{"grpc_code", "label"},
+				[]string{"grpc_code", "label", "labels"},
 			),
-			profileTypesHistogram: promauto.With(reg).NewHistogramVec(
+			profileTypesHistogram: newLatencyHistograms(
+				reg,
 				prometheus.HistogramOpts{
 					Name:                        "parca_client_profiletypes_seconds",
 					Help:                        "The seconds it takes to make ProfileTypes requests against a Parca",
@@ -99,23 +170,69 @@ func NewQuerier(
 				},
 				[]string{"grpc_code"},
 			),
-			rangeHistogram: promauto.With(reg).NewHistogramVec(
+			rangeHistogram: newLatencyHistograms(
+				reg,
 				prometheus.HistogramOpts{
 					Name:                        "parca_client_queryrange_seconds",
 					Help:                        "The seconds it takes to make QueryRange requests against a Parca",
 					NativeHistogramBucketFactor: 1.1,
 				},
-				[]string{"grpc_code", "range", "labels"},
+				[]string{"grpc_code", "range", "labels", "sum_by", "viewport"},
 			),
-			mergeHistogram: promauto.With(reg).NewHistogramVec(
+			rangeSeriesHistogram: promauto.With(reg).NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_queryrange_series",
+					Help:                        "The number of series returned by successful QueryRange requests against a Parca",
+					Buckets:                     prometheus.ExponentialBuckets(1, 2, 16),
+					NativeHistogramBucketFactor: 1.1,
+				},
+				[]string{"range", "labels", "sum_by", "viewport", "stage"},
+			),
+			queryHistogram: newLatencyHistograms(
+				reg,
 				prometheus.HistogramOpts{
 					Name:                        "parca_client_query_seconds",
 					Help:                        "The seconds it takes to make Query requests against a Parca",
-					ConstLabels:                 map[string]string{"mode": "merge"},
+					NativeHistogramBucketFactor: 1.1,
+				},
+				queryLabelNames,
+			),
+			queryBytesHistogram: promauto.With(reg).NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_query_response_bytes",
+					Help:                        "The size in bytes of the responses to successful Query requests against a Parca",
+					Buckets:                     prometheus.ExponentialBuckets(256, 4, 12),
+					NativeHistogramBucketFactor: 1.1,
+				},
+				append(queryLabelNames[1:len(queryLabelNames):len(queryLabelNames)], "stage"),
+			),
+			shareHistogram: newLatencyHistograms(
+				reg,
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_shareprofile_seconds",
+					Help:                        "The seconds it takes to make ShareProfile requests against a Parca",
 					NativeHistogramBucketFactor: 1.1,
 				},
 				[]string{"grpc_code", "range", "labels"},
 			),
+			targetsHistogram: newLatencyHistograms(
+				reg,
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_targets_seconds",
+					Help:                        "The seconds it takes to make Targets requests against a Parca",
+					NativeHistogramBucketFactor: 1.1,
+				},
+				[]string{"grpc_code", "state"},
+			),
+			agentsHistogram: newLatencyHistograms(
+				reg,
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_agents_seconds",
+					Help:                        "The seconds it takes to make Agents requests against a Parca",
+					NativeHistogramBucketFactor: 1.1,
+				},
+				[]string{"grpc_code"},
+			),
 			labelsCounter: promauto.With(reg).NewCounterVec(
 				prometheus.CounterOpts{
 					Name: "parca_client_labels_total",
@@ -128,7 +245,7 @@ func NewQuerier(
 					Name: "parca_client_values_total",
 					Help: "Total number of Values requests against Parca",
 				},
-				[]string{"grpc_code", "label"},
+				[]string{"grpc_code", "label", "labels"},
 			),
 			profileTypesCounter: promauto.With(reg).NewCounterVec(
 				prometheus.CounterOpts{
@@ -142,105 +259,503 @@ func NewQuerier(
 					Name: "parca_client_queryrange_total",
 					Help: "Total number of QueryRange requests against Parca",
 				},
-				[]string{"grpc_code", "range", "labels"},
+				[]string{"grpc_code", "range", "labels", "sum_by", "viewport"},
+			),
+			queryCounter: promauto.With(reg).NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "parca_client_query_total",
+					Help: "Total number of Query requests against Parca",
+				},
+				queryLabelNames,
 			),
-			mergeCounter: promauto.With(reg).NewCounterVec(
+			shareCounter: promauto.With(reg).NewCounterVec(
 				prometheus.CounterOpts{
-					Name:        "parca_client_query_total",
-					Help:        "Total number of Query requests against Parca",
-					ConstLabels: map[string]string{"mode": "merge"},
+					Name: "parca_client_shareprofile_total",
+					Help: "Total number of ShareProfile requests against Parca",
 				},
 				[]string{"grpc_code", "range", "labels"},
 			),
+			targetsCounter: promauto.With(reg).NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "parca_client_targets_total",
+					Help: "Total number of Targets requests against Parca",
+				},
+				[]string{"grpc_code", "state"},
+			),
+			agentsCounter: promauto.With(reg).NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "parca_client_agents_total",
+					Help: "Total number of Agents requests against Parca",
+				},
+				[]string{"grpc_code"},
+			),
+			droppedCounter: promauto.With(reg).NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "parca_client_dropped_total",
+					Help: "Total number of open-loop requests that were not sent because the in-flight limit was reached",
+				},
+				[]string{"kind"},
+			),
+			inflightGauge: promauto.With(reg).NewGauge(
+				prometheus.GaugeOpts{
+					Name: "parca_client_inflight_requests",
+					Help: "The number of open-loop requests currently in flight against Parca",
+				},
+			),
+			stageGauge: promauto.With(reg).NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "parca_client_load_stage",
+					Help: "Set to 1 for the load stage that is currently running and 0 for stages that ran before",
+				},
+				[]string{"stage"},
+			),
+			targetRateGauge: promauto.With(reg).NewGauge(
+				prometheus.GaugeOpts{
+					Name: "parca_client_load_target_rate",
+					Help: "The shared open-loop request rate per second that is currently targeted",
+				},
+			),
+			busyWorkersGauge: promauto.With(reg).NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "parca_client_busy_workers",
+					Help: "The number of workers that are currently making requests of a query kind",
+				},
+				[]string{"kind"},
+			),
+			mixConfiguredGauge: promauto.With(reg).NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "parca_client_mix_configured_ratio",
+					Help: "The ratio of shared open-loop requests that the traffic mix assigns to a query kind",
+				},
+				[]string{"kind"},
+			),
+			mixAchievedGauge: promauto.With(reg).NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: "parca_client_mix_achieved_ratio",
+					Help: "The ratio of shared open-loop requests that were actually sent for a query kind",
+				},
+				[]string{"kind"},
+			),
 		},
-		client:          client,
-		queryTimeRanges: queryTimeRangesConf,
-		labelSelectors:  labelSelectors,
-		profileTypes:    profileTypes,
-		valuesForLabels: valuesForLabels,
+		client:   client,
+		scrape:   scrape,
+		agents:   agents,
+		config:   cfg,
+		reloaded: cfg,
+		schedule: cfg.Schedule,
+		queries:  cfg.Queries,
+		mix:      cfg.Mix,
+		limits:   cfg.Limits,
+
+		viewportConf: cfg.Viewports,
 	}
+	if cfg.Limits.bounded() {
+		q.summary = &runSummary{}
+	}
+	q.workload.Store(newWorkload(cfg))
+	return q
+}
+
+// queryLabelNames are the labels of the Query metrics, which are shared by all
+// query modes. The response size histogram has all but grpc_code, and a
+// stage label like the latency histograms.
+var queryLabelNames = []string{"grpc_code", "mode", "report_type", "range", "labels", "comparison", "filter", "group_by", "viewport"}
+
+// queryLabels are the label values of a Query request. Labels that don't
+// apply to its mode are empty, which omits them from the series.
+type queryLabels struct {
+	mode       string
+	reportType ReportType
+	tr         string
+	labels     string
+	comparison string
+	filter     string
+	groupBy    string
+	viewport   string
+}
+
+func (l queryLabels) values(code string) []string {
+	return []string{code, l.mode, string(l.reportType), l.tr, l.labels, l.comparison, l.filter, l.groupBy, l.viewport}
 }
 
-func (q *Querier) Run(ctx context.Context, interval time.Duration) {
+// observeQuery records the metrics of a Query request that was sent at sent
+// and took latency to complete.
+func (q *Querier) observeQuery(
+	ctx context.Context,
+	sent time.Time,
+	latency time.Duration,
+	l queryLabels,
+	resp *connect.Response[queryv1alpha1.QueryResponse],
+	err error,
+) {
+	code := grpcCodeOK
+	if err != nil {
+		code = connect.CodeOf(err).String()
+	}
+	q.metrics.queryHistogram.observe(ctx, sent, latency, l.values(code)...)
+	q.metrics.queryCounter.WithLabelValues(l.values(code)...).Inc()
+	if err == nil {
+		q.metrics.queryBytesHistogram.WithLabelValues(append(l.values(code)[1:], stageOf(ctx))...).Observe(float64(proto.Size(resp.Msg)))
+	}
+}
+
+// request is a single request against Parca.
+type request struct {
+	// profileType is the profile type that is queried, if any.
+	profileType string
+	// do makes the request and records its metrics.
+	do func(ctx context.Context) error
+}
+
+// queryKind is a type of query that is scheduled independently of the others.
+type queryKind struct {
+	name string
+	// key is the name of the kind in the workload file.
+	key  string
+	conf QueryKindConfig
+	// requests returns the requests that make up a single round.
+	requests func() []request
+	// retry makes closed-loop rounds retry failed requests until the next
+	// round is due.
+	retry bool
+	// generation is set for kinds that build their requests from the
+	// responses of other kinds, so their requests change even if the
+	// workload doesn't. It changes whenever those responses do.
+	generation func() uint64
+}
+
+// Run sends requests until Stop is called or one of the configured limits
+// is reached. Once a limit is reached, no new requests are sent and Run
+// returns after the requests in flight completed.
+func (q *Querier) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	q.cancel = cancel
 
 	defer close(q.done)
 
-	// If no profile types configured, discover them from the backend.
-	if len(q.profileTypes) == 0 {
-		// Use the longest query time range to discover all profile types.
-		tr := q.queryTimeRanges[len(q.queryTimeRanges)-1]
-		types, latency, err := q.fetchProfileTypes(ctx, tr)
-		if err != nil {
-			log.Printf("failed to discover profile types: %v\n", err)
+	// Retry discovering the profile types, as a Parca that the writer is only
+	// starting to fill may not have any yet.
+	exp := backoff.NewExponentialBackOff()
+	exp.MaxElapsedTime = 0
+	err := backoff.RetryNotify(
+		func() error { return q.discoverProfileTypes(ctx, q.workload.Load()) },
+		backoff.WithContext(exp, ctx),
+		func(err error, next time.Duration) {
+			log.Printf("failed to discover profile types, retrying in %s: %v\n", next.Round(time.Millisecond), err)
+		},
+	)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to discover profile types: %w", err)
+	}
+
+	all := []queryKind{
+		{name: "profile_types", key: "profileTypes", conf: q.queries.ProfileTypes, requests: q.profileTypesRequests, retry: true},
+		{name: "labels", key: "labels", conf: q.queries.Labels, requests: q.labelsRequests, retry: true},
+		{name: "values", key: "values", conf: q.queries.Values.Kind, requests: q.valuesRequests, retry: true},
+		{name: "range", key: "range", conf: q.queries.Range.Kind, requests: q.rangeRequests},
+		{name: "merge", key: "merge", conf: q.queries.Merge.Kind, requests: q.mergeRequests, generation: q.mergeGeneration},
+		{name: "single", key: "single", conf: q.queries.Single.Kind, requests: q.singleRequests, generation: q.singles.generation},
+		{name: "diff", key: "diff", conf: q.queries.Diff.Kind, requests: q.diffRequests},
+		{name: "source", key: "source", conf: q.queries.Source.Kind, requests: q.sourceRequests, generation: q.sources.generation},
+		{name: "share", key: "share", conf: q.queries.Share, requests: q.shareRequests},
+		{name: "targets", key: "targets", conf: q.queries.Targets.Kind, requests: q.targetsRequests, retry: true},
+		{name: "agents", key: "agents", conf: q.queries.Agents, requests: q.agentsRequests, retry: true},
+	}
+	kinds := make([]queryKind, 0, len(all))
+	for _, kind := range all {
+		if !kind.conf.Enabled {
+			log.Printf("%s: disabled\n", kind.name)
+			continue
+		}
+		kinds = append(kinds, kind)
+	}
+
+	// Requests are made with ctx, which is only cancelled by Stop to abort
+	// them, while issue is cancelled once no new requests should be sent.
+	issue, stopIssuing := context.WithCancel(ctx)
+	defer stopIssuing()
+	if d := time.Duration(q.limits.Duration); d > 0 {
+		issue, stopIssuing = context.WithTimeout(issue, d)
+		defer stopIssuing()
+	}
+	q.stopIssuing = stopIssuing
+	q.summary.begin()
+
+	if q.schedule.Mode == scheduleModeOpen {
+		q.runOpenLoop(ctx, issue, kinds)
+		return nil
+	}
+
+	if len(kinds) == 0 {
+		// Keep running until stopped, so that writing profiles or uploading
+		// debuginfo on their own is not cut short.
+		<-issue.Done()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for _, kind := range kinds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.runClosedLoop(ctx, issue, kind)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// take reserves one request of the request limit and reports whether it may
+// be sent. Once the limit is used up, sending requests stops.
+func (q *Querier) take() bool {
+	if q.limits.Requests == 0 {
+		return true
+	}
+	n := q.issued.Add(1)
+	if n >= q.limits.Requests {
+		q.stopIssuing()
+	}
+	return n <= q.limits.Requests
+}
+
+// do makes the request and records it for the summary of the run.
+func (q *Querier) do(ctx context.Context, kind queryKind, r request) error {
+	sent := time.Now()
+	err := r.do(ctx)
+	q.summary.record(kind.name, time.Since(sent), time.Since(scheduledAt(ctx, sent)), err)
+	return err
+}
+
+// runClosedLoop starts a round of the given query kind at every interval
+// until issue is cancelled or the round limit is reached. Rounds overlap up
+// to the kind's concurrency, and the requests within a round are spread over
+// the kind's workers.
+func (q *Querier) runClosedLoop(ctx, issue context.Context, kind queryKind) {
+	interval := time.Duration(kind.conf.Interval)
+	if interval == 0 {
+		interval = time.Duration(q.schedule.Interval)
+	}
+	arrivals := newArrivals(q.arrival(kind), kind.name)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// due is when the oldest round that has not started yet was meant to
+	// start. Rounds skipped while earlier rounds are still running delay the
+	// next round, and its requests are late by the time since due.
+	var (
+		rounds int
+		due    time.Time
+	)
+	inflight := make(chan struct{}, kind.conf.Concurrency)
+	run := func(scheduled time.Time) {
+		if due.IsZero() {
+			due = scheduled
+		}
+		select {
+		case inflight <- struct{}{}:
+		default:
+			log.Printf("%s: skipping round, %d rounds still running\n", kind.name, kind.conf.Concurrency)
 			return
 		}
-		if len(types) == 0 {
-			log.Println("no profile types found on backend")
+
+		roundDue := due
+		due = time.Time{}
+		rounds++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inflight }()
+			q.round(ctx, issue, kind, interval, roundDue)
+		}()
+	}
+
+	// Immediately run and then wait for the next arrival.
+	// If we don't run immediately, we'll have to wait for the first arrival to run which can be a long time e.g. 30min.
+	next := time.Now()
+	run(next)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for q.limits.Rounds == 0 || rounds < q.limits.Rounds {
+		next = next.Add(arrivals.next(interval))
+		timer.Reset(time.Until(next))
+		select {
+		case <-issue.Done():
 			return
+		case <-timer.C:
+			run(next)
 		}
-		q.profileTypes = make([]string, 0, len(types))
-		for _, pt := range types {
-			q.profileTypes = append(q.profileTypes, profileTypeToString(pt))
+	}
+	log.Printf("%s: finishing after %d rounds\n", kind.name, rounds)
+}
+
+// arrival returns the arrival process of the kind.
+func (q *Querier) arrival(kind queryKind) ArrivalConfig {
+	if kind.conf.Arrival.Process == "" {
+		return q.schedule.Arrival
+	}
+	return kind.conf.Arrival
+}
+
+// round makes the requests of a single round of the kind, fanned out over
+// the kind's workers. A round that starts after it was due, because earlier
+// rounds were still running, is late, and so is every request it hands to a
+// worker. The time a request spends behind earlier requests of the same round
+// is how a round works, not a delay, and is not part of its latency.
+func (q *Querier) round(ctx, issue context.Context, kind queryKind, interval time.Duration, due time.Time) {
+	late := time.Since(due)
+	busy := q.metrics.busyWorkersGauge.WithLabelValues(kind.name)
+	reqs := make(chan request)
+
+	var wg sync.WaitGroup
+	for range kind.conf.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range reqs {
+				// Requests are only taken from the request limit once a
+				// worker is about to send them, so that requests still
+				// waiting for a worker when the run ends don't count.
+				if issue.Err() != nil || !q.take() {
+					continue
+				}
+				busy.Inc()
+				q.send(withScheduled(ctx, time.Now().Add(-late)), issue, kind, r, interval)
+				busy.Dec()
+			}
+		}()
+	}
+
+feed:
+	for _, r := range kind.requests() {
+		select {
+		case <-issue.Done():
+			break feed
+		case reqs <- r:
 		}
-		log.Printf("discovered %d profile types(over=%s) in %v: %v\n", len(q.profileTypes), tr, latency, q.profileTypes)
 	}
+	close(reqs)
+	wg.Wait()
+}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// send makes the request, retrying it until the next round is due if the
+// kind retries failed requests. Retries stop once issue is cancelled, and as
+// they keep the time the request was scheduled at, their latency includes
+// the failed attempts. The summary counts the request once, failed only if
+// its last attempt failed.
+func (q *Querier) send(ctx, issue context.Context, kind queryKind, r request, interval time.Duration) {
+	if !kind.retry {
+		_ = q.do(ctx, kind, r)
+		return
+	}
 
-	run := func() {
-		g, ctx := errgroup.WithContext(ctx)
+	sent := time.Now()
+	exp := backoff.NewExponentialBackOff()
+	exp.MaxElapsedTime = interval
+	var err error
+	_ = backoff.Retry(func() error {
+		err = r.do(ctx)
+		return err
+	}, backoff.WithContext(exp, issue))
+	q.summary.record(kind.name, time.Since(sent), time.Since(scheduledAt(ctx, sent)), err)
+}
 
-		g.Go(
-			func() error {
-				q.queryProfileTypes(ctx, interval)
-				return nil
-			},
-		)
-		g.Go(
-			func() error {
-				q.queryLabels(ctx, interval)
-				return nil
-			},
-		)
-		g.Go(
-			func() error {
-				q.queryValues(ctx, interval)
-				return nil
-			},
-		)
-		g.Go(
-			func() error {
-				q.queryRange(ctx)
-				return nil
-			},
-		)
-		g.Go(
-			func() error {
-				q.queryMerge(ctx)
-				return nil
-			},
-		)
+// discoverProfileTypes stores the workload, and if it doesn't configure any
+// profile types but an enabled query kind needs them, discovers them from the
+// backend first.
+func (q *Querier) discoverProfileTypes(ctx context.Context, w *workload) error {
+	if len(w.profileTypes) > 0 || !q.needsProfileTypes() {
+		q.workload.Store(w)
+		return nil
+	}
+
+	// Use the longest query time range to discover all profile types.
+	tr := slices.Max(w.queryTimeRanges)
+	types, latency, err := q.fetchProfileTypes(ctx, tr)
+	if err != nil {
+		return err
+	}
+	if len(types) == 0 {
+		return errors.New("no profile types found on backend")
+	}
 
-		if err := g.Wait(); err != nil {
-			log.Printf("query error: %v\n", err)
+	discovered := *w
+	discovered.profileTypes = make([]string, 0, len(types))
+	for _, pt := range types {
+		discovered.profileTypes = append(discovered.profileTypes, profileTypeToString(pt))
+	}
+	log.Printf("discovered %d profile types(over=%s) in %v: %v\n", len(discovered.profileTypes), tr, latency, discovered.profileTypes)
+	q.workload.Store(&discovered)
+	return nil
+}
+
+// needsProfileTypes reports whether any enabled query kind makes its requests
+// per profile type.
+func (q *Querier) needsProfileTypes() bool {
+	for key, conf := range q.queries.kinds() {
+		switch key {
+		case "profileTypes", "targets", "agents":
+			continue
+		}
+		if conf.Enabled {
+			return true
 		}
 	}
+	return false
+}
 
-	// Immediately run and then wait for the ticker.
-	// If we don't run immediately, we'll have to wait for the first tick to run which can be a long time e.g. 30min.
-	run()
+// Reload replaces the workload with the one of the given configuration. The
+// change applies to all rounds and open-loop requests that start afterwards.
+// Other settings cannot be changed at runtime and are left as they are; Reload
+// returns the sections that differ from the running configuration and so were
+// not applied.
+func (q *Querier) Reload(ctx context.Context, cfg *Config) ([]string, error) {
+	if err := q.discoverProfileTypes(ctx, newWorkload(cfg)); err != nil {
+		return nil, fmt.Errorf("discover profile types: %w", err)
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			run()
+	running := q.unappliedSections(q.config, cfg)
+	// Sections that already differed at the last reload were logged then.
+	changed := q.unappliedSections(q.reloaded, cfg)
+	q.reloaded = cfg
+
+	for _, section := range running {
+		if slices.Contains(changed, section) {
+			log.Printf("reload: changes to %s require a restart and were not applied\n", section)
 		}
 	}
+	return running, nil
+}
+
+// unappliedSections returns the sections of cfg that cannot be reloaded and
+// differ from those of base.
+func (q *Querier) unappliedSections(base, cfg *Config) []string {
+	// The labels to query values for are part of the workload.
+	queries, current := cfg.Queries, base.Queries
+	queries.Values.Labels, current.Values.Labels = nil, nil
+
+	differ := map[string]bool{
+		"target":    !reflect.DeepEqual(cfg.Target, base.Target),
+		"auth":      !reflect.DeepEqual(cfg.Auth, base.Auth),
+		"schedule":  !reflect.DeepEqual(cfg.Schedule, base.Schedule),
+		"queries":   !reflect.DeepEqual(queries, current),
+		"mix":       !reflect.DeepEqual(cfg.Mix, base.Mix),
+		"viewports": !reflect.DeepEqual(cfg.Viewports, base.Viewports),
+		"write":     !reflect.DeepEqual(cfg.Write, base.Write),
+		"debuginfo": !reflect.DeepEqual(cfg.Debuginfo, base.Debuginfo),
+		"limits":    !reflect.DeepEqual(cfg.Limits, base.Limits),
+	}
+	var sections []string
+	for _, section := range slices.Sorted(maps.Keys(differ)) {
+		if differ[section] {
+			sections = append(sections, section)
+		}
+	}
+	return sections
 }
 
 func (q *Querier) Stop() {
@@ -268,272 +783,421 @@ func (q *Querier) fetchProfileTypes(ctx context.Context, tr time.Duration) (
 	)
 	latency := time.Since(queryStart)
 	if err != nil {
-		q.metrics.profileTypesHistogram.WithLabelValues(connect.CodeOf(err).String()).Observe(latency.Seconds())
+		q.metrics.profileTypesHistogram.observe(ctx, queryStart, latency, connect.CodeOf(err).String())
 		q.metrics.profileTypesCounter.WithLabelValues(connect.CodeOf(err).String()).Inc()
 		return nil, latency, err
 	}
-	q.metrics.profileTypesHistogram.WithLabelValues(grpcCodeOK).Observe(latency.Seconds())
+	q.metrics.profileTypesHistogram.observe(ctx, queryStart, latency, grpcCodeOK)
 	q.metrics.profileTypesCounter.WithLabelValues(grpcCodeOK).Inc()
 	return resp.Msg.Types, latency, nil
 }
 
-func (q *Querier) queryLabels(ctx context.Context, interval time.Duration) {
-	for _, profileType := range q.profileTypes {
-		for _, tr := range q.queryTimeRanges {
-			rangeEnd := time.Now()
-			rangeStart := rangeEnd.Add(-1 * tr)
-
-			pt := profileType
-			var resp *connect.Response[queryv1alpha1.LabelsResponse]
-			var count int
-			operation := func() (err error) {
-				defer func() { count++ }()
-
-				queryStart := time.Now()
-				req := &queryv1alpha1.LabelsRequest{
-					Start:       timestamppb.New(rangeStart),
-					End:         timestamppb.New(rangeEnd),
-					ProfileType: &pt,
-				}
-				resp, err = q.client.Labels(ctx, connect.NewRequest(req))
-				latency := time.Since(queryStart)
+func (q *Querier) labelsRequests() []request {
+	w := q.workload.Load()
+	reqs := make([]request, 0, len(w.profileTypes)*len(w.queryTimeRanges))
+	for _, profileType := range w.profileTypesFor("labels") {
+		for _, tr := range w.rangesFor(profileType) {
+			reqs = append(reqs, request{profileType: profileType, do: func(ctx context.Context) error {
+				names, latency, err := q.fetchLabels(ctx, profileType, tr)
 				if err != nil {
-					q.metrics.labelsHistogram.WithLabelValues(connect.CodeOf(err).String()).Observe(latency.Seconds())
-					q.metrics.labelsCounter.WithLabelValues(connect.CodeOf(err).String()).Inc()
-					log.Printf("labels(type=%s,over=%s): failed to make request %d: %v\n", pt, tr, count, err)
-					return
+					log.Printf("labels(type=%s,over=%s): failed to make request: %v\n", profileType, tr, err)
+					return err
 				}
-				q.metrics.labelsHistogram.WithLabelValues(grpcCodeOK).Observe(latency.Seconds())
-				q.metrics.labelsCounter.WithLabelValues(grpcCodeOK).Inc()
 				log.Printf(
 					"labels(type=%s,over=%s): took %v and got %d results\n",
-					pt,
+					profileType,
 					tr,
 					latency,
-					len(resp.Msg.LabelNames),
+					len(names),
 				)
 
 				return nil
-			}
-
-			exp := backoff.NewExponentialBackOff()
-			exp.MaxElapsedTime = interval
-			if err := backoff.Retry(operation, backoff.WithContext(exp, ctx)); err != nil {
-				continue
-			}
+			}})
 		}
 	}
+	return reqs
 }
 
-func (q *Querier) queryValues(ctx context.Context, interval time.Duration) {
-	if len(q.valuesForLabels) == 0 {
-		return
+// fetchLabels executes the Labels API call and returns the results. The label
+// names are kept for range queries to sum by.
+func (q *Querier) fetchLabels(ctx context.Context, profileType string, tr time.Duration) (
+	[]string,
+	time.Duration,
+	error,
+) {
+	rangeEnd := time.Now()
+	rangeStart := rangeEnd.Add(-1 * tr)
+
+	queryStart := time.Now()
+	req := &queryv1alpha1.LabelsRequest{
+		Start:       timestamppb.New(rangeStart),
+		End:         timestamppb.New(rangeEnd),
+		ProfileType: &profileType,
+	}
+	resp, err := q.client.Labels(ctx, connect.NewRequest(req))
+	latency := time.Since(queryStart)
+	if err != nil {
+		q.metrics.labelsHistogram.observe(ctx, queryStart, latency, connect.CodeOf(err).String())
+		q.metrics.labelsCounter.WithLabelValues(connect.CodeOf(err).String()).Inc()
+		return nil, latency, err
 	}
+	q.metrics.labelsHistogram.observe(ctx, queryStart, latency, grpcCodeOK)
+	q.metrics.labelsCounter.WithLabelValues(grpcCodeOK).Inc()
+	q.labelNames.store(profileType, resp.Msg.LabelNames)
+	return resp.Msg.LabelNames, latency, nil
+}
 
-	for _, label := range q.valuesForLabels {
-		for _, profileType := range q.profileTypes {
-			for _, tr := range q.queryTimeRanges {
-				rangeEnd := time.Now()
-				rangeStart := rangeEnd.Add(-1 * tr)
-
-				pt := profileType
-				lbl := label
-				var resp *connect.Response[queryv1alpha1.ValuesResponse]
-				var count int
-				operation := func() (err error) {
-					defer func() { count++ }()
-					queryStart := time.Now()
-					req := &queryv1alpha1.ValuesRequest{
-						LabelName:   lbl,
-						Match:       nil,
-						Start:       timestamppb.New(rangeStart),
-						End:         timestamppb.New(rangeEnd),
-						ProfileType: &pt,
-					}
-					resp, err = q.client.Values(ctx, connect.NewRequest(req))
-					latency := time.Since(queryStart)
-					if err != nil {
-						q.metrics.valuesHistogram.WithLabelValues(connect.CodeOf(err).String(), lbl).Observe(latency.Seconds())
-						q.metrics.valuesCounter.WithLabelValues(connect.CodeOf(err).String(), lbl).Inc()
+func (q *Querier) valuesRequests() []request {
+	w := q.workload.Load()
+	labelSelectors := []string{"all"}
+	if q.queries.Values.MatchSelectors {
+		labelSelectors = w.labelSelectors
+	}
+	reqs := make([]request, 0, len(w.valuesForLabels)*len(w.profileTypes)*len(w.queryTimeRanges)*len(labelSelectors))
+	for _, label := range w.valuesForLabels {
+		for _, profileType := range w.profileTypesFor("values") {
+			for _, tr := range w.rangesFor(profileType) {
+				for _, labelSelector := range labelSelectors {
+					reqs = append(reqs, request{profileType: profileType, do: func(ctx context.Context) error {
+						rangeEnd := time.Now()
+						rangeStart := rangeEnd.Add(-1 * tr)
+
+						var match []string
+						if labelSelector != "all" {
+							match = []string{labelSelector}
+						}
+
+						pt := profileType
+						lbl := label
+						queryStart := time.Now()
+						req := &queryv1alpha1.ValuesRequest{
+							LabelName:   lbl,
+							Match:       match,
+							Start:       timestamppb.New(rangeStart),
+							End:         timestamppb.New(rangeEnd),
+							ProfileType: &pt,
+						}
+						resp, err := q.client.Values(ctx, connect.NewRequest(req))
+						latency := time.Since(queryStart)
+						if err != nil {
+							q.metrics.valuesHistogram.observe(ctx, queryStart, latency, connect.CodeOf(err).String(), lbl, labelSelector)
+							q.metrics.valuesCounter.WithLabelValues(connect.CodeOf(err).String(), lbl, labelSelector).Inc()
+							log.Printf(
+								"values(label=%s,type=%s,over=%s,labels=%s): failed to make request: %v\n",
+								lbl,
+								pt,
+								tr,
+								labelSelector,
+								err,
+							)
+							return err
+						}
+						q.metrics.valuesHistogram.observe(ctx, queryStart, latency, grpcCodeOK, lbl, labelSelector)
+						q.metrics.valuesCounter.WithLabelValues(grpcCodeOK, lbl, labelSelector).Inc()
 						log.Printf(
-							"values(label=%s,type=%s,over=%s): failed to make request %d: %v\n",
+							"values(label=%s,type=%s,over=%s,labels=%s): took %v and got %d results\n",
 							lbl,
 							pt,
 							tr,
-							count,
-							err,
+							labelSelector,
+							latency,
+							len(resp.Msg.LabelValues),
 						)
-						return
-					}
-					q.metrics.valuesHistogram.WithLabelValues(grpcCodeOK, lbl).Observe(latency.Seconds())
-					q.metrics.valuesCounter.WithLabelValues(grpcCodeOK, lbl).Inc()
-					log.Printf(
-						"values(label=%s,type=%s,over=%s): took %v and got %d results\n",
-						lbl,
-						pt,
-						tr,
-						latency,
-						len(resp.Msg.LabelValues),
-					)
-
-					return nil
-				}
 
-				exp := backoff.NewExponentialBackOff()
-				exp.MaxElapsedTime = interval
-				if err := backoff.Retry(operation, backoff.WithContext(exp, ctx)); err != nil {
-					continue
+						return nil
+					}})
 				}
 			}
 		}
 	}
+	return reqs
 }
 
-func (q *Querier) queryProfileTypes(ctx context.Context, interval time.Duration) {
-	for _, tr := range q.queryTimeRanges {
-		var count int
-		operation := func() error {
-			defer func() { count++ }()
-
+func (q *Querier) profileTypesRequests() []request {
+	w := q.workload.Load()
+	reqs := make([]request, 0, len(w.queryTimeRanges))
+	for _, tr := range w.queryTimeRanges {
+		reqs = append(reqs, request{do: func(ctx context.Context) error {
 			types, latency, err := q.fetchProfileTypes(ctx, tr)
 			if err != nil {
-				log.Printf("profile_types(over=%s): failed to make request %d: %v\n", tr, count, err)
+				log.Printf("profile_types(over=%s): failed to make request: %v\n", tr, err)
 				return err
 			}
 			log.Printf("profile_types(over=%s): took %v and got %d types\n", tr, latency, len(types))
 			return nil
+		}})
+	}
+	return reqs
+}
+
+func (q *Querier) rangeRequests() []request {
+	w := q.workload.Load()
+	// The first sum-by is empty to also request the series without
+	// aggregation.
+	sumBys := append([]SumByConfig{{}}, q.queries.Range.SumBy...)
+	viewports := q.viewports()
+	reqs := make([]request, 0, len(w.profileTypes)*len(w.queryTimeRanges)*len(w.labelSelectors)*len(sumBys)*len(viewports))
+	for _, profileType := range w.profileTypesFor("range") {
+		for _, tr := range w.rangesFor(profileType) {
+			for _, labelSelector := range w.labelSelectors {
+				for _, sumBy := range sumBys {
+					for _, vp := range viewports {
+						reqs = append(reqs, request{profileType: profileType, do: func(ctx context.Context) error {
+							vp := q.viewport(vp)
+							query := profileType
+							if labelSelector != "all" {
+								query = profileType + labelSelector
+							}
+
+							labelNames, err := q.sumBy(ctx, sumBy, profileType, tr)
+							if err != nil {
+								log.Printf(
+									"range(query=%s,over=%s,labels=%s,sum_by=%s): failed to pick labels: %v\n",
+									query, tr, labelSelector, sumBy.Name, err,
+								)
+								return err
+							}
+
+							rangeEnd := time.Now()
+							rangeStart := rangeEnd.Add(-1 * tr)
+
+							queryStart := time.Now()
+							resp, err := q.client.QueryRange(
+								ctx, connect.NewRequest(
+									&queryv1alpha1.QueryRangeRequest{
+										Query: query,
+										Start: timestamppb.New(rangeStart),
+										End:   timestamppb.New(rangeEnd),
+										Step:  vp.step(tr),
+										SumBy: labelNames,
+									},
+								),
+							)
+							latency := time.Since(queryStart)
+							if err != nil {
+								q.metrics.rangeHistogram.observe(
+									ctx, queryStart, latency,
+									connect.CodeOf(err).String(), tr.String(), labelSelector, sumBy.Name, vp.Name,
+								)
+								q.metrics.rangeCounter.WithLabelValues(
+									connect.CodeOf(err).String(), tr.String(), labelSelector, sumBy.Name, vp.Name,
+								).Inc()
+								log.Printf(
+									"range(query=%s,over=%s,labels=%s,sum_by=%s,viewport=%s): failed to make request: %v\n",
+									query,
+									tr,
+									labelSelector,
+									sumBy.Name,
+									vp.Name,
+									err,
+								)
+								return err
+							}
+
+							q.metrics.rangeHistogram.observe(
+								ctx, queryStart, latency,
+								grpcCodeOK, tr.String(),
+								labelSelector, sumBy.Name, vp.Name,
+							)
+							q.metrics.rangeCounter.WithLabelValues(
+								grpcCodeOK,
+								tr.String(),
+								labelSelector,
+								sumBy.Name,
+								vp.Name,
+							).Inc()
+							q.metrics.rangeSeriesHistogram.WithLabelValues(
+								tr.String(),
+								labelSelector,
+								sumBy.Name,
+								vp.Name,
+								stageOf(ctx),
+							).Observe(float64(len(resp.Msg.Series)))
+							log.Printf(
+								"range(query=%s,over=%s,labels=%s,sum_by=%s,viewport=%s): took %s and got %d series\n",
+								query, tr, labelSelector, sumBy.Name, vp.Name, latency, len(resp.Msg.Series),
+							)
+							// Only series that are not aggregated can be selected
+							// exactly by single-profile queries.
+							if (q.queries.Single.Kind.Enabled || w.mode(profileType) == ruleModeSingle) && len(labelNames) == 0 {
+								rq := rangeQuery{profileType: profileType, tr: tr, labelSelector: labelSelector}
+								q.singles.store(rq, resp.Msg.Series, q.queries.Single.Samples)
+							}
+							return nil
+						}})
+					}
+				}
+			}
 		}
+	}
+	return reqs
+}
 
-		exp := backoff.NewExponentialBackOff()
-		exp.MaxElapsedTime = interval
-		if err := backoff.Retry(operation, backoff.WithContext(exp, ctx)); err != nil {
-			continue
+// sumBy returns the label names to sum the series by. If the sum-by samples
+// label names but none are known for the profile type yet, they are fetched
+// with a Labels request first, unless a recent one listed none.
+func (q *Querier) sumBy(ctx context.Context, sumBy SumByConfig, profileType string, tr time.Duration) ([]string, error) {
+	if sumBy.SampleLabels == 0 {
+		return sumBy.Labels, nil
+	}
+
+	sampled := q.labelNames.sample(profileType, sumBy.SampleLabels)
+	if len(sampled) == 0 && q.labelNames.shouldLearn(profileType) {
+		if _, _, err := q.fetchLabels(ctx, profileType, tr); err != nil {
+			return nil, fmt.Errorf("fetch label names: %w", err)
 		}
+		sampled = q.labelNames.sample(profileType, sumBy.SampleLabels)
 	}
+	if len(sampled) == 0 {
+		return nil, fmt.Errorf("no label names known for %s to sum by", profileType)
+	}
+	return append(sumBy.Labels[:len(sumBy.Labels):len(sumBy.Labels)], sampled...), nil
 }
 
-func (q *Querier) queryRange(ctx context.Context) {
-	for _, profileType := range q.profileTypes {
-		for _, tr := range q.queryTimeRanges {
-			for _, labelSelector := range q.labelSelectors {
-				rangeEnd := time.Now()
-				rangeStart := rangeEnd.Add(-1 * tr)
+// mergeVariant is one combination of the options that merge queries are
+// made with for every profile type, range and selector.
+type mergeVariant struct {
+	reportType ReportType
+	groupBy    GroupByConfig
+	filterSet  FilterSetConfig
+	// viewport is nil if each request takes the next viewport in turn.
+	viewport *ViewportConfig
+}
 
-				query := profileType
-				if labelSelector != "all" {
-					query = profileType + labelSelector
-				}
+// mergeVariants returns every combination of the configured report types,
+// group-bys, filter sets and viewports. Besides the configured ones, the
+// profile is also requested ungrouped and unfiltered.
+func (q *Querier) mergeVariants() []mergeVariant {
+	groupBys := append([]GroupByConfig{{}}, q.queries.Merge.GroupBy...)
+	filterSets := append([]FilterSetConfig{{}}, q.queries.Merge.Filters...)
+	viewports := q.viewports()
 
-				queryStart := time.Now()
-				resp, err := q.client.QueryRange(
-					ctx, connect.NewRequest(
-						&queryv1alpha1.QueryRangeRequest{
-							Query: query,
-							Start: timestamppb.New(rangeStart),
-							End:   timestamppb.New(rangeEnd),
-							Step:  durationpb.New(time.Duration(tr.Nanoseconds() / numHorizontalPixelsOn8KDisplay)),
-						},
-					),
-				)
-				latency := time.Since(queryStart)
-				if err != nil {
-					q.metrics.rangeHistogram.WithLabelValues(
-						connect.CodeOf(err).String(), tr.String(), labelSelector,
-					).Observe(latency.Seconds())
-					q.metrics.rangeCounter.WithLabelValues(
-						connect.CodeOf(err).String(), tr.String(), labelSelector,
-					).Inc()
-					log.Printf(
-						"range(query=%s,over=%s,labels=%s): failed to make request: %v\n",
-						query,
-						tr,
-						labelSelector,
-						err,
-					)
-					continue
+	variants := make([]mergeVariant, 0, len(q.queries.Merge.ReportTypes)*len(groupBys)*len(filterSets)*len(viewports))
+	for _, reportType := range q.queries.Merge.ReportTypes {
+		for _, groupBy := range groupBys {
+			for _, filterSet := range filterSets {
+				for _, vp := range viewports {
+					variants = append(variants, mergeVariant{reportType: reportType, groupBy: groupBy, filterSet: filterSet, viewport: vp})
 				}
-
-				q.metrics.rangeHistogram.WithLabelValues(
-					grpcCodeOK, tr.String(),
-					labelSelector,
-				).Observe(latency.Seconds())
-				q.metrics.rangeCounter.WithLabelValues(
-					grpcCodeOK,
-					tr.String(),
-					labelSelector,
-				).Inc()
-				log.Printf(
-					"range(query=%s,over=%s,labels=%s): took %s and got %d series\n",
-					query, tr, labelSelector, latency, len(resp.Msg.Series),
-				)
 			}
 		}
 	}
+	return variants
 }
 
-func (q *Querier) queryMerge(ctx context.Context) {
-	for _, profileType := range q.profileTypes {
-		for _, tr := range q.queryTimeRanges {
-			for _, labelSelector := range q.labelSelectors {
-				rangeEnd := time.Now()
-				rangeStart := rangeEnd.Add(-1 * tr)
+// mergeGeneration changes whenever function names or single profiles of
+// another profile type become known.
+func (q *Querier) mergeGeneration() uint64 {
+	return q.functions.generation() + q.singles.generation()
+}
 
-				query := profileType
-				if labelSelector != "all" {
-					query = profileType + labelSelector
+// mergeRequests makes the merge queries of every profile type, range,
+// selector and variant. Profile types whose rule chooses the single mode are
+// queried at the most recent profile of the range instead, once range
+// queries returned any.
+func (q *Querier) mergeRequests() []request {
+	w := q.workload.Load()
+	variants := q.mergeVariants()
+	reqs := make([]request, 0, len(w.profileTypes)*len(w.queryTimeRanges)*len(w.labelSelectors)*len(variants))
+	for _, profileType := range w.profileTypesFor("merge") {
+		single := w.mode(profileType) == ruleModeSingle
+		for _, tr := range w.rangesFor(profileType) {
+			for _, labelSelector := range w.labelSelectors {
+				rq := rangeQuery{profileType: profileType, tr: tr, labelSelector: labelSelector}
+				if _, ok := q.singles.latest(rq); single && !ok {
+					continue
 				}
+				for _, v := range variants {
+					// Function names to filter by are sampled from earlier
+					// flamegraphs, so these filter sets wait for one that
+					// listed any.
+					if v.filterSet.SampleFunctions > 0 && !q.functions.known(profileType) {
+						continue
+					}
+					reqs = append(reqs, request{profileType: profileType, do: func(ctx context.Context) error {
+						vp := q.viewport(v.viewport)
+						rangeEnd := time.Now()
+						rangeStart := rangeEnd.Add(-1 * tr)
 
-				queryStart := time.Now()
-				_, err := q.client.Query(
-					ctx, connect.NewRequest(
-						&queryv1alpha1.QueryRequest{
-							Mode: queryv1alpha1.QueryRequest_MODE_MERGE,
-							Options: &queryv1alpha1.QueryRequest_Merge{
-								Merge: &queryv1alpha1.MergeProfile{
-									Query: query,
-									Start: timestamppb.New(rangeStart),
-									End:   timestamppb.New(rangeEnd),
+						query := profileType
+						if labelSelector != "all" {
+							query = profileType + labelSelector
+						}
+						merge := &queryv1alpha1.MergeProfile{
+							Query: query,
+							Start: timestamppb.New(rangeStart),
+							End:   timestamppb.New(rangeEnd),
+						}
+
+						labels := queryLabels{
+							mode:       "merge",
+							reportType: v.reportType,
+							tr:         tr.String(),
+							labels:     labelSelector,
+							filter:     v.filterSet.Name,
+							groupBy:    v.groupBy.Name,
+							viewport:   vp.Name,
+						}
+						filters, sandwich, err := q.filter(v.filterSet, profileType)
+						if err != nil {
+							log.Printf(
+								"merge(query=%s,report=%s,over=%s,labels=%s,filter=%s,group_by=%s,viewport=%s): failed to build filters: %v\n",
+								query, v.reportType, tr, labelSelector, v.filterSet.Name, v.groupBy.Name, vp.Name, err,
+							)
+							return err
+						}
+
+						req := &queryv1alpha1.QueryRequest{
+							Mode:               queryv1alpha1.QueryRequest_MODE_MERGE,
+							Options:            &queryv1alpha1.QueryRequest_Merge{Merge: merge},
+							ReportType:         v.reportType.proto(),
+							NodeTrimThreshold:  vp.nodeTrimThreshold(),
+							Filter:             filters,
+							SandwichByFunction: sandwich,
+							GroupBy:            v.groupBy.proto(),
+						}
+						if single {
+							point, ok := q.singles.latest(rq)
+							if !ok {
+								return fmt.Errorf("no profiles of %s returned by range queries to query", query)
+							}
+							query = point.query
+							labels.mode = "single"
+							req.Mode = queryv1alpha1.QueryRequest_MODE_SINGLE_UNSPECIFIED
+							req.Options = &queryv1alpha1.QueryRequest_Single{
+								Single: &queryv1alpha1.SingleProfile{
+									Query: point.query,
+									Time:  timestamppb.New(point.time),
 								},
-							},
-							ReportType:        queryv1alpha1.QueryRequest_REPORT_TYPE_FLAMEGRAPH_ARROW,
-							NodeTrimThreshold: &nodeTrimThreshold,
-						},
-					),
-				)
-				latency := time.Since(queryStart)
-				if err != nil {
-					q.metrics.mergeHistogram.WithLabelValues(
-						connect.CodeOf(err).String(), tr.String(),
-						labelSelector,
-					).Observe(latency.Seconds())
-					q.metrics.mergeCounter.WithLabelValues(
-						connect.CodeOf(err).String(),
-						tr.String(),
-						labelSelector,
-					).Inc()
-
-					log.Printf(
-						"merge(query=%s,over=%s,labels=%s): failed to make request: %v\n",
-						query, tr, labelSelector, err,
-					)
-					continue
-				}
+							}
+						}
 
-				q.metrics.mergeHistogram.WithLabelValues(
-					grpcCodeOK, tr.String(),
-					labelSelector,
-				).Observe(latency.Seconds())
-				q.metrics.mergeCounter.WithLabelValues(
-					grpcCodeOK,
-					tr.String(),
-					labelSelector,
-				).Inc()
+						queryStart := time.Now()
+						resp, err := q.client.Query(ctx, connect.NewRequest(req))
+						latency := time.Since(queryStart)
+						q.observeQuery(ctx, queryStart, latency, labels, resp, err)
+						if err != nil {
+							log.Printf(
+								"merge(query=%s,report=%s,over=%s,labels=%s,filter=%s,group_by=%s,viewport=%s): failed to make request: %v\n",
+								query, v.reportType, tr, labelSelector, v.filterSet.Name, v.groupBy.Name, vp.Name, err,
+							)
+							return err
+						}
+						if len(filters) == 0 && sandwich == nil && v.groupBy.Name == "" {
+							if fg := resp.Msg.GetFlamegraphArrow(); fg != nil {
+								q.storeFlamegraph(profileType, fg)
+							}
+						}
 
-				log.Printf(
-					"merge(query=%s,over=%s,labels=%s): took %s\n",
-					query, tr, labelSelector, latency,
-				)
+						log.Printf(
+							"merge(query=%s,report=%s,over=%s,labels=%s,filter=%s,group_by=%s,viewport=%s): took %s\n",
+							query, v.reportType, tr, labelSelector, v.filterSet.Name, v.groupBy.Name, vp.Name, latency,
+						)
+						return nil
+					}})
+				}
 			}
 		}
 	}
+	return reqs
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/query/v1alpha1/queryv1alpha1connect"
+	profilestorev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/profilestore/v1alpha1"
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// newTestQuerier returns a querier without clients and with a fresh summary,
+// and the context that its request limit cancels.
+func newTestQuerier(t *testing.T, limits LimitsConfig) (*Querier, context.Context) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Limits = limits
+	q := NewQuerier(prometheus.NewRegistry(), nil, nil, nil, cfg)
+	q.summary = &runSummary{}
+	q.summary.begin()
+
+	issue, stopIssuing := context.WithCancel(context.Background())
+	t.Cleanup(stopIssuing)
+	q.stopIssuing = stopIssuing
+	return q, issue
+}
+
+func TestTake(t *testing.T) {
+	q, issue := newTestQuerier(t, LimitsConfig{Requests: 3})
+	for i := 0; i < 3; i++ {
+		if !q.take() {
+			t.Fatalf("take() %d refused a request within the limit", i+1)
+		}
+	}
+	if issue.Err() == nil {
+		t.Error("using up the limit didn't stop issuing requests")
+	}
+	if q.take() {
+		t.Error("take() allowed a request beyond the limit")
+	}
+
+	unlimited, _ := newTestQuerier(t, LimitsConfig{})
+	for i := 0; i < 100; i++ {
+		if !unlimited.take() {
+			t.Fatal("take() refused a request without a limit")
+		}
+	}
+}
+
+// countingKind returns a kind with n requests that count how often they are
+// made and fail the first failures attempts.
+func countingKind(n, failures int, retry bool) (queryKind, *atomic.Int64) {
+	var made atomic.Int64
+	return queryKind{
+		name:  "test",
+		key:   "test",
+		conf:  QueryKindConfig{Enabled: true, Workers: 3, Concurrency: 1},
+		retry: retry,
+		requests: func() []request {
+			rs := make([]request, n)
+			for i := range rs {
+				rs[i] = request{do: func(context.Context) error {
+					if made.Add(1) <= int64(failures) {
+						return errors.New("failed")
+					}
+					return nil
+				}}
+			}
+			return rs
+		},
+	}, &made
+}
+
+func TestRoundRequestLimit(t *testing.T) {
+	q, issue := newTestQuerier(t, LimitsConfig{Requests: 5})
+	kind, made := countingKind(20, 0, false)
+
+	q.round(context.Background(), issue, kind, time.Second, time.Now())
+	if got := made.Load(); got != 5 {
+		t.Errorf("round made %d requests, want the limit of 5", got)
+	}
+	if got := len(q.summary.kinds["test"].latencies); got != 5 {
+		t.Errorf("summary counted %d requests, want 5", got)
+	}
+
+	// Once the limit is used up, later rounds don't send anything.
+	q.round(context.Background(), issue, kind, time.Second, time.Now())
+	if got := made.Load(); got != 5 {
+		t.Errorf("made %d requests after the limit was used up, want 5", got)
+	}
+}
+
+func TestRoundStopped(t *testing.T) {
+	q, issue := newTestQuerier(t, LimitsConfig{Requests: 5})
+	q.stopIssuing()
+	kind, made := countingKind(3, 0, false)
+
+	q.round(context.Background(), issue, kind, time.Second, time.Now())
+	if got := made.Load(); got != 0 {
+		t.Errorf("round made %d requests after issuing stopped", got)
+	}
+	if got := q.issued.Load(); got != 0 {
+		t.Errorf("round took %d requests from the limit after issuing stopped", got)
+	}
+}
+
+func TestRoundRetriesCountOnce(t *testing.T) {
+	q, issue := newTestQuerier(t, LimitsConfig{Requests: 10})
+	kind, made := countingKind(1, 2, true)
+
+	q.round(context.Background(), issue, kind, 10*time.Second, time.Now())
+	if got := made.Load(); got != 3 {
+		t.Fatalf("made %d attempts, want 3", got)
+	}
+	k := q.summary.kinds["test"]
+	if len(k.latencies) != 1 || k.errors != 0 {
+		t.Errorf("summary counted %d requests with %d errors, want 1 request without errors", len(k.latencies), k.errors)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	q, _ := newTestQuerier(t, LimitsConfig{Requests: 10, MaxErrorRatio: 0.2})
+	for i := 1; i <= 4; i++ {
+		q.summary.record("merge", time.Duration(i)*100*time.Millisecond, time.Duration(i)*time.Second, nil)
+	}
+	q.summary.record("labels", time.Second, time.Second, errors.New("failed"))
+
+	var out bytes.Buffer
+	if err := q.Summary(&out); err != nil {
+		t.Fatalf("Summary() = %v, want no error at an error ratio of 0.2", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Summary() wrote %d lines, want a header, two kinds and the total:\n%s", len(lines), out.String())
+	}
+	for i, want := range [][]string{
+		{"kind", "requests", "errors"},
+		{"labels", "1", "1"},
+		{"merge", "4", "0", "200ms", "400ms", "4s"},
+		{"total", "5", "1", "1s", "4s"},
+	} {
+		fields := strings.Fields(lines[i])
+		for _, w := range want {
+			found := false
+			for _, f := range fields {
+				found = found || f == w
+			}
+			if !found {
+				t.Errorf("line %q misses %q", lines[i], w)
+			}
+		}
+	}
+
+	q.summary.record("labels", time.Second, time.Second, errors.New("failed"))
+	if err := q.Summary(&bytes.Buffer{}); err == nil {
+		t.Error("Summary() returned no error at an error ratio of 1/3")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1 * time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 4 * time.Millisecond}
+	for _, tt := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0.5, 2 * time.Millisecond},
+		{0.75, 3 * time.Millisecond},
+		{0.99, 4 * time.Millisecond},
+		{1, 4 * time.Millisecond},
+		{0, time.Millisecond},
+	} {
+		if got := percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("percentile of no latencies = %v, want 0", got)
+	}
+}
+
+func TestRoundLateness(t *testing.T) {
+	q, issue := newTestQuerier(t, LimitsConfig{})
+	kind := queryKind{
+		name: "test",
+		conf: QueryKindConfig{Enabled: true, Workers: 1, Concurrency: 1},
+		requests: func() []request {
+			rs := make([]request, 3)
+			for i := range rs {
+				rs[i] = request{do: func(context.Context) error {
+					time.Sleep(20 * time.Millisecond)
+					return nil
+				}}
+			}
+			return rs
+		},
+	}
+
+	// The round is late by a second, and its requests are made one after the
+	// other by a single worker.
+	q.round(context.Background(), issue, kind, time.Second, time.Now().Add(-time.Second))
+	k := q.summary.kinds["test"]
+	if len(k.corrected) != 3 {
+		t.Fatalf("summary counted %d requests, want 3", len(k.corrected))
+	}
+	for i := range k.corrected {
+		waited := k.corrected[i] - k.latencies[i]
+		if waited < time.Second || waited > time.Second+15*time.Millisecond {
+			t.Errorf("request %d waited %v, want the second the round was late", i, waited)
+		}
+	}
+}
+
+// fakeQueryClient answers Labels requests with labelNames and counts them,
+// and keeps the Query requests it answers. Other methods aren't implemented.
+type fakeQueryClient struct {
+	queryv1alpha1connect.QueryServiceClient
+	labelNames []string
+	labels     atomic.Int64
+
+	mu      sync.Mutex
+	queries []*queryv1alpha1.QueryRequest
+}
+
+func (c *fakeQueryClient) Query(_ context.Context, req *connect.Request[queryv1alpha1.QueryRequest]) (*connect.Response[queryv1alpha1.QueryResponse], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries = append(c.queries, req.Msg)
+	return connect.NewResponse(&queryv1alpha1.QueryResponse{}), nil
+}
+
+func (c *fakeQueryClient) Labels(context.Context, *connect.Request[queryv1alpha1.LabelsRequest]) (*connect.Response[queryv1alpha1.LabelsResponse], error) {
+	c.labels.Add(1)
+	return connect.NewResponse(&queryv1alpha1.LabelsResponse{LabelNames: c.labelNames}), nil
+}
+
+func TestSumByBacksOff(t *testing.T) {
+	q, ctx := newTestQuerier(t, LimitsConfig{})
+	client := &fakeQueryClient{}
+	q.client = client
+	sumBy := SumByConfig{Name: "sampled", SampleLabels: 1}
+
+	// Without any label names, the profile type isn't asked again right away.
+	for i := 0; i < 3; i++ {
+		if _, err := q.sumBy(ctx, sumBy, testProfileType, time.Hour); err == nil {
+			t.Error("sumBy() sampled label names the profile type doesn't have")
+		}
+	}
+	if got := client.labels.Load(); got != 1 {
+		t.Errorf("sumBy() made %d Labels requests for a profile type without labels, want 1", got)
+	}
+
+	// Label names learned once are sampled without another request.
+	client.labelNames = []string{"job"}
+	const other = "goroutine:goroutine:count:goroutine:count"
+	for i := 0; i < 3; i++ {
+		got, err := q.sumBy(ctx, sumBy, other, time.Hour)
+		if err != nil || !slices.Equal(got, []string{"job"}) {
+			t.Errorf("sumBy() = %q, %v, want [job]", got, err)
+		}
+	}
+	if got := client.labels.Load(); got != 2 {
+		t.Errorf("sumBy() made %d Labels requests in total, want 2", got)
+	}
+}
+
+func TestMergeRequestsSingleMode(t *testing.T) {
+	q, ctx := newTestQuerier(t, LimitsConfig{})
+	client := &fakeQueryClient{}
+	q.client = client
+	q.queries.Merge.ReportTypes = []ReportType{reportTypeFlamegraphArrow}
+	q.workload.Store(&workload{
+		profileTypes:    []string{testProfileType},
+		queryTimeRanges: []time.Duration{time.Hour},
+		labelSelectors:  []string{"all"},
+		rules:           defaultProfileTypeRules(),
+	})
+
+	if got := len(q.mergeRequests()); got != 0 {
+		t.Errorf("mergeRequests() = %d requests before range queries returned profiles, want 0", got)
+	}
+
+	generation := q.mergeGeneration()
+	at := time.Unix(1700000000, 0)
+	rq := rangeQuery{profileType: testProfileType, tr: time.Hour, labelSelector: "all"}
+	q.singles.store(rq, []*queryv1alpha1.MetricsSeries{{
+		Labelset: &profilestorev1alpha1.LabelSet{Labels: []*profilestorev1alpha1.Label{{Name: "job", Value: "a"}}},
+		Samples: []*queryv1alpha1.MetricsSample{
+			{Timestamp: timestamppb.New(at.Add(-time.Minute))},
+			{Timestamp: timestamppb.New(at)},
+		},
+	}}, 2)
+	if q.mergeGeneration() == generation {
+		t.Error("mergeGeneration() didn't change once profiles were known")
+	}
+
+	reqs := q.mergeRequests()
+	if len(reqs) == 0 {
+		t.Fatal("mergeRequests() = no requests once range queries returned profiles")
+	}
+	if err := reqs[0].do(ctx); err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	sent := client.queries[0]
+	if sent.GetMode() != queryv1alpha1.QueryRequest_MODE_SINGLE_UNSPECIFIED {
+		t.Errorf("sent a query in mode %s, want a single profile", sent.GetMode())
+	}
+	single := sent.GetSingle()
+	if single.GetQuery() != testProfileType+`{job="a"}` || !single.GetTime().AsTime().Equal(at) {
+		t.Errorf("queried %s at %s, want the most recent profile", single.GetQuery(), single.GetTime().AsTime())
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"slices"
+	"time"
+
+	profilestorev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/profilestore/v1alpha1"
+)
+
+// The records of the Write stream follow the schema of Parca Agent: a record
+// of samples that refer to their stacks by ID, and on request of the server
+// a record of the stacktraces it doesn't know yet.
+
+// Columns of the samples record besides the labels, whose columns are
+// prefixed by agentLabelPrefix.
+const (
+	agentLabelPrefix      = "labels."
+	agentStacktraceID     = "stacktrace_id"
+	agentValue            = "value"
+	agentProducer         = "producer"
+	agentSampleType       = "sample_type"
+	agentSampleUnit       = "sample_unit"
+	agentPeriodType       = "period_type"
+	agentPeriodUnit       = "period_unit"
+	agentTemporality      = "temporality"
+	agentPeriod           = "period"
+	agentDuration         = "duration"
+	agentTimestamp        = "timestamp"
+	agentIsComplete       = "is_complete"
+	agentLocations        = "locations"
+	agentLines            = "lines"
+	agentProducerName     = "parca_agent"
+	agentTemporalityDelta = "delta"
+)
+
+var (
+	arrowBinary = arrowField{typ: arrowTypeBinary}
+	arrowInt64  = arrowField{typ: arrowTypeInt, bitWidth: 64, signed: true}
+	arrowUint64 = arrowField{typ: arrowTypeInt, bitWidth: 64}
+	arrowBool   = arrowField{typ: arrowTypeBool}
+)
+
+func withName(f arrowField, name string) arrowField {
+	f.name = name
+	return f
+}
+
+// agentSample is a row of the samples record: the summed values of a stack
+// in a series.
+type agentSample struct {
+	labels       *profilestorev1alpha1.LabelSet
+	stacktraceID string
+	value        int64
+}
+
+// stacktraceID identifies a stack of synthetic functions, like the agents
+// identify stacks by a 16 byte hash of their frames.
+func stacktraceID(functions []int) string {
+	h := fnv.New128a()
+	var b []byte
+	for _, f := range functions {
+		b = binary.LittleEndian.AppendUint64(b[:0], uint64(f))
+		_, _ = h.Write(b)
+	}
+	return string(h.Sum(nil))
+}
+
+// agentSamples sums the samples of every series by stack. It returns the
+// rows in the order their stacks first appeared, and the stacks by ID.
+func agentSamples(labelSets []*profilestorev1alpha1.LabelSet, samples func() []syntheticSample) ([]agentSample, map[string][]int) {
+	var rows []agentSample
+	stacks := map[string][]int{}
+	for _, ls := range labelSets {
+		index := map[string]int{}
+		for _, s := range samples() {
+			id := stacktraceID(s.functions)
+			stacks[id] = s.functions
+			if i, ok := index[id]; ok {
+				rows[i].value += s.value
+				continue
+			}
+			index[id] = len(rows)
+			rows = append(rows, agentSample{labels: ls, stacktraceID: id, value: s.value})
+		}
+	}
+	return rows, stacks
+}
+
+// arrowDictionaries numbers the dictionary-encoded columns of a record and
+// collects their values.
+type arrowDictionaries struct {
+	dicts []*stringDictionary
+}
+
+// column returns a column of binary values encoded in a new dictionary. The
+// values at which valid is false are null, and a nil valid has no nulls.
+func (d *arrowDictionaries) column(name string, values []string, valid []bool) arrowArray {
+	f := arrowField{name: name, typ: arrowTypeBinary, dictionary: &arrowDictionary{id: int64(len(d.dicts)), bitWidth: 32}}
+	dict := &stringDictionary{}
+	d.dicts = append(d.dicts, dict)
+	indices := make([]int64, len(values))
+	for i, v := range values {
+		if valid == nil || valid[i] {
+			indices[i] = dict.index(v)
+		}
+	}
+	return newIntArray(f, indices, valid)
+}
+
+// encode returns the stream of the schema of the arrays, their dictionaries
+// and a record batch of them.
+func (d *arrowDictionaries) encode(length int, arrays ...arrowArray) []byte {
+	fields := make([]arrowField, len(arrays))
+	for i, a := range arrays {
+		fields[i] = a.field
+	}
+	stream := appendSchema(nil, fields...)
+	for id, dict := range d.dicts {
+		stream = appendDictionary(stream, int64(id), false, newBinaryArray(arrowBinary, dict.values))
+	}
+	stream = appendRecordBatch(stream, length, arrays...)
+	return appendEndOfStream(stream)
+}
+
+// encodeAgentSamples returns the samples record of synthetic CPU profiles of
+// duration that end at end. Series without one of the label names have a
+// null in its column.
+func encodeAgentSamples(rows []agentSample, end time.Time, duration time.Duration) []byte {
+	var names []string
+	for _, row := range rows {
+		for _, l := range row.labels.GetLabels() {
+			if !slices.Contains(names, l.Name) {
+				names = append(names, l.Name)
+			}
+		}
+	}
+	slices.Sort(names)
+
+	var d arrowDictionaries
+	var arrays []arrowArray
+	for _, name := range names {
+		values := make([]string, len(rows))
+		valid := make([]bool, len(rows))
+		for i, row := range rows {
+			for _, l := range row.labels.GetLabels() {
+				if l.Name == name {
+					values[i], valid[i] = l.Value, true
+				}
+			}
+		}
+		arrays = append(arrays, d.column(agentLabelPrefix+name, values, valid))
+	}
+
+	constant := func(name, value string) arrowArray {
+		values := make([]string, len(rows))
+		for i := range values {
+			values[i] = value
+		}
+		return d.column(name, values, nil)
+	}
+	ints := func(name string, value func(i int) int64) arrowArray {
+		values := make([]int64, len(rows))
+		for i := range values {
+			values[i] = value(i)
+		}
+		return newIntArray(withName(arrowInt64, name), values, nil)
+	}
+
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row.stacktraceID
+	}
+	arrays = append(arrays,
+		d.column(agentStacktraceID, ids, nil),
+		ints(agentValue, func(i int) int64 { return rows[i].value }),
+		constant(agentProducer, agentProducerName),
+		constant(agentSampleType, "samples"),
+		constant(agentSampleUnit, "count"),
+		constant(agentPeriodType, "cpu"),
+		constant(agentPeriodUnit, "nanoseconds"),
+		constant(agentTemporality, agentTemporalityDelta),
+		ints(agentPeriod, func(int) int64 { return syntheticPeriod }),
+		ints(agentDuration, func(int) int64 { return int64(duration) }),
+		ints(agentTimestamp, func(int) int64 { return end.UnixNano() }),
+	)
+	return d.encode(len(rows), arrays...)
+}
+
+// encodeAgentStacktraces returns the stacktraces record of the stacks with
+// the given IDs. Every frame is a location with a single line.
+func encodeAgentStacktraces(conf SyntheticProfileConfig, ids []string, stacks map[string][]int) []byte {
+	var (
+		locationOffsets = []int32{0}
+		addresses       []int64
+		mappingStarts   []int64
+		mappingLimits   []int64
+		mappingOffsets  []int64
+		mappingFiles    []string
+		buildIDs        []string
+		lines           []int64
+		functionNames   []string
+		filenames       []string
+	)
+	for _, id := range ids {
+		for _, f := range stacks[id] {
+			sf := newSyntheticFunction(conf, f)
+			sm := newSyntheticMapping(sf.mapping)
+			addresses = append(addresses, int64(sf.address))
+			mappingStarts = append(mappingStarts, int64(sm.start))
+			mappingLimits = append(mappingLimits, int64(sm.limit))
+			mappingOffsets = append(mappingOffsets, 0)
+			mappingFiles = append(mappingFiles, sm.file)
+			buildIDs = append(buildIDs, sm.buildID)
+			lines = append(lines, sf.line)
+			functionNames = append(functionNames, sf.name)
+			filenames = append(filenames, sf.filename)
+		}
+		locationOffsets = append(locationOffsets, int32(len(addresses)))
+	}
+	n := len(addresses)
+	lineOffsets := make([]int32, n+1)
+	for i := range lineOffsets {
+		lineOffsets[i] = int32(i)
+	}
+
+	var d arrowDictionaries
+	line := newStructArray(arrowField{name: "item", typ: arrowTypeStruct}, n,
+		newIntArray(withName(arrowInt64, "line"), lines, nil),
+		d.column("function_name", functionNames, nil),
+		d.column("function_system_name", functionNames, nil),
+		d.column("function_filename", filenames, nil),
+		newIntArray(withName(arrowInt64, "function_start_line"), lines, nil),
+	)
+	location := newStructArray(arrowField{name: "item", typ: arrowTypeStruct}, n,
+		newIntArray(withName(arrowUint64, "address"), addresses, nil),
+		newIntArray(withName(arrowUint64, "mapping_start"), mappingStarts, nil),
+		newIntArray(withName(arrowUint64, "mapping_limit"), mappingLimits, nil),
+		newIntArray(withName(arrowUint64, "mapping_offset"), mappingOffsets, nil),
+		d.column("mapping_file", mappingFiles, nil),
+		d.column("mapping_build_id", buildIDs, nil),
+		newListArray(arrowField{name: agentLines, typ: arrowTypeList}, lineOffsets, line),
+	)
+
+	complete := make([]bool, len(ids))
+	for i := range complete {
+		complete[i] = true
+	}
+	return d.encode(len(ids),
+		newBinaryArray(withName(arrowBinary, agentStacktraceID), ids),
+		newListArray(arrowField{name: agentLocations, typ: arrowTypeList}, locationOffsets, location),
+		newBoolArray(withName(arrowBool, agentIsComplete), complete),
+	)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	profilestorev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/profilestore/v1alpha1"
+)
+
+func TestAgentSamples(t *testing.T) {
+	labelSets := []*profilestorev1alpha1.LabelSet{
+		{Labels: []*profilestorev1alpha1.Label{{Name: "__name__", Value: "parca_load"}, {Name: "instance", Value: "a"}}},
+		{Labels: []*profilestorev1alpha1.Label{{Name: "__name__", Value: "parca_load"}}},
+	}
+	samples := func() []syntheticSample {
+		return []syntheticSample{
+			{functions: []int{1, 0}, value: 2},
+			{functions: []int{2, 0}, value: 1},
+			{functions: []int{1, 0}, value: 3},
+		}
+	}
+
+	rows, stacks := agentSamples(labelSets, samples)
+	if len(rows) != 4 || len(stacks) != 2 {
+		t.Fatalf("agentSamples() = %d rows of %d stacks, want 4 rows of 2 stacks", len(rows), len(stacks))
+	}
+	if rows[0].value != 5 || rows[1].value != 1 || rows[0].labels != labelSets[0] || rows[2].labels != labelSets[1] {
+		t.Errorf("agentSamples() didn't sum the samples of each series by stack: %+v", rows)
+	}
+	if rows[0].stacktraceID != rows[2].stacktraceID || rows[0].stacktraceID == rows[1].stacktraceID {
+		t.Error("agentSamples() didn't give the same stacks the same ID across series")
+	}
+
+	record := encodeAgentSamples(rows, time.Unix(0, 0), time.Second)
+	columns, err := readArrowStrings(record, "labels.__name__", "labels.instance", agentStacktraceID, agentProducer, agentTemporality)
+	if err != nil {
+		t.Fatalf("readArrowStrings() of the samples record error = %v", err)
+	}
+	if got := columns["labels.instance"]; !slices.Equal(got, []string{"a", "a", "", ""}) {
+		t.Errorf("labels.instance = %q, want the series without it to be null", got)
+	}
+	if got := columns["labels.__name__"]; !slices.Equal(got, []string{"parca_load", "parca_load", "parca_load", "parca_load"}) {
+		t.Errorf("labels.__name__ = %q", got)
+	}
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row.stacktraceID
+	}
+	if got := columns[agentStacktraceID]; !slices.Equal(got, ids) {
+		t.Errorf("%s = %x, want %x", agentStacktraceID, got, ids)
+	}
+	if got := columns[agentProducer]; len(got) != 4 || got[0] != agentProducerName {
+		t.Errorf("%s = %q, want %s", agentProducer, got, agentProducerName)
+	}
+	if got := columns[agentTemporality]; len(got) != 4 || got[3] != agentTemporalityDelta {
+		t.Errorf("%s = %q, want %s", agentTemporality, got, agentTemporalityDelta)
+	}
+}
+
+func TestEncodeAgentStacktraces(t *testing.T) {
+	conf := defaultConfig().Write.Profile
+	stacks := map[string][]int{
+		stacktraceID([]int{3, 1, 0}): {3, 1, 0},
+		stacktraceID([]int{2}):       {2},
+	}
+	ids := []string{stacktraceID([]int{2}), stacktraceID([]int{3, 1, 0})}
+
+	// Reading the IDs reads the nested locations and lines of every row as
+	// well, so their buffers must add up.
+	columns, err := readArrowStrings(encodeAgentStacktraces(conf, ids, stacks), agentStacktraceID)
+	if err != nil {
+		t.Fatalf("readArrowStrings() of the stacktraces record error = %v", err)
+	}
+	if got := columns[agentStacktraceID]; !slices.Equal(got, ids) {
+		t.Errorf("%s = %x, want %x", agentStacktraceID, got, ids)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// configReloader reloads the workload file into the querier when SIGHUP is
+// received or when the content of the file changes.
+type configReloader struct {
+	path     string
+	interval time.Duration
+	querier  *Querier
+	// limitFlags applies the limits given as flags, which take precedence
+	// over the limits of the file.
+	limitFlags func(*Config)
+
+	lastSuccessful prometheus.Gauge
+	lastSuccess    prometheus.Gauge
+	reloads        *prometheus.CounterVec
+
+	// content is the file content that was last loaded successfully.
+	content []byte
+}
+
+func newConfigReloader(
+	reg *prometheus.Registry,
+	path string,
+	interval time.Duration,
+	querier *Querier,
+	limitFlags func(*Config),
+) (*configReloader, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &configReloader{
+		path:       path,
+		interval:   interval,
+		querier:    querier,
+		limitFlags: limitFlags,
+		content:    content,
+		lastSuccessful: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name: "parca_client_config_last_reload_successful",
+				Help: "Whether the last reload of the workload file was successful",
+			},
+		),
+		lastSuccess: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name: "parca_client_config_last_reload_success_timestamp_seconds",
+				Help: "Timestamp of the last successful load of the workload file",
+			},
+		),
+		reloads: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "parca_client_config_reloads_total",
+				Help: "Total number of reloads of the workload file by result: success, partial if changes that need a restart were not applied, or failure",
+			},
+			[]string{"result"},
+		),
+	}
+	r.lastSuccessful.Set(1)
+	r.lastSuccess.SetToCurrentTime()
+	return r, nil
+}
+
+// Run reloads the workload file until the context is cancelled. If the
+// interval is zero, the file is only reloaded on SIGHUP.
+func (r *configReloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var watch <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		watch = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("reload: received SIGHUP")
+			r.reload(ctx, true)
+		case <-watch:
+			r.reload(ctx, false)
+		}
+	}
+}
+
+// reload loads the workload file and passes it to the querier. Unless forced,
+// the file is only loaded if its content changed.
+func (r *configReloader) reload(ctx context.Context, force bool) {
+	content, err := os.ReadFile(r.path)
+	if err == nil && !force && bytes.Equal(content, r.content) {
+		return
+	}
+
+	var unapplied []string
+	if err == nil {
+		var cfg *Config
+		cfg, err = parseConfig(content)
+		if err == nil {
+			r.limitFlags(cfg)
+			unapplied, err = r.querier.Reload(ctx, cfg)
+		}
+	}
+	// Remember the content even if it is broken, so that a broken file is
+	// only reported once and not on every check.
+	r.content = content
+	if err != nil {
+		r.lastSuccessful.Set(0)
+		r.reloads.WithLabelValues("failure").Inc()
+		log.Printf("reload: failed to reload %s: %v\n", r.path, err)
+		return
+	}
+
+	// The workload was replaced even if other changes were not applied.
+	r.lastSuccessful.Set(1)
+	r.lastSuccess.SetToCurrentTime()
+	if len(unapplied) > 0 {
+		r.reloads.WithLabelValues("partial").Inc()
+		log.Printf("reload: reloaded the workload of %s, changes to %s need a restart\n", r.path, strings.Join(unapplied, ", "))
+		return
+	}
+	r.reloads.WithLabelValues("success").Inc()
+	log.Printf("reload: reloaded %s\n", r.path)
+}
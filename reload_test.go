@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConfigReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workload.yaml")
+	write := func(profileType, interval string) {
+		t.Helper()
+		content := []byte("version: 1\nprofileTypes: [" + profileType + "]\nschedule:\n  interval: " + interval + "\n")
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("cpu:samples:count:cpu:nanoseconds:delta", "10s")
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseConfig(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	q := NewQuerier(reg, nil, nil, nil, cfg)
+	r, err := newConfigReloader(reg, path, 0, q, func(*Config) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	count := func(result string) float64 {
+		return testutil.ToFloat64(r.reloads.WithLabelValues(result))
+	}
+
+	// An unchanged file is not reloaded unless forced.
+	r.reload(ctx, false)
+	if got := count("success"); got != 0 {
+		t.Errorf("reloaded an unchanged file %v times", got)
+	}
+
+	write("memory:inuse_space:bytes:space:bytes", "10s")
+	r.reload(ctx, false)
+	if got := count("success"); got != 1 {
+		t.Errorf("success count = %v, want 1", got)
+	}
+	if got := q.workload.Load().profileTypes; !slices.Equal(got, []string{"memory:inuse_space:bytes:space:bytes"}) {
+		t.Errorf("profile types after reload = %v", got)
+	}
+
+	// The workload is applied while the schedule is not.
+	write("goroutine:goroutine:count:goroutine:count", "1m")
+	r.reload(ctx, false)
+	if got := count("partial"); got != 1 {
+		t.Errorf("partial count = %v, want 1", got)
+	}
+	if got := q.workload.Load().profileTypes; !slices.Equal(got, []string{"goroutine:goroutine:count:goroutine:count"}) {
+		t.Errorf("profile types after partial reload = %v", got)
+	}
+	if q.schedule.Interval != cfg.Schedule.Interval {
+		t.Errorf("interval changed to %v at runtime", q.schedule.Interval)
+	}
+
+	// Reloading the same change reports it as partial again without logging
+	// it anew, and reverting it makes reloads succeed again.
+	unapplied, err := q.Reload(ctx, q.reloaded)
+	if err != nil || !slices.Equal(unapplied, []string{"schedule"}) {
+		t.Errorf("Reload() = %v, %v, want [schedule]", unapplied, err)
+	}
+	write("goroutine:goroutine:count:goroutine:count", "10s")
+	r.reload(ctx, false)
+	if got := count("success"); got != 2 {
+		t.Errorf("success count = %v, want 2", got)
+	}
+
+	write("[", "10s")
+	r.reload(ctx, false)
+	if got := count("failure"); got != 1 {
+		t.Errorf("failure count = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(r.lastSuccessful); got != 0 {
+		t.Errorf("last reload successful = %v, want 0", got)
+	}
+}
+
+func TestUnappliedSections(t *testing.T) {
+	base := defaultConfig()
+
+	cfg := defaultConfig()
+	cfg.Queries.Values.Labels = []string{"job"}
+	cfg.ProfileTypes = []ProfileTypeString{"cpu:samples:count:cpu:nanoseconds:delta"}
+	if got := (&Querier{}).unappliedSections(base, cfg); len(got) != 0 {
+		t.Errorf("workload changes are reported as unapplied: %v", got)
+	}
+
+	cfg.Limits.Requests = 10
+	cfg.Mix.Seed = 1
+	if got := (&Querier{}).unappliedSections(base, cfg); !slices.Equal(got, []string{"limits", "mix"}) {
+		t.Errorf("unappliedSections() = %v, want [limits mix]", got)
+	}
+}
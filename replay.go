@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// replayProfile is a captured pprof profile.
+type replayProfile struct {
+	name string
+	// raw is the uncompressed profile without its time, which is set when
+	// it is written.
+	raw []byte
+	// taken is when the profile was taken, or the zero time if unknown.
+	taken time.Time
+}
+
+// isReplayProfile reports whether the file is a pprof profile to replay.
+func isReplayProfile(name string) bool {
+	return strings.HasSuffix(name, ".pb.gz") || strings.HasSuffix(name, ".pb")
+}
+
+// loadReplayProfiles reads the profiles of a directory or tarball, ordered
+// by when they were taken. All of them are kept in memory uncompressed.
+func loadReplayProfiles(path string) ([]replayProfile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []replayProfile
+	add := func(name string, r io.Reader) error {
+		p, err := readReplayProfile(name, r)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		profiles = append(profiles, p)
+		return nil
+	}
+
+	if info.IsDir() {
+		err = filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !isReplayProfile(name) {
+				return err
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return add(name, f)
+		})
+	} else {
+		err = readTar(path, func(name string, r io.Reader) error {
+			if !isReplayProfile(name) {
+				return nil
+			}
+			return add(name, r)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no .pb.gz or .pb profiles found in %s", path)
+	}
+
+	slices.SortStableFunc(profiles, func(a, b replayProfile) int {
+		if c := a.taken.Compare(b.taken); c != 0 {
+			return c
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	return profiles, nil
+}
+
+// readTar calls fn for every regular file of the tarball, which may be
+// gzipped.
+func readTar(path string, fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// readReplayProfile reads a profile, which is decompressed if it is gzipped.
+func readReplayProfile(name string, r io.Reader) (replayProfile, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return replayProfile{}, err
+	}
+	if bytes.HasPrefix(raw, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return replayProfile{}, err
+		}
+		if raw, err = io.ReadAll(zr); err != nil {
+			return replayProfile{}, err
+		}
+	}
+
+	p := replayProfile{name: name, raw: make([]byte, 0, len(raw))}
+	for b := raw; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return replayProfile{}, fmt.Errorf("not a pprof profile: %w", protowire.ParseError(n))
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return replayProfile{}, fmt.Errorf("not a pprof profile: %w", protowire.ParseError(m))
+		}
+		if num == pprofProfileTimeNanos && typ == protowire.VarintType {
+			v, _ := protowire.ConsumeVarint(b[n:])
+			p.taken = time.Unix(0, int64(v))
+		} else {
+			p.raw = append(p.raw, b[:n+m]...)
+		}
+		b = b[n+m:]
+	}
+	return p, nil
+}
+
+// at returns the gzipped profile as if it was taken at t.
+func (p replayProfile) at(t time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(appendVarintField(p.raw[:len(p.raw):len(p.raw)], pprofProfileTimeNanos, uint64(t.UnixNano()))); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runReplay writes the captured profiles in the order they were taken, with
+// the time between them compressed by the replay speed, and starts over
+// after the last one. Profiles whose time is unknown are written at the
+// configured rate.
+func (w *Writer) runReplay(ctx context.Context, wg *sync.WaitGroup, inflight chan struct{}) {
+	profiles := w.replay
+	log.Printf(
+		"write: replaying %d profiles of %s at %gx speed to %d series\n",
+		len(profiles), w.conf.Replay.Path, w.conf.Replay.Speed, len(w.labelSets),
+	)
+
+	interval := time.Duration(float64(time.Second) / w.conf.Rate)
+	next := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		for i, p := range profiles {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			scheduled := next
+			// Every series gets the same profile, so it is only encoded once.
+			ctx := withScheduled(ctx, scheduled)
+			profile := sync.OnceValues(func() ([]byte, error) {
+				return p.at(time.Now())
+			})
+			w.dispatch(wg, inflight, func() {
+				_ = w.write(ctx, p.name, profile)
+			})
+
+			gap := interval
+			if i+1 < len(profiles) && !p.taken.IsZero() && !profiles[i+1].taken.IsZero() {
+				gap = time.Duration(float64(profiles[i+1].taken.Sub(p.taken)) / w.conf.Replay.Speed)
+			}
+			next = next.Add(gap)
+			timer.Reset(time.Until(next))
+		}
+	}
+}
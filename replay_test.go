@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReplayProfile returns a gzipped synthetic profile taken at the given
+// time, which is when the profile starts.
+func testReplayProfile(t *testing.T, taken time.Time) []byte {
+	t.Helper()
+	conf := SyntheticProfileConfig{Functions: 20, Mappings: 2, StackDepth: 4, Samples: 10, Seed: 1}
+	gz, err := newProfileGenerator(conf).generate(taken.Add(10*time.Second), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gz
+}
+
+func TestReadReplayProfile(t *testing.T) {
+	taken := time.Unix(1700000000, 0)
+	gz := testReplayProfile(t, taken)
+	raw := gunzip(t, gz)
+
+	for name, content := range map[string][]byte{"gzipped": gz, "uncompressed": raw} {
+		p, err := readReplayProfile(name, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("readReplayProfile(%s) error = %v", name, err)
+		}
+		if !p.taken.Equal(taken) {
+			t.Errorf("readReplayProfile(%s) taken = %s, want %s", name, p.taken, taken)
+		}
+		for _, f := range decodeFields(t, p.raw) {
+			if f.num == pprofProfileTimeNanos {
+				t.Errorf("readReplayProfile(%s) kept the time of the profile", name)
+			}
+		}
+	}
+
+	if _, err := readReplayProfile("broken", strings.NewReader("\xff\xff")); err == nil {
+		t.Error("readReplayProfile() of a file that isn't a profile succeeded")
+	}
+}
+
+func TestReplayProfileAt(t *testing.T) {
+	original := decodeFields(t, gunzip(t, testReplayProfile(t, time.Unix(1700000000, 0))))
+	p, err := readReplayProfile("cpu.pb.gz", bytes.NewReader(testReplayProfile(t, time.Unix(1700000000, 0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := time.Unix(1800000000, 5)
+	gz, err := p.at(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []uint64
+	var rest, want []protoField
+	for _, f := range decodeFields(t, gunzip(t, gz)) {
+		if f.num == pprofProfileTimeNanos {
+			times = append(times, f.value)
+			continue
+		}
+		rest = append(rest, f)
+	}
+	for _, f := range original {
+		if f.num != pprofProfileTimeNanos {
+			want = append(want, f)
+		}
+	}
+	if !slices.Equal(times, []uint64{uint64(sent.UnixNano())}) {
+		t.Errorf("at() time_nanos = %v, want only %d", times, sent.UnixNano())
+	}
+	if !slices.EqualFunc(rest, want, func(a, b protoField) bool {
+		return a.num == b.num && a.value == b.value && bytes.Equal(a.bytes, b.bytes)
+	}) {
+		t.Error("at() changed more of the profile than its time")
+	}
+
+	// Rewriting the time again must not pile up time fields, nor change the
+	// profile kept in memory.
+	if _, err := p.at(sent.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := p.at(sent); !bytes.Equal(gunzip(t, again), gunzip(t, gz)) {
+		t.Error("at() changed the profile kept in memory")
+	}
+}
+
+func TestLoadReplayProfiles(t *testing.T) {
+	files := map[string][]byte{
+		"later.pb":          gunzip(t, testReplayProfile(t, time.Unix(1700000060, 0))),
+		"sub/earlier.pb.gz": testReplayProfile(t, time.Unix(1700000000, 0)),
+		"README.md":         []byte("not a profile"),
+	}
+	want := []string{"sub/earlier.pb.gz", "later.pb"}
+
+	dir := t.TempDir()
+	var tarball bytes.Buffer
+	zw := gzip.NewWriter(&tarball)
+	tw := tar.NewWriter(zw)
+	for name, content := range files {
+		path := filepath.Join(dir, "profiles", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "profiles.tgz"), tarball.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{filepath.Join(dir, "profiles"), filepath.Join(dir, "profiles.tgz")} {
+		profiles, err := loadReplayProfiles(path)
+		if err != nil {
+			t.Fatalf("loadReplayProfiles(%s) error = %v", path, err)
+		}
+		var names []string
+		for _, p := range profiles {
+			// Files of a directory are named by their path, and those of a
+			// tarball by their name in it.
+			names = append(names, filepath.ToSlash(strings.TrimPrefix(p.name, filepath.Join(dir, "profiles")+string(filepath.Separator))))
+		}
+		if !slices.Equal(names, want) {
+			t.Errorf("loadReplayProfiles(%s) = %q, want the profiles in the order they were taken %q", path, names, want)
+		}
+	}
+
+	empty := t.TempDir()
+	if _, err := loadReplayProfiles(empty); err == nil || !strings.Contains(err.Error(), "no .pb.gz or .pb profiles") {
+		t.Errorf("loadReplayProfiles() of an empty directory error = %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// matches reports whether the profile type, in the form
+// name:sample_type:sample_unit:period_type:period_unit[:delta], is matched.
+func (m ProfileTypeMatch) matches(profileType string) bool {
+	parts := strings.Split(profileType, ":")
+	if m.Name != "" && m.Name != profileType && m.Name != parts[0] {
+		return false
+	}
+	if m.SampleType != "" && (len(parts) < 2 || m.SampleType != parts[1]) {
+		return false
+	}
+	if m.Delta != nil && *m.Delta != strings.HasSuffix(profileType, ":delta") {
+		return false
+	}
+	return true
+}
+
+// rule returns the first rule that matches the profile type, or nil if none
+// does.
+func (w *workload) rule(profileType string) *ProfileTypeRule {
+	for i := range w.rules {
+		if w.rules[i].Match.matches(profileType) {
+			return &w.rules[i]
+		}
+	}
+	return nil
+}
+
+// profileTypesFor returns the profile types that requests of the kind are made
+// for, leaving out those whose rule excludes the kind.
+func (w *workload) profileTypesFor(kind string) []string {
+	types := make([]string, 0, len(w.profileTypes))
+	for _, profileType := range w.profileTypes {
+		if r := w.rule(profileType); r == nil || !r.excludes(kind) {
+			types = append(types, profileType)
+		}
+	}
+	return types
+}
+
+// mode returns how merge queries of the profile type are made.
+func (w *workload) mode(profileType string) string {
+	if r := w.rule(profileType); r != nil && r.Mode != "" {
+		return r.Mode
+	}
+	return ruleModeMerge
+}
+
+// rangesFor returns the query time ranges of the profile type, leaving out
+// those longer than the maximum range of its rule.
+func (w *workload) rangesFor(profileType string) []time.Duration {
+	r := w.rule(profileType)
+	if r == nil || r.MaxRange == 0 {
+		return w.queryTimeRanges
+	}
+	ranges := make([]time.Duration, 0, len(w.queryTimeRanges))
+	for _, tr := range w.queryTimeRanges {
+		if tr <= time.Duration(r.MaxRange) {
+			ranges = append(ranges, tr)
+		}
+	}
+	return ranges
+}
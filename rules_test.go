@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestProfileTypeMatch(t *testing.T) {
+	const (
+		cpu       = "parca_agent:samples:count:cpu:nanoseconds:delta"
+		inuse     = "memory:inuse_space:bytes:space:bytes"
+		goroutine = "goroutine:goroutine:count:goroutine:count"
+	)
+	yes, no := true, false
+	tests := []struct {
+		name  string
+		match ProfileTypeMatch
+		want  []string
+	}{
+		{name: "empty", match: ProfileTypeMatch{}, want: []string{cpu, inuse, goroutine}},
+		{name: "name", match: ProfileTypeMatch{Name: "memory"}, want: []string{inuse}},
+		{name: "whole profile type", match: ProfileTypeMatch{Name: cpu}, want: []string{cpu}},
+		{name: "sample type", match: ProfileTypeMatch{SampleType: "goroutine"}, want: []string{goroutine}},
+		{name: "delta", match: ProfileTypeMatch{Delta: &yes}, want: []string{cpu}},
+		{name: "not delta", match: ProfileTypeMatch{Delta: &no}, want: []string{inuse, goroutine}},
+		{name: "all fields", match: ProfileTypeMatch{Name: "memory", SampleType: "inuse_space", Delta: &yes}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, profileType := range []string{cpu, inuse, goroutine} {
+				if tt.match.matches(profileType) {
+					got = append(got, profileType)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("matches %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkloadRules(t *testing.T) {
+	const (
+		cpu       = "parca_agent:samples:count:cpu:nanoseconds:delta"
+		goroutine = "goroutine:goroutine:count:goroutine:count"
+	)
+	w := &workload{
+		profileTypes:    []string{cpu, goroutine},
+		queryTimeRanges: []time.Duration{15 * time.Minute, 12 * time.Hour, 168 * time.Hour},
+		rules: []ProfileTypeRule{
+			{Match: ProfileTypeMatch{Name: "goroutine"}, Exclude: []string{"diff"}, MaxRange: Duration(12 * time.Hour), Mode: ruleModeSingle},
+			// Never applies, as the first matching rule does.
+			{Match: ProfileTypeMatch{Name: "goroutine"}, Exclude: []string{"merge"}},
+		},
+	}
+
+	if got := w.profileTypesFor("diff"); !slices.Equal(got, []string{cpu}) {
+		t.Errorf("profileTypesFor(diff) = %q, want only %s", got, cpu)
+	}
+	if got := w.profileTypesFor("merge"); !slices.Equal(got, []string{cpu, goroutine}) {
+		t.Errorf("profileTypesFor(merge) = %q, want both types", got)
+	}
+	if got := w.rangesFor(goroutine); !slices.Equal(got, []time.Duration{15 * time.Minute, 12 * time.Hour}) {
+		t.Errorf("rangesFor(%s) = %v, want the ranges up to 12h", goroutine, got)
+	}
+	if got := w.rangesFor(cpu); len(got) != 3 {
+		t.Errorf("rangesFor(%s) = %v, want all ranges", cpu, got)
+	}
+	if got := w.mode(goroutine); got != ruleModeSingle {
+		t.Errorf("mode(%s) = %q, want %q", goroutine, got, ruleModeSingle)
+	}
+	if got := w.mode(cpu); got != ruleModeMerge {
+		t.Errorf("mode(%s) = %q, want %q", cpu, got, ruleModeMerge)
+	}
+}
+
+func TestDefaultProfileTypeRules(t *testing.T) {
+	const (
+		cpu   = "parca_agent:samples:count:cpu:nanoseconds:delta"
+		inuse = "memory:inuse_space:bytes:space:bytes"
+	)
+
+	cfg := defaultConfig()
+	w := newWorkload(cfg)
+	if got := w.mode(inuse); got != ruleModeSingle {
+		t.Errorf("mode(%s) = %q by default, want %q", inuse, got, ruleModeSingle)
+	}
+	if got := w.mode(cpu); got != ruleModeMerge {
+		t.Errorf("mode(%s) = %q by default, want %q", cpu, got, ruleModeMerge)
+	}
+	w.profileTypes = []string{cpu, inuse}
+	if got := w.profileTypesFor("diff"); !slices.Equal(got, []string{cpu}) {
+		t.Errorf("profileTypesFor(diff) = %q by default, want only %s", got, cpu)
+	}
+
+	// Configured rules take precedence over the default ones.
+	cfg.ProfileTypeRules = []ProfileTypeRule{{Match: ProfileTypeMatch{Name: "memory"}}}
+	if got := newWorkload(cfg).mode(inuse); got != ruleModeMerge {
+		t.Errorf("mode(%s) = %q with a configured rule, want %q", inuse, got, ruleModeMerge)
+	}
+
+	cfg = defaultConfig()
+	cfg.DefaultProfileTypeRules = false
+	if rules := newWorkload(cfg).rules; len(rules) != 0 {
+		t.Errorf("rules = %v after opting out of the default ones, want none", rules)
+	}
+
+	cfg = defaultConfig()
+	cfg.Queries.Range.Kind.Enabled = false
+	if rules := newWorkload(cfg).rules; len(rules) != 0 {
+		t.Errorf("rules = %v without range queries, want none", rules)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// shareDescription is the description of the profiles parca-load shares.
+const shareDescription = "parca-load"
+
+// shareRequests shares the merged profile of every profile type, range and
+// selector, as the UI's share button does.
+func (q *Querier) shareRequests() []request {
+	w := q.workload.Load()
+	reqs := make([]request, 0, len(w.profileTypes)*len(w.queryTimeRanges)*len(w.labelSelectors))
+	for _, profileType := range w.profileTypesFor("share") {
+		for _, tr := range w.rangesFor(profileType) {
+			for _, labelSelector := range w.labelSelectors {
+				reqs = append(reqs, request{profileType: profileType, do: func(ctx context.Context) error {
+					rangeEnd := time.Now()
+					rangeStart := rangeEnd.Add(-1 * tr)
+
+					query := profileType
+					if labelSelector != "all" {
+						query = profileType + labelSelector
+					}
+
+					description := shareDescription
+					queryStart := time.Now()
+					resp, err := q.client.ShareProfile(
+						ctx, connect.NewRequest(
+							&queryv1alpha1.ShareProfileRequest{
+								QueryRequest: &queryv1alpha1.QueryRequest{
+									Mode: queryv1alpha1.QueryRequest_MODE_MERGE,
+									Options: &queryv1alpha1.QueryRequest_Merge{
+										Merge: &queryv1alpha1.MergeProfile{
+											Query: query,
+											Start: timestamppb.New(rangeStart),
+											End:   timestamppb.New(rangeEnd),
+										},
+									},
+								},
+								Description: &description,
+							},
+						),
+					)
+					latency := time.Since(queryStart)
+					if err != nil {
+						q.metrics.shareHistogram.observe(ctx, queryStart, latency, connect.CodeOf(err).String(), tr.String(), labelSelector)
+						q.metrics.shareCounter.WithLabelValues(connect.CodeOf(err).String(), tr.String(), labelSelector).Inc()
+						log.Printf("share(query=%s,over=%s,labels=%s): failed to make request: %v\n", query, tr, labelSelector, err)
+						return err
+					}
+					q.metrics.shareHistogram.observe(ctx, queryStart, latency, grpcCodeOK, tr.String(), labelSelector)
+					q.metrics.shareCounter.WithLabelValues(grpcCodeOK, tr.String(), labelSelector).Inc()
+					log.Printf(
+						"share(query=%s,over=%s,labels=%s): took %s and got %s\n",
+						query, tr, labelSelector, latency, resp.Msg.Link,
+					)
+					return nil
+				}})
+			}
+		}
+	}
+	return reqs
+}
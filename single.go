@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	profilestorev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/profilestore/v1alpha1"
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// rangeQuery identifies a range query of the profile type × range × selector
+// matrix.
+type rangeQuery struct {
+	profileType   string
+	tr            time.Duration
+	labelSelector string
+}
+
+// singlePoint is a point of the metrics graph that a user could click on.
+type singlePoint struct {
+	// query selects the series the point belongs to.
+	query string
+	time  time.Time
+}
+
+// singlePoints holds the points that single-profile queries are made for, by
+// the range query whose response they were taken from. Each response
+// replaces the points of the previous one, so the points stay recent.
+type singlePoints struct {
+	mu     sync.Mutex
+	points map[rangeQuery][]singlePoint
+	// stored counts the responses the points were taken from.
+	stored uint64
+}
+
+// store takes n points spread evenly over the samples of all series.
+func (p *singlePoints) store(rq rangeQuery, series []*queryv1alpha1.MetricsSeries, n int) {
+	var all []singlePoint
+	for _, s := range series {
+		query := rq.profileType + seriesSelector(s.Labelset)
+		for _, sample := range s.Samples {
+			all = append(all, singlePoint{query: query, time: sample.Timestamp.AsTime()})
+		}
+	}
+
+	n = min(n, len(all))
+	points := make([]singlePoint, 0, n)
+	for i := range n {
+		points = append(points, all[i*len(all)/n])
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.points == nil {
+		p.points = map[rangeQuery][]singlePoint{}
+	}
+	p.points[rq] = points
+	p.stored++
+}
+
+// generation changes whenever new points were stored.
+func (p *singlePoints) generation() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stored
+}
+
+func (p *singlePoints) get(rq rangeQuery) []singlePoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.points[rq]
+}
+
+// latest returns the most recent point of the range query, if it returned
+// any.
+func (p *singlePoints) latest(rq rangeQuery) (singlePoint, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var latest singlePoint
+	for _, point := range p.points[rq] {
+		if point.time.After(latest.time) {
+			latest = point
+		}
+	}
+	return latest, !latest.time.IsZero()
+}
+
+// seriesSelector returns the label selector that matches exactly the series
+// with the given labels.
+func seriesSelector(ls *profilestorev1alpha1.LabelSet) string {
+	if len(ls.GetLabels()) == 0 {
+		return ""
+	}
+	matchers := make([]string, 0, len(ls.GetLabels()))
+	for _, l := range ls.GetLabels() {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", l.Name, l.Value))
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+// singleRequests queries single profiles at the points that range queries of
+// the current workload returned. Until range queries returned any samples,
+// there is nothing to query.
+func (q *Querier) singleRequests() []request {
+	w := q.workload.Load()
+	viewports := q.viewports()
+	var reqs []request
+	for _, profileType := range w.profileTypesFor("single") {
+		for _, tr := range w.rangesFor(profileType) {
+			for _, labelSelector := range w.labelSelectors {
+				rq := rangeQuery{profileType: profileType, tr: tr, labelSelector: labelSelector}
+				for _, point := range q.singles.get(rq) {
+					for _, vp := range viewports {
+						reqs = append(reqs, request{profileType: profileType, do: func(ctx context.Context) error {
+							vp := q.viewport(vp)
+							labels := queryLabels{mode: "single", reportType: reportTypeFlamegraphArrow, tr: tr.String(), labels: labelSelector, viewport: vp.Name}
+							queryStart := time.Now()
+							resp, err := q.client.Query(
+								ctx, connect.NewRequest(
+									&queryv1alpha1.QueryRequest{
+										Mode: queryv1alpha1.QueryRequest_MODE_SINGLE_UNSPECIFIED,
+										Options: &queryv1alpha1.QueryRequest_Single{
+											Single: &queryv1alpha1.SingleProfile{
+												Query: point.query,
+												Time:  timestamppb.New(point.time),
+											},
+										},
+										ReportType:        reportTypeFlamegraphArrow.proto(),
+										NodeTrimThreshold: vp.nodeTrimThreshold(),
+									},
+								),
+							)
+							latency := time.Since(queryStart)
+							q.observeQuery(ctx, queryStart, latency, labels, resp, err)
+							if err != nil {
+								log.Printf(
+									"single(query=%s,at=%s,over=%s,labels=%s,viewport=%s): failed to make request: %v\n",
+									point.query, point.time.Format(time.RFC3339), tr, labelSelector, vp.Name, err,
+								)
+								return err
+							}
+
+							log.Printf(
+								"single(query=%s,at=%s,over=%s,labels=%s,viewport=%s): took %s\n",
+								point.query, point.time.Format(time.RFC3339), tr, labelSelector, vp.Name, latency,
+							)
+							return nil
+						}})
+					}
+				}
+			}
+		}
+	}
+	return reqs
+}
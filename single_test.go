@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	profilestorev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/profilestore/v1alpha1"
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestSeriesSelector(t *testing.T) {
+	ls := &profilestorev1alpha1.LabelSet{Labels: []*profilestorev1alpha1.Label{
+		{Name: "job", Value: "parca"},
+		{Name: "path", Value: `C:\tmp "x"`},
+	}}
+	if got, want := seriesSelector(ls), `{job="parca",path="C:\\tmp \"x\""}`; got != want {
+		t.Errorf("seriesSelector() = %s, want %s", got, want)
+	}
+	if got := seriesSelector(nil); got != "" {
+		t.Errorf("seriesSelector(nil) = %q, want empty", got)
+	}
+}
+
+func TestSinglePoints(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	series := func(job string, samples int) *queryv1alpha1.MetricsSeries {
+		s := &queryv1alpha1.MetricsSeries{Labelset: &profilestorev1alpha1.LabelSet{
+			Labels: []*profilestorev1alpha1.Label{{Name: "job", Value: job}},
+		}}
+		for i := range samples {
+			s.Samples = append(s.Samples, &queryv1alpha1.MetricsSample{Timestamp: timestamppb.New(start.Add(time.Duration(i) * time.Minute))})
+		}
+		return s
+	}
+
+	var p singlePoints
+	rq := rangeQuery{profileType: "cpu:samples", tr: time.Hour}
+	if got := p.generation(); got != 0 {
+		t.Errorf("generation() before any response = %d, want 0", got)
+	}
+
+	p.store(rq, []*queryv1alpha1.MetricsSeries{series("a", 6), series("b", 2)}, 4)
+	points := p.get(rq)
+	want := []singlePoint{
+		{query: `cpu:samples{job="a"}`, time: start},
+		{query: `cpu:samples{job="a"}`, time: start.Add(2 * time.Minute)},
+		{query: `cpu:samples{job="a"}`, time: start.Add(4 * time.Minute)},
+		{query: `cpu:samples{job="b"}`, time: start},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("stored %d points, want %d: %v", len(points), len(want), points)
+	}
+	for i := range want {
+		if points[i].query != want[i].query || !points[i].time.Equal(want[i].time) {
+			t.Errorf("point %d = %v, want %v", i, points[i], want[i])
+		}
+	}
+	if got, ok := p.latest(rq); !ok || got.query != want[2].query || !got.time.Equal(want[2].time) {
+		t.Errorf("latest() = %v, %t, want %v", got, ok, want[2])
+	}
+	if _, ok := p.latest(rangeQuery{profileType: "cpu:samples"}); ok {
+		t.Error("latest() returned a point of a range query without any")
+	}
+	if got := p.generation(); got != 1 {
+		t.Errorf("generation() after a response = %d, want 1", got)
+	}
+
+	// Each response replaces the points of the previous one, and there are
+	// never more points than samples.
+	p.store(rq, []*queryv1alpha1.MetricsSeries{series("c", 2)}, 4)
+	if got := p.get(rq); len(got) != 2 || got[0].query != `cpu:samples{job="c"}` {
+		t.Errorf("points after the second response = %v", got)
+	}
+	if got := p.get(rangeQuery{profileType: "memory"}); len(got) != 0 {
+		t.Errorf("points of a range query without responses = %v", got)
+	}
+}
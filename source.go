@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+	"connectrpc.com/connect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// sourceRef is a source file of a binary that source reports can be
+// requested for.
+type sourceRef struct {
+	buildID  string
+	filename string
+}
+
+// sourceRequests requests the source reports of files seen in flamegraphs,
+// for every profile type, range and selector. Each request picks one of the
+// known files of its profile type at random, so profile types are only
+// requested once a flamegraph listed any.
+func (q *Querier) sourceRequests() []request {
+	w := q.workload.Load()
+	samples := q.queries.Source.Samples
+	reqs := make([]request, 0, len(w.profileTypes)*len(w.queryTimeRanges)*len(w.labelSelectors)*samples)
+	for _, profileType := range w.profileTypesFor("source") {
+		if !q.sources.known(profileType) {
+			continue
+		}
+		for _, tr := range w.rangesFor(profileType) {
+			for _, labelSelector := range w.labelSelectors {
+				for range samples {
+					reqs = append(reqs, request{profileType: profileType, do: func(ctx context.Context) error {
+						rangeEnd := time.Now()
+						rangeStart := rangeEnd.Add(-1 * tr)
+
+						query := profileType
+						if labelSelector != "all" {
+							query = profileType + labelSelector
+						}
+						merge := &queryv1alpha1.MergeProfile{
+							Query: query,
+							Start: timestamppb.New(rangeStart),
+							End:   timestamppb.New(rangeEnd),
+						}
+
+						labels := queryLabels{mode: "merge", reportType: reportTypeSource, tr: tr.String(), labels: labelSelector}
+						// Known files are never forgotten, so there is one to pick.
+						ref := q.sources.sample(profileType, 1)[0]
+
+						queryStart := time.Now()
+						resp, err := q.client.Query(
+							ctx, connect.NewRequest(
+								&queryv1alpha1.QueryRequest{
+									Mode:       queryv1alpha1.QueryRequest_MODE_MERGE,
+									Options:    &queryv1alpha1.QueryRequest_Merge{Merge: merge},
+									ReportType: queryv1alpha1.QueryRequest_REPORT_TYPE_SOURCE,
+									SourceReference: &queryv1alpha1.SourceReference{
+										BuildId:    ref.buildID,
+										Filename:   ref.filename,
+										SourceOnly: q.queries.Source.SourceOnly,
+									},
+								},
+							),
+						)
+						latency := time.Since(queryStart)
+						q.observeQuery(ctx, queryStart, latency, labels, resp, err)
+						if err != nil {
+							log.Printf(
+								"source(query=%s,build_id=%s,file=%s,over=%s,labels=%s): failed to make request: %v\n",
+								query, ref.buildID, ref.filename, tr, labelSelector, err,
+							)
+							return err
+						}
+
+						log.Printf(
+							"source(query=%s,build_id=%s,file=%s,over=%s,labels=%s): took %s\n",
+							query, ref.buildID, ref.filename, tr, labelSelector, latency,
+						)
+						return nil
+					}})
+				}
+			}
+		}
+	}
+	return reqs
+}
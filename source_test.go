@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	queryv1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/query/v1alpha1"
+)
+
+func TestSourceRequestsWaitForFiles(t *testing.T) {
+	q, _ := newTestQuerier(t, LimitsConfig{})
+	q.queries.Source.Kind.Enabled = true
+	q.workload.Store(&workload{
+		profileTypes:    []string{testProfileType},
+		queryTimeRanges: []time.Duration{time.Hour},
+		labelSelectors:  []string{"all"},
+	})
+
+	if got := len(q.sourceRequests()); got != 0 {
+		t.Errorf("sourceRequests() = %d requests before any file is known, want 0", got)
+	}
+	generation := q.sources.generation()
+	q.storeFlamegraph(testProfileType, &queryv1alpha1.FlamegraphArrow{Record: testFlamegraph()})
+	if q.sources.generation() == generation {
+		t.Error("storing the first files of a profile type didn't change the generation")
+	}
+	if got := len(q.sourceRequests()); got != q.queries.Source.Samples {
+		t.Errorf("sourceRequests() = %d requests once files are known, want %d", got, q.queries.Source.Samples)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// loadShape computes the target rate of a list of stages over time.
+type loadShape struct {
+	stages []StageConfig
+	start  time.Time
+}
+
+func newLoadShape(stages []StageConfig, start time.Time) *loadShape {
+	return &loadShape{stages: stages, start: start}
+}
+
+// at returns the rate at the given time and the index of the stage it
+// belongs to. Once all stages are over, the rate at the end of the last
+// stage is held.
+func (s *loadShape) at(now time.Time) (float64, int) {
+	elapsed := now.Sub(s.start)
+	for i, stage := range s.stages {
+		d := time.Duration(stage.Duration)
+		if elapsed < d {
+			return stage.rate(elapsed), i
+		}
+		elapsed -= d
+	}
+	last := len(s.stages) - 1
+	return s.stages[last].rate(time.Duration(s.stages[last].Duration)), last
+}
+
+// stage returns the name of the stage at the given time, or an empty string
+// if there are no stages.
+func (s *loadShape) stage(now time.Time) string {
+	if s == nil {
+		return ""
+	}
+	_, i := s.at(now)
+	return stageName(s.stages, i)
+}
+
+// rate returns the rate of the stage after it ran for elapsed.
+func (s StageConfig) rate(elapsed time.Duration) float64 {
+	progress := float64(elapsed) / float64(s.Duration)
+	progress = min(max(progress, 0), 1)
+
+	switch s.Type {
+	case stageTypeRamp:
+		return s.From + (s.To-s.From)*progress
+	case stageTypeSteps:
+		step := min(int(progress*float64(s.Steps)), s.Steps-1)
+		return s.From + (s.To-s.From)*float64(step)/float64(s.Steps-1)
+	case stageTypeSpike:
+		if elapsed < time.Duration(s.Hold) {
+			return s.To
+		}
+		return s.From
+	default:
+		return s.Rate
+	}
+}
+
+// stageName returns the configured name of the stage at index i, falling
+// back to its type and position.
+func stageName(stages []StageConfig, i int) string {
+	if stages[i].Name != "" {
+		return stages[i].Name
+	}
+	return fmt.Sprintf("%s-%d", stages[i].Type, i)
+}
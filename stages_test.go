@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStageRate(t *testing.T) {
+	minute := Duration(time.Minute)
+	tests := []struct {
+		name    string
+		stage   StageConfig
+		elapsed time.Duration
+		want    float64
+	}{
+		{"constant", StageConfig{Type: stageTypeConstant, Duration: minute, Rate: 5}, 30 * time.Second, 5},
+		{"ramp start", StageConfig{Type: stageTypeRamp, Duration: minute, From: 10, To: 30}, 0, 10},
+		{"ramp middle", StageConfig{Type: stageTypeRamp, Duration: minute, From: 10, To: 30}, 30 * time.Second, 20},
+		{"ramp end", StageConfig{Type: stageTypeRamp, Duration: minute, From: 10, To: 30}, time.Minute, 30},
+		{"ramp beyond end", StageConfig{Type: stageTypeRamp, Duration: minute, From: 10, To: 30}, 2 * time.Minute, 30},
+		{"ramp down", StageConfig{Type: stageTypeRamp, Duration: minute, From: 30, To: 10}, 45 * time.Second, 15},
+		{"first step", StageConfig{Type: stageTypeSteps, Duration: minute, From: 0, To: 30, Steps: 4}, 0, 0},
+		{"second step", StageConfig{Type: stageTypeSteps, Duration: minute, From: 0, To: 30, Steps: 4}, 15 * time.Second, 10},
+		{"third step", StageConfig{Type: stageTypeSteps, Duration: minute, From: 0, To: 30, Steps: 4}, 44 * time.Second, 20},
+		{"last step", StageConfig{Type: stageTypeSteps, Duration: minute, From: 0, To: 30, Steps: 4}, 45 * time.Second, 30},
+		{"last step at the end", StageConfig{Type: stageTypeSteps, Duration: minute, From: 0, To: 30, Steps: 4}, time.Minute, 30},
+		{"spike", StageConfig{Type: stageTypeSpike, Duration: minute, From: 1, To: 50, Hold: Duration(10 * time.Second)}, 5 * time.Second, 50},
+		{"after spike", StageConfig{Type: stageTypeSpike, Duration: minute, From: 1, To: 50, Hold: Duration(10 * time.Second)}, 10 * time.Second, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.stage.rate(tt.elapsed); got != tt.want {
+				t.Errorf("rate(%v) = %v, want %v", tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadShape(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	shape := newLoadShape([]StageConfig{
+		{Type: stageTypeRamp, Duration: Duration(time.Minute), From: 0, To: 10},
+		{Type: stageTypeConstant, Duration: Duration(time.Minute), Rate: 10},
+		{Type: stageTypeRamp, Duration: Duration(time.Minute), From: 10, To: 2},
+	}, start)
+
+	tests := []struct {
+		elapsed   time.Duration
+		wantRate  float64
+		wantStage int
+	}{
+		{0, 0, 0},
+		{30 * time.Second, 5, 0},
+		{time.Minute, 10, 1},
+		{90 * time.Second, 10, 1},
+		{2 * time.Minute, 10, 2},
+		{150 * time.Second, 6, 2},
+		{3 * time.Minute, 2, 2},
+		{time.Hour, 2, 2},
+	}
+	for _, tt := range tests {
+		rate, stage := shape.at(start.Add(tt.elapsed))
+		if rate != tt.wantRate || stage != tt.wantStage {
+			t.Errorf("at(%v) = %v, %d, want %v, %d", tt.elapsed, rate, stage, tt.wantRate, tt.wantStage)
+		}
+	}
+}
+
+func TestLoadShapeStage(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	shape := newLoadShape([]StageConfig{
+		{Name: "warmup", Type: stageTypeRamp, Duration: Duration(time.Minute), From: 0, To: 10},
+		{Type: stageTypeConstant, Duration: Duration(time.Minute), Rate: 10},
+	}, start)
+
+	if got := shape.stage(start.Add(30 * time.Second)); got != "warmup" {
+		t.Errorf("stage() = %q, want %q", got, "warmup")
+	}
+	if got := shape.stage(start.Add(time.Hour)); got != "constant-1" {
+		t.Errorf("stage() = %q, want %q", got, "constant-1")
+	}
+
+	var none *loadShape
+	if got := none.stage(start); got != "" {
+		t.Errorf("stage() without stages = %q, want empty", got)
+	}
+}
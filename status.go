@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	profilestorev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/profilestore/v1alpha1"
+	scrapev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/scrape/v1alpha1"
+	"connectrpc.com/connect"
+)
+
+// targetsRequests lists the scrape targets in every configured state, as the
+// UI's targets page does.
+func (q *Querier) targetsRequests() []request {
+	states := q.queries.Targets.States
+	reqs := make([]request, 0, len(states))
+	for _, state := range states {
+		reqs = append(reqs, request{do: func(ctx context.Context) error {
+			queryStart := time.Now()
+			resp, err := q.scrape.Targets(ctx, connect.NewRequest(&scrapev1alpha1.TargetsRequest{
+				State: targetStates[state],
+			}))
+			latency := time.Since(queryStart)
+			if err != nil {
+				q.metrics.targetsHistogram.observe(ctx, queryStart, latency, connect.CodeOf(err).String(), state)
+				q.metrics.targetsCounter.WithLabelValues(connect.CodeOf(err).String(), state).Inc()
+				log.Printf("targets(state=%s): failed to make request: %v\n", state, err)
+				return err
+			}
+			q.metrics.targetsHistogram.observe(ctx, queryStart, latency, grpcCodeOK, state)
+			q.metrics.targetsCounter.WithLabelValues(grpcCodeOK, state).Inc()
+
+			targets := 0
+			for _, job := range resp.Msg.Targets {
+				targets += len(job.GetTargets())
+			}
+			log.Printf(
+				"targets(state=%s): took %v and got %d targets of %d jobs\n",
+				state, latency, targets, len(resp.Msg.Targets),
+			)
+			return nil
+		}})
+	}
+	return reqs
+}
+
+// agentsRequests lists the agents that send profiles, as the UI's agents
+// page does.
+func (q *Querier) agentsRequests() []request {
+	return []request{{do: func(ctx context.Context) error {
+		queryStart := time.Now()
+		resp, err := q.agents.Agents(ctx, connect.NewRequest(&profilestorev1alpha1.AgentsRequest{}))
+		latency := time.Since(queryStart)
+		if err != nil {
+			q.metrics.agentsHistogram.observe(ctx, queryStart, latency, connect.CodeOf(err).String())
+			q.metrics.agentsCounter.WithLabelValues(connect.CodeOf(err).String()).Inc()
+			log.Printf("agents: failed to make request: %v\n", err)
+			return err
+		}
+		q.metrics.agentsHistogram.observe(ctx, queryStart, latency, grpcCodeOK)
+		q.metrics.agentsCounter.WithLabelValues(grpcCodeOK).Inc()
+		log.Printf("agents: took %v and got %d agents\n", latency, len(resp.Msg.Agents))
+		return nil
+	}}}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// runSummary collects the latency and errors of every request of a bounded
+// run, so that the run can be reported once it finished. A nil runSummary
+// records nothing.
+type runSummary struct {
+	mu    sync.Mutex
+	start time.Time
+	kinds map[string]*kindSummary
+}
+
+type kindSummary struct {
+	// latencies are measured from when the requests were sent, and
+	// corrected from when they were scheduled to be sent.
+	latencies []time.Duration
+	corrected []time.Duration
+	errors    int
+}
+
+func (s *runSummary) begin() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = time.Now()
+	s.kinds = map[string]*kindSummary{}
+}
+
+func (s *runSummary) record(kind string, latency, corrected time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.kinds[kind]
+	if !ok {
+		k = &kindSummary{}
+		s.kinds[kind] = k
+	}
+	k.latencies = append(k.latencies, latency)
+	k.corrected = append(k.corrected, corrected)
+	if err != nil {
+		k.errors++
+	}
+}
+
+// Summary writes a table of the requests made by a bounded run, with the
+// percentiles of their latency and the 99th percentile corrected for the time
+// they were late. It returns an error if more requests failed than
+// limits.maxErrorRatio allows.
+func (q *Querier) Summary(w io.Writer) error {
+	s := q.summary
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.start).Seconds()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "kind\trequests\terrors\trate/s\tp50\tp90\tp99\tmax\tcorrected p99\t")
+
+	total := &kindSummary{}
+	row := func(name string, k *kindSummary) {
+		slices.Sort(k.latencies)
+		slices.Sort(k.corrected)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f\t%s\t%s\t%s\t%s\t%s\t\n",
+			name,
+			len(k.latencies),
+			k.errors,
+			float64(len(k.latencies))/elapsed,
+			percentile(k.latencies, 0.5),
+			percentile(k.latencies, 0.9),
+			percentile(k.latencies, 0.99),
+			percentile(k.latencies, 1),
+			percentile(k.corrected, 0.99),
+		)
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.kinds)) {
+		k := s.kinds[name]
+		row(name, k)
+		total.latencies = append(total.latencies, k.latencies...)
+		total.corrected = append(total.corrected, k.corrected...)
+		total.errors += k.errors
+	}
+	row("total", total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(total.latencies) == 0 {
+		return nil
+	}
+	ratio := float64(total.errors) / float64(len(total.latencies))
+	if ratio > q.limits.MaxErrorRatio {
+		return fmt.Errorf("%d of %d requests failed, error ratio %.4f exceeds %g", total.errors, len(total.latencies), ratio, q.limits.MaxErrorRatio)
+	}
+	return nil
+}
+
+// percentile returns the p-th percentile of the sorted latencies, rounded to
+// milliseconds for readability.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)].Round(time.Millisecond)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const numHorizontalPixelsOn8KDisplay = 7680
+
+// step returns the step of a range query over tr, so that there is a sample
+// for every horizontal pixel.
+func (vp ViewportConfig) step(tr time.Duration) *durationpb.Duration {
+	return durationpb.New(tr / time.Duration(vp.Width))
+}
+
+// nodeTrimThreshold trims anything that can't be displayed by the viewport,
+// unless trimming is disabled.
+func (vp ViewportConfig) nodeTrimThreshold() *float32 {
+	if vp.NoTrimming {
+		return nil
+	}
+	threshold := float32(1) / float32(vp.Width)
+	return &threshold
+}
+
+// viewports returns the viewports to build requests for. When rotating,
+// requests are built for a single nil viewport instead, and each request
+// takes the next viewport in turn when it is made.
+func (q *Querier) viewports() []*ViewportConfig {
+	if q.viewportConf.Mode == viewportModeRotate {
+		return []*ViewportConfig{nil}
+	}
+	viewports := make([]*ViewportConfig, len(q.viewportConf.Profiles))
+	for i := range q.viewportConf.Profiles {
+		viewports[i] = &q.viewportConf.Profiles[i]
+	}
+	return viewports
+}
+
+// viewport returns the viewport a request is made for.
+func (q *Querier) viewport(vp *ViewportConfig) ViewportConfig {
+	if vp != nil {
+		return *vp
+	}
+	profiles := q.viewportConf.Profiles
+	return profiles[(q.viewportTurn.Add(1)-1)%uint64(len(profiles))]
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/profilestore/v1alpha1/profilestorev1alpha1connect"
+	profilestorev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/profilestore/v1alpha1"
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type writerMetrics struct {
+	writeHistogram      latencyHistograms
+	writeBytesHistogram prometheus.Histogram
+	writeCounter        *prometheus.CounterVec
+	droppedCounter      prometheus.Counter
+	inflightGauge       prometheus.Gauge
+
+	batchHistogram      *prometheus.HistogramVec
+	batchBytesHistogram *prometheus.HistogramVec
+	sendHistogram       *prometheus.HistogramVec
+	unknownHistogram    prometheus.Histogram
+}
+
+// Writer ingests synthetic or replayed profiles through the profile store's
+// WriteRaw RPC, or synthetic ones through its Write stream like Parca Agent,
+// next to the Querier reading them.
+type Writer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	metrics writerMetrics
+
+	client profilestorev1alpha1connect.ProfileStoreServiceClient
+	conf   WriteConfig
+
+	profiles *profileGenerator
+	// replay are the captured profiles to write instead of synthetic ones.
+	replay []replayProfile
+	// labelSets are the label sets of the written series, including their
+	// __name__ and replica labels.
+	labelSets []*profilestorev1alpha1.LabelSet
+}
+
+func NewWriter(
+	reg *prometheus.Registry,
+	client profilestorev1alpha1connect.ProfileStoreServiceClient,
+	conf WriteConfig,
+) (*Writer, error) {
+	w := &Writer{
+		done: make(chan struct{}),
+		metrics: writerMetrics{
+			writeHistogram: newLatencyHistograms(
+				reg,
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_write_seconds",
+					Help:                        "The seconds it takes to make WriteRaw requests or Write streams against a Parca",
+					NativeHistogramBucketFactor: 1.1,
+				},
+				[]string{"grpc_code"},
+			),
+			writeBytesHistogram: promauto.With(reg).NewHistogram(
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_write_bytes",
+					Help:                        "The size in bytes of the profiles or records sent by WriteRaw requests or Write streams against a Parca",
+					Buckets:                     prometheus.ExponentialBuckets(256, 4, 12),
+					NativeHistogramBucketFactor: 1.1,
+				},
+			),
+			writeCounter: promauto.With(reg).NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "parca_client_write_total",
+					Help: "Total number of WriteRaw requests or Write streams against Parca",
+				},
+				[]string{"grpc_code"},
+			),
+			droppedCounter: promauto.With(reg).NewCounter(
+				prometheus.CounterOpts{
+					Name: "parca_client_write_dropped_total",
+					Help: "Total number of WriteRaw requests or Write streams that were not sent because the in-flight limit was reached",
+				},
+			),
+			inflightGauge: promauto.With(reg).NewGauge(
+				prometheus.GaugeOpts{
+					Name: "parca_client_write_inflight_requests",
+					Help: "The number of WriteRaw requests or Write streams currently in flight against Parca",
+				},
+			),
+			batchHistogram: promauto.With(reg).NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_write_batch_seconds",
+					Help:                        "The seconds from sending a record of a Write stream until Parca answered it",
+					NativeHistogramBucketFactor: 1.1,
+				},
+				[]string{"grpc_code", "batch"},
+			),
+			batchBytesHistogram: promauto.With(reg).NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_write_batch_bytes",
+					Help:                        "The size in bytes of the records sent by Write streams against a Parca",
+					Buckets:                     prometheus.ExponentialBuckets(256, 4, 12),
+					NativeHistogramBucketFactor: 1.1,
+				},
+				[]string{"batch"},
+			),
+			sendHistogram: promauto.With(reg).NewHistogramVec(
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_write_send_seconds",
+					Help:                        "The seconds that sending a record of a Write stream blocked, which grows when Parca applies backpressure",
+					NativeHistogramBucketFactor: 1.1,
+				},
+				[]string{"batch"},
+			),
+			unknownHistogram: promauto.With(reg).NewHistogram(
+				prometheus.HistogramOpts{
+					Name:                        "parca_client_write_unknown_stacktraces",
+					Help:                        "The number of stacktraces that Parca asked for in a Write stream",
+					Buckets:                     prometheus.ExponentialBuckets(1, 4, 10),
+					NativeHistogramBucketFactor: 1.1,
+				},
+			),
+		},
+		client: client,
+		conf:   conf,
+	}
+
+	for _, labels := range conf.LabelSets {
+		for replica := range conf.Replicas {
+			ls := &profilestorev1alpha1.LabelSet{Labels: []*profilestorev1alpha1.Label{{Name: "__name__", Value: conf.Name}}}
+			for _, name := range slices.Sorted(maps.Keys(labels)) {
+				ls.Labels = append(ls.Labels, &profilestorev1alpha1.Label{Name: name, Value: labels[name]})
+			}
+			if conf.Replicas > 1 {
+				ls.Labels = append(ls.Labels, &profilestorev1alpha1.Label{Name: "replica", Value: strconv.Itoa(replica)})
+			}
+			w.labelSets = append(w.labelSets, ls)
+		}
+	}
+
+	// Load the profiles to replay up front, so that a broken replay set
+	// fails the start rather than a running load test.
+	if conf.Replay.Path != "" {
+		profiles, err := loadReplayProfiles(conf.Replay.Path)
+		if err != nil {
+			return nil, fmt.Errorf("load profiles to replay: %w", err)
+		}
+		w.replay = profiles
+	}
+	return w, nil
+}
+
+// Run writes profiles until Stop is called, and returns after the requests
+// in flight completed.
+func (w *Writer) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	w.cancel = cancel
+
+	defer close(w.done)
+
+	inflight := make(chan struct{}, w.conf.MaxInFlight)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	if len(w.replay) > 0 {
+		w.runReplay(ctx, &wg, inflight)
+		return nil
+	}
+
+	w.profiles = newProfileGenerator(w.conf.Profile)
+	// Each profile covers the time since the previous write, like the
+	// profiles of an agent.
+	duration := time.Duration(float64(time.Second) / w.conf.Rate)
+	log.Printf(
+		"write: sending %g %s requests per second of %d series with %d samples each\n",
+		w.conf.Rate, w.conf.Mode, len(w.labelSets), w.conf.Profile.Samples,
+	)
+
+	pace(ctx, constantRate(w.conf.Rate), newArrivals(w.conf.Arrival, "write"), func(scheduled time.Time) {
+		ctx := withScheduled(ctx, scheduled)
+		if w.conf.Mode == writeModeArrow {
+			w.dispatch(&wg, inflight, func() {
+				_ = w.writeArrow(ctx, time.Now(), duration)
+			})
+			return
+		}
+		w.dispatch(&wg, inflight, func() {
+			_ = w.write(ctx, "synthetic", func() ([]byte, error) {
+				return w.profiles.generate(time.Now(), duration)
+			})
+		})
+	})
+	return nil
+}
+
+// dispatch runs write in the background unless the in-flight limit is
+// reached, in which case the write is dropped.
+func (w *Writer) dispatch(wg *sync.WaitGroup, inflight chan struct{}, write func()) {
+	select {
+	case inflight <- struct{}{}:
+	default:
+		w.metrics.droppedCounter.Inc()
+		return
+	}
+
+	w.metrics.inflightGauge.Inc()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			w.metrics.inflightGauge.Dec()
+			<-inflight
+		}()
+		write()
+	}()
+}
+
+func (w *Writer) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+// write sends a profile of every series in a single WriteRaw request. The
+// source of the profiles, such as the replayed file, is only logged.
+func (w *Writer) write(ctx context.Context, source string, profile func() ([]byte, error)) error {
+	req := &profilestorev1alpha1.WriteRawRequest{}
+	size := 0
+	for _, ls := range w.labelSets {
+		raw, err := profile()
+		if err != nil {
+			log.Printf("write(source=%s): failed to get profile: %v\n", source, err)
+			return err
+		}
+		size += len(raw)
+		req.Series = append(req.Series, &profilestorev1alpha1.RawProfileSeries{
+			Labels:  ls,
+			Samples: []*profilestorev1alpha1.RawSample{{RawProfile: raw}},
+		})
+	}
+
+	writeStart := time.Now()
+	_, err := w.client.WriteRaw(ctx, connect.NewRequest(req))
+	latency := time.Since(writeStart)
+	if err != nil {
+		w.metrics.writeHistogram.observe(ctx, writeStart, latency, connect.CodeOf(err).String())
+		w.metrics.writeCounter.WithLabelValues(connect.CodeOf(err).String()).Inc()
+		log.Printf("write(source=%s,series=%d,bytes=%d): failed to make request: %v\n", source, len(req.Series), size, err)
+		return err
+	}
+	w.metrics.writeHistogram.observe(ctx, writeStart, latency, grpcCodeOK)
+	w.metrics.writeCounter.WithLabelValues(grpcCodeOK).Inc()
+	w.metrics.writeBytesHistogram.Observe(float64(size))
+	log.Printf("write(source=%s,series=%d,bytes=%d): took %s\n", source, len(req.Series), size, latency)
+	return nil
+}
+
+// writeArrow sends the samples of every series in a single Write stream, like
+// Parca Agent does: a record of samples first, and then a record of the
+// stacktraces that Parca answered it doesn't know yet.
+func (w *Writer) writeArrow(ctx context.Context, end time.Time, duration time.Duration) error {
+	rows, stacks := agentSamples(w.labelSets, w.profiles.samples)
+	samples := encodeAgentSamples(rows, end, duration)
+	size := len(samples)
+	var unknown []string
+
+	writeStart := time.Now()
+	stream := w.client.Write(ctx)
+	batch, batchStart := "samples", writeStart
+	fail := func(err error) error {
+		code := connect.CodeOf(err).String()
+		w.metrics.batchHistogram.WithLabelValues(code, batch).Observe(time.Since(batchStart).Seconds())
+		w.metrics.writeHistogram.observe(ctx, writeStart, time.Since(writeStart), code)
+		w.metrics.writeCounter.WithLabelValues(code).Inc()
+		log.Printf(
+			"write(mode=arrow,batch=%s,series=%d,samples=%d,bytes=%d): failed to stream: %v\n",
+			batch, len(w.labelSets), len(rows), size, err,
+		)
+		_ = stream.CloseRequest()
+		_ = stream.CloseResponse()
+		return err
+	}
+
+	if err := w.send(stream, batch, samples); err != nil {
+		return fail(err)
+	}
+	resp, err := stream.Receive()
+	if err != nil {
+		return fail(err)
+	}
+	if len(resp.GetRecord()) > 0 {
+		if unknown, err = unknownStacktraces(resp.GetRecord()); err != nil {
+			return fail(err)
+		}
+	}
+	w.metrics.batchHistogram.WithLabelValues(grpcCodeOK, batch).Observe(time.Since(batchStart).Seconds())
+	w.metrics.unknownHistogram.Observe(float64(len(unknown)))
+
+	if len(unknown) > 0 {
+		stacktraces := encodeAgentStacktraces(w.conf.Profile, unknown, stacks)
+		size += len(stacktraces)
+		batch, batchStart = "stacktraces", time.Now()
+		if err := w.send(stream, batch, stacktraces); err != nil {
+			return fail(err)
+		}
+	}
+	// Parca answers the last record by ending the stream.
+	if err := stream.CloseRequest(); err != nil {
+		return fail(err)
+	}
+	for {
+		if _, err := stream.Receive(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+	}
+	if err := stream.CloseResponse(); err != nil {
+		return fail(err)
+	}
+	if len(unknown) > 0 {
+		w.metrics.batchHistogram.WithLabelValues(grpcCodeOK, batch).Observe(time.Since(batchStart).Seconds())
+	}
+
+	latency := time.Since(writeStart)
+	w.metrics.writeHistogram.observe(ctx, writeStart, latency, grpcCodeOK)
+	w.metrics.writeCounter.WithLabelValues(grpcCodeOK).Inc()
+	w.metrics.writeBytesHistogram.Observe(float64(size))
+	log.Printf(
+		"write(mode=arrow,series=%d,samples=%d,stacktraces=%d,bytes=%d): took %s\n",
+		len(w.labelSets), len(rows), len(unknown), size, latency,
+	)
+	return nil
+}
+
+// send sends a record on a Write stream. Sending blocks while Parca applies
+// backpressure.
+func (w *Writer) send(
+	stream *connect.BidiStreamForClient[profilestorev1alpha1.WriteRequest, profilestorev1alpha1.WriteResponse],
+	batch string,
+	record []byte,
+) error {
+	w.metrics.batchBytesHistogram.WithLabelValues(batch).Observe(float64(len(record)))
+	sendStart := time.Now()
+	err := stream.Send(&profilestorev1alpha1.WriteRequest{Record: record})
+	w.metrics.sendHistogram.WithLabelValues(batch).Observe(time.Since(sendStart).Seconds())
+	return err
+}
+
+// unknownStacktraces returns the IDs of the stacktraces that Parca asked for
+// in its answer to the samples record.
+func unknownStacktraces(record []byte) ([]string, error) {
+	columns, err := readArrowStrings(record, agentStacktraceID)
+	if err != nil {
+		return nil, fmt.Errorf("read unknown stacktraces: %w", err)
+	}
+	ids, ok := columns[agentStacktraceID]
+	if !ok {
+		return nil, fmt.Errorf("read unknown stacktraces: no %s column", agentStacktraceID)
+	}
+	return ids, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"buf.build/gen/go/parca-dev/parca/connectrpc/go/parca/profilestore/v1alpha1/profilestorev1alpha1connect"
+	profilestorev1alpha1 "buf.build/gen/go/parca-dev/parca/protocolbuffers/go/parca/profilestore/v1alpha1"
+	"connectrpc.com/connect"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeProfileStore answers Write streams like Parca: it asks for the
+// stacktraces it hasn't been sent before.
+type fakeProfileStore struct {
+	mu    sync.Mutex
+	known map[string]bool
+	// asked are the numbers of stacktraces asked for, by stream.
+	asked []int
+}
+
+func (s *fakeProfileStore) write(_ context.Context, stream *connect.BidiStream[profilestorev1alpha1.WriteRequest, profilestorev1alpha1.WriteResponse]) error {
+	req, err := stream.Receive()
+	if err != nil {
+		return err
+	}
+	columns, err := readArrowStrings(req.GetRecord(), agentStacktraceID)
+	if err != nil {
+		return connect.NewError(connect.CodeInvalidArgument, err)
+	}
+
+	s.mu.Lock()
+	var unknown []string
+	for _, id := range columns[agentStacktraceID] {
+		if !s.known[id] && !slices.Contains(unknown, id) {
+			unknown = append(unknown, id)
+		}
+	}
+	s.asked = append(s.asked, len(unknown))
+	s.mu.Unlock()
+
+	if len(unknown) == 0 {
+		if err := stream.Send(&profilestorev1alpha1.WriteResponse{}); err != nil {
+			return err
+		}
+	} else {
+		f := withName(arrowBinary, agentStacktraceID)
+		record := appendSchema(nil, f)
+		record = appendEndOfStream(appendRecordBatch(record, len(unknown), newBinaryArray(f, unknown)))
+		if err := stream.Send(&profilestorev1alpha1.WriteResponse{Record: record}); err != nil {
+			return err
+		}
+
+		req, err := stream.Receive()
+		if err != nil {
+			return err
+		}
+		columns, err := readArrowStrings(req.GetRecord(), agentStacktraceID)
+		if err != nil {
+			return connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		if !slices.Equal(columns[agentStacktraceID], unknown) {
+			return connect.NewError(connect.CodeInvalidArgument, errors.New("sent other stacktraces than asked for"))
+		}
+		s.mu.Lock()
+		for _, id := range unknown {
+			s.known[id] = true
+		}
+		s.mu.Unlock()
+	}
+
+	if _, err := stream.Receive(); !errors.Is(err, io.EOF) {
+		return connect.NewError(connect.CodeInvalidArgument, errors.New("stream not closed after the last record"))
+	}
+	return nil
+}
+
+func TestWriteArrow(t *testing.T) {
+	store := &fakeProfileStore{known: map[string]bool{}}
+	mux := http.NewServeMux()
+	mux.Handle("/parca.profilestore.v1alpha1.ProfileStoreService/Write", connect.NewBidiStreamHandler(
+		"/parca.profilestore.v1alpha1.ProfileStoreService/Write", store.write,
+	))
+	srv := httptest.NewUnstartedServer(mux)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	conf := defaultConfig().Write
+	conf.Mode = writeModeArrow
+	conf.LabelSets = []map[string]string{{"instance": "a"}, {"instance": "b"}}
+	conf.Profile.Samples = 50
+	conf.Profile.Seed = 1
+	w, err := NewWriter(prometheus.NewRegistry(), profilestorev1alpha1connect.NewProfileStoreServiceClient(srv.Client(), srv.URL), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.profiles = newProfileGenerator(conf.Profile)
+
+	for range 2 {
+		if err := w.writeArrow(context.Background(), time.Now(), time.Second); err != nil {
+			t.Fatalf("writeArrow() error = %v", err)
+		}
+	}
+	if len(store.asked) != 2 || store.asked[0] == 0 {
+		t.Fatalf("Parca was asked for %v stacktraces, want some in the first of two streams", store.asked)
+	}
+	if got := testutil.ToFloat64(w.metrics.writeCounter.WithLabelValues(grpcCodeOK)); got != 2 {
+		t.Errorf("parca_client_write_total{grpc_code=%q} = %g, want 2", grpcCodeOK, got)
+	}
+
+	// A stream that fails counts by its code.
+	srv.Close()
+	if err := w.writeArrow(context.Background(), time.Now(), time.Second); err == nil {
+		t.Error("writeArrow() against a closed server succeeded")
+	}
+	if got := testutil.ToFloat64(w.metrics.writeCounter.WithLabelValues(grpcCodeOK)); got != 2 {
+		t.Errorf("parca_client_write_total{grpc_code=%q} = %g after a failure, want 2", grpcCodeOK, got)
+	}
+}